@@ -0,0 +1,55 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"flag"
+
+	"github.com/ellotheth/pipethis/fetch"
+)
+
+// httpClient downloads scripts and signatures, and is handed to the key
+// lookup services. It's replaced once the command line is parsed.
+var httpClient = fetch.Default()
+
+// clientFlags adds the HTTP client options to flags. The function it returns
+// builds the client from them, once they're parsed, and makes it httpClient.
+func clientFlags(flags *flag.FlagSet) func() (*fetch.Client, error) {
+	defaults := fetch.DefaultOptions()
+	options := &fetch.Options{}
+
+	flags.DurationVar(&options.Timeout, "timeout", defaults.Timeout, "How long to wait to connect and get a response from a server")
+	flags.IntVar(&options.Retries, "retries", defaults.Retries, "How many times to retry downloads after network errors and 429 or 5xx responses")
+	flags.StringVar(&options.Proxy, "proxy", "", "Proxy URL for every download (default $HTTPS_PROXY or $HTTP_PROXY)")
+	flags.StringVar(&options.CABundle, "ca-bundle", "", "PEM file of CA certificates to trust, besides the system's")
+	flags.StringVar(&options.ClientCert, "client-cert", "", "PEM certificate for TLS client authentication")
+	flags.StringVar(&options.ClientKey, "client-key", "", "PEM private key for -client-cert, if it's not in the same file")
+	flags.Int64Var(&options.MaxBodySize, "max-size", defaults.MaxBodySize, "Largest download to accept, in bytes (0 for no limit)")
+	flags.BoolVar(&options.AllowInsecure, "allow-insecure", false, "Allow downloads over plain HTTP, and redirects from HTTPS to HTTP")
+	flags.StringVar(&options.S3Endpoint, "s3-endpoint", "", "S3-compatible object store for s3:// URLs (default AWS, in -s3-region)")
+	flags.StringVar(&options.S3Region, "s3-region", "", "Region to sign s3:// requests for (default $AWS_REGION, or us-east-1)")
+	flags.Var((*stringsFlag)(&options.RedirectHosts), "redirect-host", "Another host downloads can be redirected to, like objects.example.com or *.example.com. Repeat it for more than one. (default only the same host)")
+
+	return func() (*fetch.Client, error) {
+		options.Backoff = defaults.Backoff
+		options.UserAgent = defaults.UserAgent
+		if build != "" {
+			options.UserAgent += "/" + build
+		}
+
+		client, err := fetch.NewClient(*options)
+		if err != nil {
+			return nil, err
+		}
+
+		httpClient = client
+		return client, nil
+	}
+}
@@ -0,0 +1,387 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+// Package fetch is the HTTP client for everything pipethis downloads: scripts,
+// signatures, and keys. Scripts and signatures can also come from any URL
+// scheme with a registered Fetcher.
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrTooLarge is returned when reading a response body bigger than
+// Options.MaxBodySize.
+var ErrTooLarge = errors.New("The response is bigger than the maximum size")
+
+// Options configure a Client.
+type Options struct {
+	// Timeout limits connecting, the TLS handshake, and waiting for the
+	// response headers. It doesn't limit reading the body, so big downloads
+	// aren't cut off.
+	Timeout time.Duration
+	// Retries is how many more times to try a GET after a network error or a
+	// 429 or 5xx response. Backoff is the wait before the first retry; it
+	// doubles after each one.
+	Retries int
+	Backoff time.Duration
+	// Proxy is the proxy URL. If it's empty, HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY are used.
+	Proxy string
+	// CABundle is a PEM file of certificates to trust, besides the system's.
+	CABundle string
+	// ClientCert and ClientKey are PEM files for TLS client authentication.
+	// ClientKey can be left out if the key is in ClientCert.
+	ClientCert string
+	ClientKey  string
+	// MaxBodySize is the most a response body can hold, in bytes. 0 is no
+	// limit.
+	MaxBodySize int64
+	UserAgent   string
+	// AllowInsecure allows plain HTTP downloads, and redirects from HTTPS
+	// to HTTP.
+	AllowInsecure bool
+	// RedirectHosts are the other hosts a redirect can go to. They can start
+	// with *. for any subdomain, or be * for anywhere.
+	RedirectHosts []string
+	// S3Endpoint is the S3-compatible object store for s3:// URLs, and
+	// S3Region is the region requests to it are signed for. They default to
+	// AWS, and AWS_REGION.
+	S3Endpoint string
+	S3Region   string
+}
+
+// DefaultOptions are the Options pipethis uses unless it's told otherwise.
+func DefaultOptions() Options {
+	return Options{
+		Timeout:     30 * time.Second,
+		Retries:     2,
+		Backoff:     time.Second,
+		MaxBodySize: 100 << 20,
+		UserAgent:   "pipethis",
+	}
+}
+
+// Client is an HTTP client configured with Options.
+type Client struct {
+	http    *http.Client
+	options Options
+}
+
+// Default is a Client with the DefaultOptions.
+func Default() *Client {
+	client, _ := NewClient(DefaultOptions())
+	return client
+}
+
+// NewClient creates a Client. It returns an error if the CA bundle, client
+// certificate or proxy can't be used.
+func NewClient(options Options) (*Client, error) {
+	config := &tls.Config{}
+
+	if options.CABundle != "" {
+		pem, err := ioutil.ReadFile(options.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + options.CABundle)
+		}
+		config.RootCAs = roots
+	}
+
+	if options.ClientCert != "" {
+		key := options.ClientKey
+		if key == "" {
+			key = options.ClientCert
+		}
+
+		cert, err := tls.LoadX509KeyPair(options.ClientCert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if options.Proxy != "" {
+		parsed, err := url.Parse(options.Proxy)
+		if err != nil || parsed.Host == "" {
+			return nil, errors.New("Invalid proxy URL " + options.Proxy)
+		}
+		proxy = http.ProxyURL(parsed)
+	}
+
+	dialer := &net.Dialer{Timeout: options.Timeout, KeepAlive: 30 * time.Second}
+	base := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       config,
+		TLSHandshakeTimeout:   options.Timeout,
+		ResponseHeaderTimeout: options.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	return &Client{
+		http: &http.Client{
+			Transport:     &transport{base: base, options: options},
+			CheckRedirect: options.checkRedirect,
+		},
+		options: options,
+	}, nil
+}
+
+// MaxBodySize is the most a download can hold, in bytes. 0 is no limit.
+func (c *Client) MaxBodySize() int64 {
+	return c.options.MaxBodySize
+}
+
+// HTTPContext is HTTP, but every request it makes is cancelled along with
+// ctx. It's for code that doesn't take a context itself.
+func (c *Client) HTTPContext(ctx context.Context) *http.Client {
+	return &http.Client{
+		Transport:     contextTransport{ctx: ctx, base: c.http.Transport},
+		CheckRedirect: c.http.CheckRedirect,
+	}
+}
+
+// HTTP is the underlying http.Client, for code that handles status codes
+// itself. It still retries, limits body sizes, sends the User-Agent and
+// checks redirects.
+func (c *Client) HTTP() *http.Client {
+	return c.http
+}
+
+// Get fetches location, which has to be HTTPS unless Options.AllowInsecure is
+// set. Anything but a 2xx response is a *StatusError. The response's Request
+// has the URL it ended up at, after any redirects. If the connection drops
+// partway through the body, reading it resumes the download with a range
+// request when the server allows it; a body that's shorter than its
+// Content-Length is an error.
+func (c *Client) Get(location string) (*http.Response, error) {
+	return c.GetContext(context.Background(), location)
+}
+
+// GetContext is Get, but it stops (even partway through the body) when ctx is
+// cancelled.
+func (c *Client) GetContext(ctx context.Context, location string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Do(req)
+}
+
+// Do is GetContext for a request that's already been made, for fetchers that
+// need to add headers to it. The headers are sent again if the download has
+// to be resumed.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	location := req.URL.String()
+	if req.URL.Scheme != "https" && !c.options.AllowInsecure {
+		return nil, fmt.Errorf("Refusing to download %s without HTTPS (use -allow-insecure to allow it)", location)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &StatusError{URL: location, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	// the size limit covers the whole body, however many requests it takes
+	body := newResumableBody(c, resp)
+	resp.Body = limitedBody{Reader: LimitReader(body, c.options.MaxBodySize), Closer: body}
+
+	return resp, nil
+}
+
+// StatusError is a response that wasn't a 2xx.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Couldn't get %s: %s", e.URL, e.Status)
+}
+
+// checkRedirect refuses redirects from HTTPS to anything else, and to hosts
+// other than the one the request started at, unless the options allow them.
+func (o Options) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("Stopped after 10 redirects")
+	}
+
+	previous := via[len(via)-1].URL
+	if previous.Scheme == "https" && req.URL.Scheme != "https" && !o.AllowInsecure {
+		return fmt.Errorf("Refusing to follow a redirect from %s to %s without HTTPS (use -allow-insecure to allow it)", previous, req.URL)
+	}
+
+	origin := via[0].URL
+	anyHost := req.Context().Value(anyHostKey{}) != nil
+	if !strings.EqualFold(origin.Host, req.URL.Host) && !anyHost && !o.redirectAllowed(req.URL.Hostname()) {
+		return fmt.Errorf("Refusing to follow a redirect from %s to %s on another host (use -redirect-host to allow it)", origin, req.URL)
+	}
+
+	return nil
+}
+
+// anyHostKey marks requests that can be redirected to any host, like OCI
+// blobs, which are checked against their digest wherever they come from.
+type anyHostKey struct{}
+
+func (o Options) redirectAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range o.RedirectHosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == host || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contextTransport gives every request ctx.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// transport adds the User-Agent, retries and body size limit to every
+// request.
+type transport struct {
+	base    http.RoundTripper
+	options Options
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.options.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.options.UserAgent)
+	}
+
+	delay := t.options.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.options.Retries || !retryable(req, resp, err) {
+			if err != nil {
+				return nil, err
+			}
+			return t.limit(resp)
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+	}
+}
+
+// retryable is true for GETs and HEADs that failed in a way that might not
+// happen next time.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+func (t *transport) limit(resp *http.Response) (*http.Response, error) {
+	if t.options.MaxBodySize <= 0 {
+		return resp, nil
+	}
+
+	if resp.ContentLength > t.options.MaxBodySize {
+		resp.Body.Close()
+		return nil, ErrTooLarge
+	}
+
+	resp.Body = limitedBody{Reader: LimitReader(resp.Body, t.options.MaxBodySize), Closer: resp.Body}
+	return resp, nil
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// LimitReader reads from reader, and fails with ErrTooLarge once there's more
+// than max bytes. 0 is no limit.
+func LimitReader(reader io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return reader
+	}
+
+	return &limitedReader{reader: reader, remaining: max}
+}
+
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.reader.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, ErrTooLarge
+	}
+
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,217 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ClientTest struct {
+	suite.Suite
+	server   *httptest.Server
+	attempts int
+}
+
+func (s *ClientTest) SetupTest() {
+	s.attempts = 0
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/agent":
+			fmt.Fprint(w, r.Header.Get("User-Agent"))
+		case "/flaky":
+			s.attempts++
+			if s.attempts < 3 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, "finally")
+		case "/moved":
+			http.Redirect(w, r, "/agent", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, strings.Replace(s.server.URL, "127.0.0.1", "localhost", 1)+"/agent", http.StatusFound)
+		case "/big":
+			w.Header().Set("Content-Length", "2048")
+			w.Write(make([]byte, 2048))
+		case "/chunked":
+			w.Write(make([]byte, 1024))
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 1024))
+		default:
+			s.attempts++
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func (s *ClientTest) TearDownTest() {
+	s.server.Close()
+}
+
+// client makes a Client for the plain HTTP test server.
+func (s *ClientTest) client(options Options) *Client {
+	options.AllowInsecure = true
+	client, err := NewClient(options)
+	s.Require().NoError(err)
+	return client
+}
+
+func (s *ClientTest) read(client *Client, path string) (string, error) {
+	resp, err := client.Get(s.server.URL + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func (s *ClientTest) TestSendsUserAgent() {
+	body, err := s.read(s.client(Options{UserAgent: "pipethis/test"}), "/agent")
+	s.NoError(err)
+	s.Equal("pipethis/test", body)
+}
+
+func (s *ClientTest) TestRetriesServerErrors() {
+	body, err := s.read(s.client(Options{Retries: 2}), "/flaky")
+	s.NoError(err)
+	s.Equal("finally", body)
+	s.Equal(3, s.attempts)
+
+	s.attempts = 0
+	_, err = s.read(s.client(Options{Retries: 1}), "/flaky")
+	s.Error(err)
+	s.Equal(2, s.attempts)
+}
+
+func (s *ClientTest) TestNon2xxIsAnError() {
+	_, err := s.read(s.client(Options{Retries: 2}), "/missing")
+	s.Require().Error(err)
+	s.Equal(http.StatusNotFound, err.(*StatusError).StatusCode)
+	s.Equal(1, s.attempts, "a 404 isn't worth retrying")
+
+	// the underlying client leaves status codes alone
+	resp, err := s.client(Options{}).HTTP().Get(s.server.URL + "/missing")
+	s.NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *ClientTest) TestMaxBodySize() {
+	client := s.client(Options{MaxBodySize: 1024})
+
+	_, err := s.read(client, "/big")
+	s.True(errors.Is(err, ErrTooLarge), err)
+
+	_, err = s.read(client, "/chunked")
+	s.Equal(ErrTooLarge, err)
+
+	body, err := s.read(s.client(Options{MaxBodySize: 2048}), "/chunked")
+	s.NoError(err)
+	s.Len(body, 2048)
+}
+
+func (s *ClientTest) TestHTTPSOnly() {
+	client, err := NewClient(Options{})
+	s.Require().NoError(err)
+
+	_, err = client.Get(s.server.URL + "/agent")
+	s.EqualError(err, "Refusing to download "+s.server.URL+"/agent without HTTPS (use -allow-insecure to allow it)")
+}
+
+func (s *ClientTest) TestRedirects() {
+	resp, err := s.client(Options{}).Get(s.server.URL + "/moved")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(s.server.URL+"/agent", resp.Request.URL.String())
+
+	_, err = s.client(Options{}).Get(s.server.URL + "/elsewhere")
+	s.Error(err)
+
+	resp, err = s.client(Options{RedirectHosts: []string{"localhost"}}).Get(s.server.URL + "/elsewhere")
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal("localhost", resp.Request.URL.Hostname())
+}
+
+func (s *ClientTest) TestCheckRedirect() {
+	request := func(location string) *http.Request {
+		req, err := http.NewRequest("GET", location, nil)
+		s.Require().NoError(err)
+		return req
+	}
+	via := []*http.Request{request("https://get.example.com/install.sh")}
+
+	s.NoError(Options{}.checkRedirect(request("https://get.example.com/v2/install.sh"), via))
+	s.Error(Options{}.checkRedirect(request("http://get.example.com/install.sh"), via))
+	s.NoError(Options{AllowInsecure: true}.checkRedirect(request("http://get.example.com/install.sh"), via))
+
+	s.Error(Options{}.checkRedirect(request("https://cdn.example.net/install.sh"), via))
+	s.NoError(Options{RedirectHosts: []string{"*.example.net"}}.checkRedirect(request("https://cdn.example.net/install.sh"), via))
+	s.NoError(Options{RedirectHosts: []string{"*"}}.checkRedirect(request("https://cdn.example.org/install.sh"), via))
+	s.Error(Options{RedirectHosts: []string{"*.example.net"}}.checkRedirect(request("https://example.net.evil.com/install.sh"), via))
+}
+
+func (s *ClientTest) TestCABundle() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer server.Close()
+
+	_, err := s.client(Options{}).Get(server.URL)
+	s.Error(err, "the test server's certificate isn't trusted by default")
+
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	s.Require().NoError(ioutil.WriteFile(bundle, cert, 0644))
+
+	resp, err := s.client(Options{CABundle: bundle}).Get(server.URL)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	s.Equal("secure", string(body))
+
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, []byte("nothing"), 0644)
+	_, err = NewClient(Options{CABundle: empty})
+	s.Error(err)
+}
+
+func (s *ClientTest) TestBadOptions() {
+	for _, options := range []Options{
+		{CABundle: "missing.pem"},
+		{ClientCert: "missing.pem"},
+		{Proxy: "not a proxy"},
+	} {
+		_, err := NewClient(options)
+		s.Error(err, fmt.Sprintf("%+v", options))
+	}
+
+	s.True(strings.HasPrefix(DefaultOptions().UserAgent, "pipethis"))
+}
+
+func TestClientTest(t *testing.T) {
+	suite.Run(t, new(ClientTest))
+}
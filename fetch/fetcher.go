@@ -0,0 +1,176 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Resource is something that was fetched: its contents, where it really came
+// from (after any redirects), and its response headers, if it has any.
+type Resource struct {
+	Body     io.ReadCloser
+	Location string
+	Header   http.Header
+	// Size is how long Body is, or -1 if that isn't known.
+	Size int64
+}
+
+// Fetcher opens location, a URL with one of the schemes it was registered
+// for. client has the network options.
+type Fetcher func(ctx context.Context, client *Client, location *url.URL) (*Resource, error)
+
+var (
+	fetchersMu sync.RWMutex
+	fetchers   = map[string]Fetcher{}
+)
+
+func init() {
+	Register("http", fetchHTTP)
+	Register("https", fetchHTTP)
+	Register("file", fetchFile)
+	Register("data", fetchData)
+}
+
+// Register makes a Fetcher available for URLs with scheme. It panics if the
+// scheme is already taken or the fetcher is nil, the same way
+// lookup.Register does.
+func Register(scheme string, fetcher Fetcher) {
+	fetchersMu.Lock()
+	defer fetchersMu.Unlock()
+
+	if fetcher == nil {
+		panic("fetch: Register fetcher is nil")
+	}
+	if _, dup := fetchers[scheme]; dup {
+		panic("fetch: Register called twice for " + scheme)
+	}
+
+	fetchers[scheme] = fetcher
+}
+
+// Schemes returns the sorted schemes of all the registered Fetchers.
+func Schemes() []string {
+	fetchersMu.RLock()
+	defer fetchersMu.RUnlock()
+
+	schemes := []string{}
+	for scheme := range fetchers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// Open fetches location with the Fetcher registered for its scheme. Its body
+// is limited to Options.MaxBodySize, whatever the scheme.
+func (c *Client) Open(ctx context.Context, location string) (*Resource, error) {
+	parsed, err := url.Parse(location)
+	if err != nil || parsed.Scheme == "" {
+		return nil, errors.New("Invalid URL")
+	}
+
+	fetchersMu.RLock()
+	fetcher, ok := fetchers[strings.ToLower(parsed.Scheme)]
+	fetchersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unsupported URL scheme %q; use one of: %s", parsed.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	resource, err := fetcher(ctx, c, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.options.MaxBodySize > 0 && resource.Size > c.options.MaxBodySize {
+		resource.Body.Close()
+		return nil, ErrTooLarge
+	}
+	resource.Body = limitedBody{Reader: LimitReader(resource.Body, c.options.MaxBodySize), Closer: resource.Body}
+
+	return resource, nil
+}
+
+func fetchHTTP(ctx context.Context, client *Client, location *url.URL) (*Resource, error) {
+	resp, err := client.GetContext(ctx, location.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Resource{Body: resp.Body, Location: resp.Request.URL.String(), Header: resp.Header, Size: resp.ContentLength}, nil
+}
+
+// fetchFile opens file:///path URLs. Only local files work.
+func fetchFile(ctx context.Context, client *Client, location *url.URL) (*Resource, error) {
+	if location.Host != "" && location.Host != "localhost" {
+		return nil, errors.New("Only local file:// URLs work, not " + location.String())
+	}
+
+	file, err := os.Open(location.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, errors.New(location.Path + " is a directory")
+	}
+
+	return &Resource{Body: file, Location: location.String(), Header: http.Header{}, Size: info.Size()}, nil
+}
+
+// fetchData decodes data: URLs, like data:text/plain;base64,ZWNobyBoaQ==.
+func fetchData(ctx context.Context, client *Client, location *url.URL) (*Resource, error) {
+	raw := strings.TrimPrefix(location.String(), location.Scheme+":")
+	comma := strings.Index(raw, ",")
+	if comma < 0 {
+		return nil, errors.New("Invalid data: URL; it needs a comma before the data")
+	}
+
+	mediaType, data := raw[:comma], raw[comma+1:]
+	var contents []byte
+	var err error
+	if strings.HasSuffix(mediaType, ";base64") {
+		contents, err = base64.StdEncoding.DecodeString(data)
+	} else {
+		var unescaped string
+		unescaped, err = url.PathUnescape(data)
+		contents = []byte(unescaped)
+	}
+	if err != nil {
+		return nil, errors.New("Invalid data: URL: " + err.Error())
+	}
+
+	header := http.Header{}
+	if mediaType = strings.TrimSuffix(mediaType, ";base64"); mediaType != "" {
+		header.Set("Content-Type", mediaType)
+	}
+
+	return &Resource{Body: ioutil.NopCloser(bytes.NewReader(contents)), Location: location.String(), Header: header, Size: int64(len(contents))}, nil
+}
@@ -0,0 +1,111 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	for _, transport := range []string{"https", "http", "ssh", "file"} {
+		Register("git+"+transport, fetchGit)
+	}
+}
+
+// fetchGit reads one file from a git repository at a ref, with URLs like
+// git+https://github.com/example/repo.git#v1.2.0:scripts/install.sh. It runs
+// git, so git's own configuration (not Options) decides how it connects. The
+// resource's location names the commit the ref pointed to.
+func fetchGit(ctx context.Context, client *Client, location *url.URL) (*Resource, error) {
+	transport := strings.TrimPrefix(strings.ToLower(location.Scheme), "git+")
+	if transport == "http" && !client.options.AllowInsecure {
+		return nil, fmt.Errorf("Refusing to download %s without HTTPS (use -allow-insecure to allow it)", location)
+	}
+
+	parts := strings.SplitN(location.Fragment, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("git URLs need the ref and file after a #, like " + location.Scheme + "://host/repo.git#main:install.sh")
+	}
+	ref, file := parts[0], parts[1]
+	if strings.HasPrefix(ref, "-") {
+		return nil, errors.New("Invalid git ref " + ref)
+	}
+
+	repo := *location
+	repo.Scheme = transport
+	repo.Fragment = ""
+
+	dir, err := ioutil.TempDir("", "pipethis-git-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) ([]byte, error) {
+		stderr := &bytes.Buffer{}
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+transport)
+		cmd.Stderr = stderr
+
+		out, err := cmd.Output()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+
+	if _, err := git("init", "-q"); err != nil {
+		return nil, err
+	}
+	if _, err := git("fetch", "-q", "--depth", "1", "--", repo.String(), ref); err != nil {
+		return nil, err
+	}
+
+	commit, err := git("rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return nil, err
+	}
+	object := strings.TrimSpace(string(commit)) + ":" + strings.TrimPrefix(file, "/")
+
+	size, err := git("cat-file", "-s", object)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseInt(strings.TrimSpace(string(size)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if client.options.MaxBodySize > 0 && length > client.options.MaxBodySize {
+		return nil, ErrTooLarge
+	}
+
+	contents, err := git("cat-file", "blob", object)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := *location
+	resolved.Fragment = object
+	return &Resource{Body: ioutil.NopCloser(bytes.NewReader(contents)), Location: resolved.String(), Header: http.Header{}, Size: length}, nil
+}
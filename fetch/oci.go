@@ -0,0 +1,446 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType    = "application/vnd.oci.image.index.v1+json"
+	// ociTitle is the annotation that names a layer's file.
+	ociTitle = "org.opencontainers.image.title"
+	// maxManifestSize is the most a manifest or index can hold.
+	maxManifestSize = 4 << 20
+)
+
+func init() {
+	Register("oci", fetchOCI)
+}
+
+// ociDescriptor points to a manifest or a blob in a registry.
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is an image manifest, or an index of them.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// fetchOCI pulls a script from an OCI artifact, with URLs like
+// oci://registry.example.com/team/installers:v1 (or @sha256:...). If the
+// artifact has more than one layer, the fragment picks one by its title, like
+// oci://registry.example.com/team/installers:v1#install.sh.
+//
+// The resource's location names the manifest by digest. Its X-Signature-URL
+// headers point to the artifact's referrers, and its cosign-style
+// sha256-<digest>.sig tag, so Signature finds them along with the <tag>.sig
+// tag it tries anyway.
+func fetchOCI(ctx context.Context, client *Client, location *url.URL) (*Resource, error) {
+	repo, reference := parseOCIPath(location.Path)
+	if location.Host == "" || repo == "" || reference == "" {
+		return nil, errors.New("OCI URLs need a registry, repository and tag or digest, like oci://registry.example.com/team/installers:v1")
+	}
+
+	registry := newOCIRegistry(ctx, client, location.Host, repo)
+	manifest, digest, err := registry.manifest(reference)
+	if err != nil {
+		return nil, err
+	}
+
+	layer, err := manifest.layer(location.Fragment)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", location, err)
+	}
+
+	body, err := registry.blob(layer)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := url.URL{Scheme: location.Scheme, Host: location.Host, Path: "/" + repo + "@" + digest, Fragment: location.Fragment}
+	header := http.Header{}
+	for _, referrer := range registry.referrers(digest) {
+		header.Add("X-Signature-URL", (&url.URL{Scheme: location.Scheme, Host: location.Host, Path: "/" + repo + "@" + referrer.Digest}).String())
+	}
+	header.Add("X-Signature-URL", (&url.URL{Scheme: location.Scheme, Host: location.Host, Path: "/" + repo + ":" + strings.Replace(digest, ":", "-", 1) + ".sig"}).String())
+
+	return &Resource{Body: body, Location: resolved.String(), Header: header, Size: layer.Size}, nil
+}
+
+// parseOCIPath splits /team/installers:v1 or /team/installers@sha256:... into
+// the repository and the tag or digest.
+func parseOCIPath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	if at := strings.Index(path, "@"); at >= 0 {
+		return path[:at], path[at+1:]
+	}
+
+	if colon := strings.LastIndex(path, ":"); colon > strings.LastIndex(path, "/") {
+		return path[:colon], path[colon+1:]
+	}
+
+	return path, ""
+}
+
+// layer picks the layer with title, or the only layer if title is empty.
+func (m ociManifest) layer(title string) (ociDescriptor, error) {
+	if m.MediaType == ociIndexType || len(m.Manifests) > 0 {
+		return ociDescriptor{}, errors.New("The tag is an index of images, not an artifact")
+	}
+
+	titles := []string{}
+	for _, layer := range m.Layers {
+		if title != "" && layer.Annotations[ociTitle] == title {
+			return layer, nil
+		}
+		titles = append(titles, layer.Annotations[ociTitle])
+	}
+
+	if title == "" && len(m.Layers) == 1 {
+		return m.Layers[0], nil
+	}
+	if title == "" {
+		return ociDescriptor{}, fmt.Errorf("The artifact has %d layers; pick one with #<title> (one of: %s)", len(m.Layers), strings.Join(titles, ", "))
+	}
+
+	return ociDescriptor{}, errors.New("The artifact doesn't have a layer titled " + title)
+}
+
+// plainRegistries are the registries that turned out to only speak plain
+// HTTP, so they don't have to be tried with HTTPS every time.
+var plainRegistries sync.Map
+
+// ociRegistry talks to one repository in a registry, with the distribution
+// API. Registries are tried with HTTPS first, then plain HTTP if they don't
+// speak TLS at all and they're on this machine (like Docker does) or
+// Options.AllowInsecure is set.
+type ociRegistry struct {
+	ctx    context.Context
+	client *Client
+	host   string
+	repo   string
+	token  string
+}
+
+func newOCIRegistry(ctx context.Context, client *Client, host, repo string) *ociRegistry {
+	return &ociRegistry{ctx: ctx, client: client, host: host, repo: repo}
+}
+
+func (r *ociRegistry) scheme() string {
+	if _, plain := plainRegistries.Load(r.host); plain {
+		return "http"
+	}
+
+	return "https"
+}
+
+// plainAllowed is true if host (the registry, or where its tokens come from)
+// can be used without HTTPS.
+func (r *ociRegistry) plainAllowed(host string) bool {
+	if r.client.options.AllowInsecure {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// get requests path in the repository, getting a token if the registry asks
+// for one. Blobs can be redirected to any host, since they're checked against
+// their digest.
+func (r *ociRegistry) get(path, accept string, blob bool) (*http.Response, error) {
+	resp, err := r.request(path, accept, blob)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		if err := r.authorize(challenge); err != nil {
+			return nil, err
+		}
+		resp, err = r.request(path, accept, blob)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &StatusError{URL: resp.Request.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp, nil
+}
+
+func (r *ociRegistry) request(path, accept string, blob bool) (*http.Response, error) {
+	ctx := r.ctx
+	if blob {
+		ctx = context.WithValue(ctx, anyHostKey{}, true)
+	}
+
+	do := func(scheme string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+r.host+"/v2/"+r.repo+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", accept)
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+
+		return r.client.http.Do(req)
+	}
+
+	scheme := r.scheme()
+	resp, err := do(scheme)
+	// only a server that doesn't speak TLS gets tried without it; a bad
+	// certificate is an error whatever the host
+	if err != nil && scheme == "https" && notTLS(err) && r.plainAllowed(r.host) && r.ctx.Err() == nil {
+		if resp, plainErr := do("http"); plainErr == nil {
+			plainRegistries.Store(r.host, true)
+			return resp, nil
+		}
+	}
+
+	return resp, err
+}
+
+// notTLS is true if err is from a server that answered the TLS handshake
+// with something else, like plain HTTP.
+func notTLS(err error) bool {
+	var recordErr tls.RecordHeaderError
+	return errors.Is(err, http.ErrSchemeMismatch) || errors.As(err, &recordErr)
+}
+
+// authorize gets a bearer token for pulling from the repository, using
+// PIPETHIS_REGISTRY_USERNAME and PIPETHIS_REGISTRY_PASSWORD if they're set.
+func (r *ociRegistry) authorize(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "Bearer") || params["realm"] == "" {
+		return fmt.Errorf("The registry %s needs authentication pipethis can't do (%s)", r.host, challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+	if realm.Scheme != "https" && !r.plainAllowed(realm.Host) {
+		return fmt.Errorf("Refusing to get a registry token from %s without HTTPS (use -allow-insecure to allow it)", realm)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.repo + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if username := os.Getenv("PIPETHIS_REGISTRY_USERNAME"); username != "" {
+		req.SetBasicAuth(username, os.Getenv("PIPETHIS_REGISTRY_PASSWORD"))
+	}
+
+	resp, err := r.client.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{URL: realm.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token); err != nil {
+		return errors.New("Invalid registry token: " + err.Error())
+	}
+
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return errors.New("The registry didn't send a token")
+	}
+
+	return nil
+}
+
+// parseChallenge splits a WWW-Authenticate header like
+// `Bearer realm="https://auth.example.com/token",service="registry"` into its
+// scheme and parameters.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		params[name] = strings.TrimSpace(value)
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+
+	return parts[0], params
+}
+
+// manifest gets the manifest for a tag or digest, and its digest. Manifests
+// asked for by digest have to match it.
+func (r *ociRegistry) manifest(reference string) (ociManifest, string, error) {
+	manifest := ociManifest{}
+	resp, err := r.get("/manifests/"+reference, ociManifestType+", application/vnd.docker.distribution.manifest.v2+json, "+ociIndexType, false)
+	if err != nil {
+		return manifest, "", err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return manifest, "", err
+	}
+
+	sum := sha256.Sum256(contents)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if strings.Contains(reference, ":") && reference != digest {
+		return manifest, "", fmt.Errorf("The manifest's digest is %s, not %s", digest, reference)
+	}
+
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return manifest, "", errors.New("Invalid OCI manifest: " + err.Error())
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	return manifest, digest, nil
+}
+
+// blob downloads layer, and fails at the end if it doesn't match the layer's
+// digest.
+func (r *ociRegistry) blob(layer ociDescriptor) (io.ReadCloser, error) {
+	if !strings.HasPrefix(layer.Digest, "sha256:") {
+		return nil, errors.New("Unsupported layer digest " + layer.Digest)
+	}
+	if r.client.options.MaxBodySize > 0 && layer.Size > r.client.options.MaxBodySize {
+		return nil, ErrTooLarge
+	}
+
+	resp, err := r.get("/blobs/"+layer.Digest, "*/*", true)
+	if err != nil {
+		return nil, err
+	}
+
+	body := newResumableBody(r.client, resp)
+	return &digestReader{ReadCloser: body, hash: sha256.New(), digest: layer.Digest}, nil
+}
+
+// referrers lists the artifacts that refer to the manifest with digest, with
+// the referrers API or, for registries that don't have it, the
+// sha256-<digest> tag. Registries that don't have either have no referrers.
+func (r *ociRegistry) referrers(digest string) []ociDescriptor {
+	resp, err := r.get("/referrers/"+digest, ociIndexType, false)
+	if err == nil {
+		defer resp.Body.Close()
+
+		index := ociManifest{}
+		if json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&index) == nil {
+			return index.Manifests
+		}
+		return nil
+	}
+
+	index, _, err := r.manifest(strings.Replace(digest, ":", "-", 1))
+	if err != nil {
+		return nil
+	}
+
+	return index.Manifests
+}
+
+// digestReader checks everything read from it against digest, once it's all
+// been read.
+type digestReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	digest string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.hash.Write(p[:n])
+
+	if err == io.EOF {
+		if actual := "sha256:" + hex.EncodeToString(d.hash.Sum(nil)); actual != d.digest {
+			return n, fmt.Errorf("The blob's digest is %s, not %s", actual, d.digest)
+		}
+	}
+
+	return n, err
+}
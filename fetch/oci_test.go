@@ -0,0 +1,309 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// testRegistry is a stand-in for an OCI registry, with one repository.
+type testRegistry struct {
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	referrers map[string][]ociDescriptor
+	token     string
+	// realm is where tokens come from, if it isn't the registry.
+	realm string
+	// noReferrersAPI makes the registry 404 the referrers API, so clients
+	// have to use the sha256-<digest> tag.
+	noReferrersAPI bool
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}, referrers: map[string][]ociDescriptor{}}
+}
+
+func digestOf(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// push stores an artifact with a layer for each file, by title, and tags it.
+// If subject is set, the artifact refers to it. It returns the manifest's
+// digest.
+func (r *testRegistry) push(tag, subject string, files ...string) string {
+	manifest := ociManifest{MediaType: ociManifestType}
+	for i := 0; i < len(files); i += 2 {
+		contents := []byte(files[i+1])
+		digest := digestOf(contents)
+		r.blobs[digest] = contents
+		manifest.Layers = append(manifest.Layers, ociDescriptor{MediaType: "application/octet-stream", Digest: digest, Size: int64(len(contents)), Annotations: map[string]string{ociTitle: files[i]}})
+	}
+
+	contents, _ := json.Marshal(manifest)
+	digest := digestOf(contents)
+	r.manifests[digest] = contents
+	if tag != "" {
+		r.manifests[tag] = contents
+	}
+
+	if subject != "" {
+		r.referrers[subject] = append(r.referrers[subject], ociDescriptor{MediaType: ociManifestType, Digest: digest, Size: int64(len(contents)), ArtifactType: "application/pgp-signature"})
+		index, _ := json.Marshal(ociManifest{MediaType: ociIndexType, Manifests: r.referrers[subject]})
+		r.manifests[strings.Replace(subject, ":", "-", 1)] = index
+	}
+
+	return digest
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		fmt.Fprintf(w, `{"token": %q}`, r.token)
+		return
+	}
+
+	if strings.HasPrefix(req.URL.Path, "/storage/") {
+		w.Write(r.blobs[strings.TrimPrefix(req.URL.Path, "/storage/")])
+		return
+	}
+
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		realm := r.realm
+		if realm == "" {
+			realm = "http://" + req.Host + "/token"
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`",service="registry.test"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/v2/team/installers/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch parts[0] {
+	case "manifests":
+		contents, ok := r.manifests[parts[1]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", ociManifestType)
+		w.Write(contents)
+	case "blobs":
+		if _, ok := r.blobs[parts[1]]; !ok {
+			http.NotFound(w, req)
+			return
+		}
+		// blobs usually come from somewhere else
+		http.Redirect(w, req, "http://"+strings.Replace(req.Host, "127.0.0.1", "localhost", 1)+"/storage/"+parts[1], http.StatusTemporaryRedirect)
+	case "referrers":
+		if r.noReferrersAPI {
+			http.NotFound(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(ociManifest{MediaType: ociIndexType, Manifests: r.referrers[parts[1]]})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+type OCITest struct {
+	suite.Suite
+	registry *testRegistry
+	server   *httptest.Server
+	host     string
+	client   *Client
+}
+
+func (s *OCITest) SetupTest() {
+	s.registry = newTestRegistry()
+	s.server = httptest.NewServer(s.registry)
+	s.host = strings.TrimPrefix(s.server.URL, "http://")
+
+	var err error
+	s.client, err = NewClient(Options{})
+	s.Require().NoError(err)
+}
+
+func (s *OCITest) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *OCITest) open(location string) (string, *Resource, error) {
+	resource, err := s.client.Open(context.Background(), location)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resource.Body.Close()
+
+	contents, err := ioutil.ReadAll(resource.Body)
+	return string(contents), resource, err
+}
+
+func (s *OCITest) TestPullsScriptAndFindsSignatures() {
+	script := s.registry.push("v1", "", "install.sh", "echo from oci\n")
+	signature := s.registry.push("", script, "install.sh.sig", "-----BEGIN PGP SIGNATURE-----\n")
+
+	contents, resource, err := s.open("oci://" + s.host + "/team/installers:v1")
+	s.Require().NoError(err)
+	s.Equal("echo from oci\n", contents)
+	s.Equal("oci://"+s.host+"/team/installers@"+script, resource.Location)
+	s.Equal([]string{
+		"oci://" + s.host + "/team/installers@" + signature,
+		"oci://" + s.host + "/team/installers:" + strings.Replace(script, ":", "-", 1) + ".sig",
+	}, resource.Header["X-Signature-Url"])
+
+	contents, _, err = s.open(resource.Header["X-Signature-Url"][0])
+	s.NoError(err)
+	s.Equal("-----BEGIN PGP SIGNATURE-----\n", contents)
+
+	// the same thing, by digest
+	contents, _, err = s.open(resource.Location)
+	s.NoError(err)
+	s.Equal("echo from oci\n", contents)
+}
+
+func (s *OCITest) TestReferrersTagAndTokens() {
+	s.registry.noReferrersAPI = true
+	s.registry.token = "t0k3n"
+	script := s.registry.push("v1", "", "install.sh", "echo from oci\n")
+	signature := s.registry.push("", script, "install.sh.sig", "signature")
+
+	_, resource, err := s.open("oci://" + s.host + "/team/installers:v1")
+	s.Require().NoError(err)
+	s.Equal("oci://"+s.host+"/team/installers@"+signature, resource.Header.Get("X-Signature-Url"))
+}
+
+func (s *OCITest) TestTokensNeedHTTPSAwayFromHome() {
+	s.registry.token = "t0k3n"
+	s.registry.realm = "http://auth.invalid/token"
+	s.registry.push("v1", "", "install.sh", "echo from oci\n")
+
+	_, _, err := s.open("oci://" + s.host + "/team/installers:v1")
+	s.Require().Error(err)
+	s.Contains(err.Error(), "Refusing to get a registry token from http://auth.invalid/token")
+}
+
+func (s *OCITest) TestChecksDigests() {
+	script := s.registry.push("v1", "", "install.sh", "echo from oci\n")
+	s.registry.blobs[s.registry.push("v2", "", "install.sh", "echo v2\n")] = nil
+	for digest := range s.registry.blobs {
+		if digest != script {
+			s.registry.blobs[digest] = []byte("echo evil\n")
+		}
+	}
+
+	_, _, err := s.open("oci://" + s.host + "/team/installers:v2")
+	s.Error(err)
+
+	_, _, err = s.open("oci://" + s.host + "/team/installers@sha256:" + strings.Repeat("0", 64))
+	s.Error(err)
+
+	// a manifest asked for by digest has to have that digest
+	s.registry.manifests["sha256:"+strings.Repeat("1", 64)] = s.registry.manifests["v1"]
+	_, _, err = s.open("oci://" + s.host + "/team/installers@sha256:" + strings.Repeat("1", 64))
+	s.EqualError(err, "The manifest's digest is "+script+", not sha256:"+strings.Repeat("1", 64))
+}
+
+func (s *OCITest) TestPicksLayersByTitle() {
+	s.registry.push("v1", "", "install.sh", "echo install\n", "uninstall.sh", "echo uninstall\n")
+
+	_, _, err := s.open("oci://" + s.host + "/team/installers:v1")
+	s.EqualError(err, "oci://"+s.host+"/team/installers:v1: The artifact has 2 layers; pick one with #<title> (one of: install.sh, uninstall.sh)")
+
+	contents, resource, err := s.open("oci://" + s.host + "/team/installers:v1#uninstall.sh")
+	s.NoError(err)
+	s.Equal("echo uninstall\n", contents)
+	s.True(strings.HasSuffix(resource.Location, "#uninstall.sh"))
+
+	_, _, err = s.open("oci://" + s.host + "/team/installers:v1#missing.sh")
+	s.Error(err)
+}
+
+func (s *OCITest) TestNeedsHTTPSAwayFromHome() {
+	_, _, err := s.open("oci://registry.invalid/team/installers:v1")
+	s.Error(err)
+
+	_, _, err = s.open("oci://" + s.host + "/team/installers")
+	s.Error(err)
+}
+
+func (s *OCITest) TestHTTPS() {
+	server := httptest.NewTLSServer(s.registry)
+	defer server.Close()
+	s.registry.push("v1", "", "install.sh", "echo over https\n")
+
+	bundle := filepath.Join(os.TempDir(), "pipethis-registry-ca.pem")
+	defer os.Remove(bundle)
+	ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	client, err := NewClient(Options{CABundle: bundle})
+	s.Require().NoError(err)
+
+	// only the manifest; the blobs are redirected to plain HTTP
+	registry := newOCIRegistry(context.Background(), client, strings.TrimPrefix(server.URL, "https://"), "team/installers")
+	manifest, _, err := registry.manifest("v1")
+	s.NoError(err)
+	s.Len(manifest.Layers, 1)
+	s.Equal("https", registry.scheme())
+}
+
+func (s *OCITest) TestNoPlainHTTPAfterCertificateErrors() {
+	server := httptest.NewTLSServer(s.registry)
+	defer server.Close()
+	s.registry.push("v1", "", "install.sh", "echo over https\n")
+
+	// the registry's on this machine, but it does speak TLS, so its
+	// certificate has to be trusted
+	registry := newOCIRegistry(context.Background(), s.client, strings.TrimPrefix(server.URL, "https://"), "team/installers")
+	_, _, err := registry.manifest("v1")
+	s.Require().Error(err)
+	s.Contains(err.Error(), "certificate")
+	s.Equal("https", registry.scheme())
+}
+
+func (s *OCITest) TestParsing() {
+	repo, reference := parseOCIPath("/team/installers:v1")
+	s.Equal("team/installers", repo)
+	s.Equal("v1", reference)
+
+	repo, reference = parseOCIPath("/installers@sha256:abc")
+	s.Equal("installers", repo)
+	s.Equal("sha256:abc", reference)
+
+	repo, reference = parseOCIPath("/team/installers")
+	s.Equal("team/installers", repo)
+	s.Equal("", reference)
+
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/installers:pull"`)
+	s.Equal("Bearer", scheme)
+	s.Equal(map[string]string{"realm": "https://auth.example.com/token", "service": "registry.example.com", "scope": "repository:team/installers:pull"}, params)
+}
+
+func TestOCITest(t *testing.T) {
+	suite.Run(t, new(OCITest))
+}
@@ -0,0 +1,152 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// resumableBody is a response body that picks up where it left off when the
+// connection drops, with a range request. It only resumes when the server
+// takes byte ranges and the response has a strong ETag or a Last-Modified
+// date, so the rest is sure to be from the same file. It also makes sure
+// there's as much body as the Content-Length said there would be.
+type resumableBody struct {
+	ctx       context.Context
+	client    *Client
+	location  string
+	header    http.Header
+	body      io.ReadCloser
+	validator string
+	length    int64
+	read      int64
+	retries   int
+	delay     time.Duration
+}
+
+func newResumableBody(client *Client, resp *http.Response) *resumableBody {
+	body := &resumableBody{
+		ctx:      resp.Request.Context(),
+		client:   client,
+		location: resp.Request.URL.String(),
+		header:   resp.Request.Header.Clone(),
+		body:     resp.Body,
+		length:   resp.ContentLength,
+		retries:  client.options.Retries,
+		delay:    client.options.Backoff,
+	}
+
+	if strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes") {
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			body.validator = etag
+		} else {
+			body.validator = resp.Header.Get("Last-Modified")
+		}
+	}
+
+	return body
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.read += int64(n)
+
+		if err == io.EOF && b.length >= 0 && b.read < b.length {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF || errors.Is(err, ErrTooLarge) {
+			return n, err
+		}
+
+		// hand over what was read; the error will still be there next time
+		if n > 0 {
+			return n, nil
+		}
+
+		if resumeErr := b.resume(); resumeErr != nil {
+			return 0, fmt.Errorf("%s (and couldn't resume: %s)", err, resumeErr)
+		}
+	}
+}
+
+// resume asks for the rest of the body, from the last byte that was read.
+func (b *resumableBody) resume() error {
+	if b.validator == "" {
+		return errors.New("the server doesn't support resuming it")
+	}
+	if b.retries <= 0 {
+		return errors.New("out of retries")
+	}
+	b.retries--
+
+	select {
+	case <-time.After(b.delay):
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+	b.delay *= 2
+
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.location, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range b.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.read))
+	req.Header.Set("If-Range", b.validator)
+
+	resp, err := b.client.http.Do(req)
+	if err != nil {
+		return err
+	}
+
+	start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if resp.StatusCode != http.StatusPartialContent || !ok || start != b.read || (b.length >= 0 && total >= 0 && total != b.length) {
+		resp.Body.Close()
+		return fmt.Errorf("the server sent %s instead of the rest of the file", resp.Status)
+	}
+
+	b.body.Close()
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
+
+// parseContentRange reads the first byte and the total length out of a
+// Content-Range header like "bytes 100-999/1000". The total is -1 if it's *.
+func parseContentRange(header string) (int64, int64, bool) {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		return 0, 0, false
+	}
+
+	if total == "*" {
+		return start, -1, true
+	}
+
+	var length int64
+	if _, err := fmt.Sscanf(total, "%d", &length); err != nil {
+		return 0, 0, false
+	}
+
+	return start, length, true
+}
@@ -0,0 +1,114 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ResumeTest struct {
+	suite.Suite
+	server   *httptest.Server
+	contents []byte
+	ranges   []string
+}
+
+func (s *ResumeTest) SetupTest() {
+	s.contents = bytes.Repeat([]byte("echo resumed\n"), 1000)
+	s.ranges = []string{}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+
+		// the first response drops the connection halfway through
+		if r.Header.Get("Range") == "" {
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n", len(s.contents))
+			if r.URL.Path != "/plain" {
+				fmt.Fprint(buf, "Accept-Ranges: bytes\r\nETag: \"v1\"\r\n")
+			}
+			fmt.Fprint(buf, "\r\n")
+			buf.Write(s.contents[:len(s.contents)/2])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+
+		etag := `"v1"`
+		if r.URL.Path == "/changed" {
+			etag = `"v2"`
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "install.sh", time.Time{}, bytes.NewReader(s.contents))
+	}))
+}
+
+func (s *ResumeTest) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *ResumeTest) get(path string) ([]byte, error) {
+	client, err := NewClient(Options{AllowInsecure: true, Retries: 1})
+	s.Require().NoError(err)
+
+	resp, err := client.Get(s.server.URL + path)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *ResumeTest) TestResumesWithRange() {
+	body, err := s.get("/resumable")
+	s.NoError(err)
+	s.Equal(s.contents, body)
+	s.Equal([]string{"", fmt.Sprintf("bytes=%d-", len(s.contents)/2)}, s.ranges)
+}
+
+func (s *ResumeTest) TestTruncatedBodyIsAnError() {
+	_, err := s.get("/plain")
+	s.Error(err)
+	s.True(strings.Contains(err.Error(), "doesn't support resuming"), err.Error())
+	s.Len(s.ranges, 1)
+}
+
+func (s *ResumeTest) TestDoesntMixVersions() {
+	_, err := s.get("/changed")
+	s.Error(err)
+	s.True(strings.Contains(err.Error(), "200 OK instead of the rest"), err.Error())
+}
+
+func (s *ResumeTest) TestParseContentRange() {
+	start, total, ok := parseContentRange("bytes 100-999/1000")
+	s.True(ok)
+	s.Equal(int64(100), start)
+	s.Equal(int64(1000), total)
+
+	start, total, ok = parseContentRange("bytes 5-9/*")
+	s.True(ok)
+	s.Equal(int64(5), start)
+	s.Equal(int64(-1), total)
+
+	_, _, ok = parseContentRange("bytes */1000")
+	s.False(ok)
+}
+
+func TestResumeTest(t *testing.T) {
+	suite.Run(t, new(ResumeTest))
+}
@@ -0,0 +1,199 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package fetch
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA-256 of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func init() {
+	Register("s3", fetchS3)
+}
+
+// s3Credentials are the keys requests are signed with. Without them, requests
+// are anonymous, which works for public objects.
+type s3Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// s3CredentialsFromEnv reads AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+func s3CredentialsFromEnv() *s3Credentials {
+	creds := &s3Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return nil
+	}
+
+	return creds
+}
+
+// s3Region is Options.S3Region, or AWS_REGION, or AWS_DEFAULT_REGION, or
+// us-east-1.
+func (o Options) s3Region() string {
+	for _, region := range []string{o.S3Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if region != "" {
+			return region
+		}
+	}
+
+	return "us-east-1"
+}
+
+// s3Endpoint is Options.S3Endpoint, or AWS's endpoint for the region.
+func (o Options) s3Endpoint() string {
+	if o.S3Endpoint != "" {
+		return strings.TrimSuffix(o.S3Endpoint, "/")
+	}
+
+	return "https://s3." + o.s3Region() + ".amazonaws.com"
+}
+
+// fetchS3 gets s3://bucket/key URLs from Options.S3Endpoint, which can be any
+// S3-compatible object store. Objects are addressed by path, so bucket names
+// don't need to be valid hostnames.
+func fetchS3(ctx context.Context, client *Client, location *url.URL) (*Resource, error) {
+	bucket, key := location.Host, strings.TrimPrefix(location.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, errors.New("S3 URLs need a bucket and a key, like s3://bucket/install.sh")
+	}
+
+	endpoint, err := url.Parse(client.options.s3Endpoint())
+	if err != nil || endpoint.Host == "" {
+		return nil, errors.New("Invalid S3 endpoint " + client.options.s3Endpoint())
+	}
+
+	object := *endpoint
+	object.Path = strings.TrimSuffix(endpoint.Path, "/") + "/" + bucket + "/" + key
+	object.RawPath = s3Escape(object.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, object.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if creds := s3CredentialsFromEnv(); creds != nil {
+		signS3(req, creds, client.options.s3Region(), time.Now())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Resource{Body: resp.Body, Location: location.String(), Header: resp.Header, Size: resp.ContentLength}, nil
+}
+
+// signS3 signs req with AWS Signature Version 4, for a request with no body.
+// Every header already on req is signed, along with Host.
+func signS3(req *http.Request, creds *s3Credentials, region string, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3Query(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + sha256Hex(canonical)
+
+	key := []byte("AWS4" + creds.SecretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape encodes path the way SigV4 wants it: everything but unreserved
+// characters and slashes.
+func s3Escape(path string) string {
+	escaped := &strings.Builder{}
+	for _, b := range []byte(path) {
+		if b == '/' || b == '-' || b == '_' || b == '.' || b == '~' || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9') {
+			escaped.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(escaped, "%%%02X", b)
+	}
+
+	return escaped.String()
+}
+
+// s3Query is the canonical query string: sorted, and escaped like s3Escape.
+func s3Query(query url.Values) string {
+	pairs := []string{}
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, strings.Replace(s3Escape(name), "/", "%2F", -1)+"="+strings.Replace(s3Escape(value), "/", "%2F", -1))
+		}
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,355 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ellotheth/pipethis/lookup"
+)
+
+// verifyOptions say how signatures are checked, and where the keys come from.
+type verifyOptions struct {
+	serviceName    string
+	keyserver      string
+	githubURL      string
+	keyring        string
+	allowedSigners string
+	sshNamespace   string
+	minisignKey    string
+	policy         *Policy
+
+	// single picks the author's key without asking, as long as there's only
+	// one match. Piped scripts always do.
+	single bool
+}
+
+// verifyFlags adds the signature and key lookup options to flags. The
+// function it returns loads the policy once they're parsed.
+func verifyFlags(flags *flag.FlagSet) func() (*verifyOptions, error) {
+	options := &verifyOptions{}
+	policyFile := flags.String("policy", "", "JSON policy file with the trust roots and expected identity for Sigstore bundles, minisign keys, and the script locations keys are trusted for")
+
+	flags.StringVar(&options.serviceName, "lookup-with", "keybase", "Key lookup services to use, comma-separated and tried in order. Could be any of: "+strings.Join(lookup.Services(), ", "))
+	flags.StringVar(&options.keyserver, "keyserver", "https://keys.openpgp.org", "Keyserver for the 'keyserver' lookup service. Could be https://, hkps:// or hkp://.")
+	flags.StringVar(&options.githubURL, "github-url", "https://github.com", "GitHub (or GitHub Enterprise) site for the 'github' lookup service")
+	flags.StringVar(&options.keyring, "keyring", lookup.DefaultKeyring(), "Keyring directory for the 'pipethis' lookup service")
+	flags.StringVar(&options.allowedSigners, "allowed-signers", "", "SSH allowed_signers file to verify SSH signatures with, instead of looking up the author's SSH keys")
+	flags.StringVar(&options.sshNamespace, "ssh-namespace", "file", "Namespace SSH signatures have to be made in")
+	flags.StringVar(&options.minisignKey, "minisign-key", "", "minisign or signify public key (or key file) to verify the signature with")
+
+	return func() (*verifyOptions, error) {
+		policy, err := LoadPolicy(*policyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		options.policy = policy
+		return options, nil
+	}
+}
+
+// install is a script on its way to being run: downloaded along with its
+// signature, then verified.
+type install struct {
+	options   *verifyOptions
+	script    *Script
+	signature *Signature
+
+	// ctx is the one the script's download was started with. cancel stops it,
+	// and everything else the install is doing.
+	ctx    context.Context
+	cancel func()
+	body   io.ReadCloser
+
+	fetchErr   error
+	trustedFor string
+
+	// fingerprint, if it's set, picks the author's PGP key instead of asking.
+	fingerprint string
+
+	// service is the key service authors are looked up with, once keyService
+	// has set it up.
+	service lookup.KeyService
+}
+
+// newInstall starts downloading the script at location. Remove cleans up
+// after it, whatever happens next.
+func newInstall(ctx context.Context, options *verifyOptions, location, sigSource string) (*install, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	script, body, err := openScript(ctx, location)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &install{
+		options:   options,
+		script:    script,
+		signature: NewSignature(nil, script, sigSource),
+		ctx:       ctx,
+		cancel:    cancel,
+		body:      body,
+	}, nil
+}
+
+// Remove stops anything still running, and deletes the downloaded files.
+func (i *install) Remove() {
+	i.cancel()
+	os.Remove(i.script.Name())
+	os.Remove(i.signature.Name())
+	os.Remove(i.signature.fetched())
+}
+
+// fetch downloads the script and its signature at the same time. If the
+// author's key has to be looked up and lookupEarly is set, that starts as
+// soon as the signature and the script's PIPETHIS_AUTHOR line are in.
+// Whichever fails first stops the rest. When someone might have to pick which
+// author is right, only the search starts early; asking waits for verify, so
+// it never prompts over the progress bar.
+func (i *install) fetch(verify, lookupEarly bool) error {
+	author := newTokenWatcher(authorPattern)
+	running := newTasks(i.cancel)
+	running.Go(func() error {
+		defer i.body.Close()
+		defer author.Close()
+		return i.script.download(i.body, author)
+	})
+
+	if !verify {
+		return running.Wait()
+	}
+
+	fetched := make(chan string, 1)
+	running.Go(func() error {
+		defer close(fetched)
+		if i.fetchErr = i.signature.fetch(i.ctx); i.fetchErr == nil {
+			fetched <- sniffFile(i.signature.fetched())
+		}
+		return nil
+	})
+
+	if lookupEarly {
+		running.Go(func() error {
+			format, ok := <-fetched
+			if !ok || !(format == "" || format == formatPGP || (format == formatSSH && i.options.allowedSigners == "")) {
+				return nil
+			}
+			if format == "" {
+				format = formatPGP
+			}
+
+			name, ok := author.Wait()
+			if !ok {
+				return nil
+			}
+
+			if i.canAsk() {
+				// the matches are kept for verify, which asks about them; if
+				// the search fails, verify tries again and reports it
+				if format == formatPGP {
+					if service, err := i.keyService(); err == nil {
+						service.Matches(name)
+					}
+				}
+				return nil
+			}
+
+			if err := i.useTrust(format, name); err != nil {
+				return err
+			}
+			i.trustedFor = format + " " + name
+			return nil
+		})
+	}
+
+	return running.Wait()
+}
+
+// verify checks the script's signature, and that the key that made it is
+// trusted for the script's location.
+func (i *install) verify() (Signer, error) {
+	format, err := i.trust()
+	if err != nil {
+		return Signer{}, err
+	}
+
+	return i.check(format)
+}
+
+// trust is the first half of verify. It finishes the signature's download,
+// and loads the keys for its format. It returns the format.
+func (i *install) trust() (string, error) {
+	if i.fetchErr != nil && !i.script.IsClearsigned() {
+		return "", errors.New(i.fetchErr.Error() + " (do you need to set -signature?)")
+	}
+	if err := i.signature.commit(); err != nil {
+		return "", err
+	}
+
+	format, err := i.signature.Format()
+	if err != nil {
+		return "", err
+	}
+
+	// only PGP and SSH signatures are checked against the author
+	author, err := i.script.Author()
+	if err != nil && (format == formatPGP || format == formatSSH) {
+		return "", err
+	}
+
+	// the key might already have been looked up while the script was
+	// downloading
+	if i.trustedFor != format+" "+author {
+		if err := i.useTrust(format, author); err != nil {
+			return "", err
+		}
+	}
+
+	return format, nil
+}
+
+// check is the second half of verify. It checks the signature in format
+// against the keys trust loaded.
+func (i *install) check(format string) (Signer, error) {
+	verifier, err := VerifierFor(format)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	signer, err := i.signature.VerifyWith(verifier)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	// a valid signature isn't enough if the key is only trusted for scripts
+	// from somewhere else
+	scopes, err := trustScopes(signer, format, i.options.policy, i.options.keyring)
+	if err != nil {
+		return Signer{}, err
+	}
+	if err := checkScope(signer, i.script.Source(), scopes); err != nil {
+		return Signer{}, err
+	}
+
+	log.Println("Signature verified! Signed by", signer)
+	if !i.script.IsPiped() {
+		log.Println("Verified script from", i.script.Resolved())
+	}
+
+	return signer, nil
+}
+
+// confirm asks whoever is running pipethis a yes or no question. Anything
+// but yes is no. It's a variable so tests can answer it.
+var confirm = func(question string) bool {
+	answer := "n"
+	fmt.Print(question, " (y/N) ")
+	fmt.Scanf("%s", &answer)
+
+	return strings.ToLower(answer) == "y"
+}
+
+// useTrust sets up the keys (or trust roots) the signature has to be made
+// with, for its format.
+func (i *install) useTrust(format, author string) error {
+	options, script, signature := i.options, i.script, i.signature
+
+	switch {
+	case format == formatSigstore:
+		trust, err := options.policy.SigstoreTrust(script, options.single || script.IsPiped())
+		if err != nil {
+			return err
+		}
+
+		signature.UseSigstore(trust)
+	case format == formatMinisign || format == formatSignify:
+		keys, err := minisignKeys(options.minisignKey, options.policy, script, options.single || script.IsPiped())
+		if err != nil {
+			return err
+		}
+
+		signature.UseMinisignKeys(keys)
+	case format == formatSSH && options.allowedSigners != "":
+		signers, err := readAllowedSigners(options.allowedSigners)
+		if err != nil {
+			return err
+		}
+
+		signature.UseSSHSigners(signers, options.sshNamespace)
+	default:
+		service, err := i.keyService()
+		if err != nil {
+			return err
+		}
+
+		if format == formatSSH {
+			keys, err := lookup.SSHKeys(service, author)
+			if err != nil {
+				return err
+			}
+
+			signature.UseSSHSigners(sshSignersForKeys(keys), options.sshNamespace)
+		} else {
+			var key openpgp.KeyRing
+			if i.fingerprint != "" {
+				key, err = lookup.KeyWithFingerprint(service, author, i.fingerprint)
+			} else {
+				key, err = lookup.Key(service, author, !i.canAsk())
+			}
+			if err != nil {
+				return err
+			}
+
+			signature.UseKey(key)
+		}
+	}
+
+	return nil
+}
+
+// canAsk is whether someone might be asked which of the author's matches is
+// right.
+func (i *install) canAsk() bool {
+	return !i.options.single && !i.script.IsPiped() && i.fingerprint == ""
+}
+
+// keyService sets up the key service authors are looked up with, the first
+// time it's needed. It remembers what it finds, so a search started while the
+// script was downloading isn't done twice.
+func (i *install) keyService() (lookup.KeyService, error) {
+	if i.service != nil {
+		return i.service, nil
+	}
+
+	// without a fingerprint, the only match nobody picked that can be
+	// trusted is one the user already put in their keyring
+	options := i.options
+	keyringOnly := i.script.IsPiped() || (options.single && i.fingerprint == "")
+	service, err := lookup.NewKeyService(options.serviceName, keyringOnly, lookup.Config{
+		Options: map[string]string{"keyserver": options.keyserver, "github-url": options.githubURL, "keyring": options.keyring},
+		Client:  httpClient.HTTPContext(i.ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	i.service = lookup.NewCachedService(service)
+	return i.service, nil
+}
@@ -0,0 +1,343 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ellotheth/pipethis/lookup"
+)
+
+// keyCommands are the `pipethis keys` subcommands.
+var keyCommands = map[string]func(args []string) error{
+	"add":    addKeys,
+	"export": exportKeys,
+	"import": addKeys,
+	"list":   listKeys,
+	"remove": removeKeys,
+	"show":   showKeys,
+}
+
+// keys is the `pipethis keys <command>` subcommand, for managing the pipethis
+// keyring.
+func keys(args []string) error {
+	names := []string{}
+	for name := range keyCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(args) == 0 {
+		return errors.New("keys needs a command: " + strings.Join(names, ", "))
+	}
+
+	command, ok := keyCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown keys command %q; use one of: %s", args[0], strings.Join(names, ", "))
+	}
+
+	return command(args[1:])
+}
+
+// exportKeys is `pipethis keys export --author <author>`. It looks the author
+// up the same way pipethis would, and writes the identity that was chosen and
+// its key into a bundle.
+func exportKeys(args []string) error {
+	flags := flag.NewFlagSet("keys export", flag.ExitOnError)
+	var (
+		author      = flags.String("author", "", "Author to look up, the same as PIPETHIS_AUTHOR")
+		output      = flags.String("o", "", `File to write the bundle to, or - for STDOUT (default "<author>.bundle.json")`)
+		serviceName = flags.String("lookup-with", "keybase", "Key lookup services to find the author's key, comma-separated and tried in order. Could be any of: "+strings.Join(lookup.Services(), ", "))
+		keyserver   = flags.String("keyserver", "https://keys.openpgp.org", "Keyserver for the 'keyserver' lookup service")
+		githubURL   = flags.String("github-url", "https://github.com", "GitHub site for the 'github' lookup service")
+		keyring     = flags.String("keyring", lookup.DefaultKeyring(), "Keyring directory for the 'pipethis' lookup service")
+		newClient   = clientFlags(flags)
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pipethis keys export --author <author> [ OPTIONS ]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *author == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("keys export needs an author")
+	}
+
+	client, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	service, err := lookup.NewKeyService(*serviceName, false, lookup.Config{
+		Options: map[string]string{"keyserver": *keyserver, "github-url": *githubURL, "keyring": *keyring},
+		Client:  client.HTTP(),
+	})
+	if err != nil {
+		return err
+	}
+
+	user, ring, err := lookup.Resolve(service, *author, false)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := lookup.NewBundle(*author, user, ring)
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	contents = append(contents, '\n')
+
+	if *output == "" {
+		*output = *author + ".bundle.json"
+	}
+	if *output == "-" {
+		_, err = os.Stdout.Write(contents)
+		return err
+	}
+
+	if err := ioutil.WriteFile(*output, contents, 0644); err != nil {
+		return err
+	}
+
+	log.Println("Exported", user.Fingerprint, "for", *author, "to", *output)
+	return nil
+}
+
+// addKeys is `pipethis keys add <file>...` (and `pipethis keys import`). Each
+// file is a bundle from `pipethis keys export`, or a public key. The keys are
+// copied into the keyring, with who added them, when, and what they're
+// trusted for.
+func addKeys(args []string) error {
+	flags := flag.NewFlagSet("keys add", flag.ExitOnError)
+	var (
+		keyring = flags.String("keyring", lookup.DefaultKeyring(), "Keyring directory to add the keys to")
+		replace = flags.Bool("replace", false, "Replace keys that are already in the keyring, along with the authors and URLs they're trusted for")
+		authors = &stringsFlag{}
+		urls    = &stringsFlag{}
+	)
+	flags.Var(authors, "author", "Author (PIPETHIS_AUTHOR) to trust the keys for. Repeat it for more than one.")
+	flags.Var(urls, "url", "Script location to trust the keys for, like https://get.example.com/*. Repeat it for more than one. (default anywhere)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pipethis keys add [ OPTIONS ] <bundle or key file>... (or - for STDIN)")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("keys add needs at least one bundle or key file")
+	}
+
+	bundles := []*lookup.Bundle{}
+	for _, location := range flags.Args() {
+		found, err := readBundles(location)
+		if err != nil {
+			return fmt.Errorf("%s: %s", location, err)
+		}
+		bundles = append(bundles, found...)
+	}
+
+	// check everything before anything is written, so the keyring is never
+	// left half updated
+	added := time.Now().UTC()
+	addedBy := currentUser()
+	ring := lookup.NewKeyring(*keyring)
+	seen := map[string]bool{}
+	for _, bundle := range bundles {
+		if _, err := bundle.Ring(); err != nil {
+			return err
+		}
+
+		fingerprint := strings.ToLower(bundle.User.Fingerprint)
+		if seen[fingerprint] {
+			return errors.New(bundle.User.Fingerprint + " is in more than one of the files")
+		}
+		seen[fingerprint] = true
+
+		if _, err := ring.Find(bundle.User.Fingerprint); err == nil && !*replace {
+			return errors.New(bundle.User.Fingerprint + " is already in the keyring; use -replace to change what it's trusted for")
+		}
+
+		bundle.Authors = append(bundle.Authors, *authors...)
+		if len(bundle.TrustedAuthors()) == 0 {
+			bundle.Authors = []string{bundle.User.Fingerprint}
+		}
+		bundle.URLs = append(bundle.URLs, *urls...)
+		bundle.AddedBy = addedBy
+		bundle.Added = &added
+	}
+
+	for _, bundle := range bundles {
+		if previous, err := ring.Find(bundle.User.Fingerprint); err == nil {
+			log.Println("Replacing", bundle.User.Fingerprint, "added by", previous.AddedBy, "for authors", previous.TrustedAuthors(), "and URLs", previous.URLs)
+		}
+
+		filename, err := ring.Add(bundle, *replace)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Added", bundle.User.Fingerprint, "to", filename)
+		if len(*authors) == 0 && bundle.Query == "" {
+			log.Println("It's only trusted for scripts that name its fingerprint; use -author to trust it for more")
+		}
+	}
+
+	return nil
+}
+
+// readBundles reads the bundle in location, or makes one for every public
+// key in it.
+func readBundles(location string) ([]*lookup.Bundle, error) {
+	var contents []byte
+	var err error
+	if location == "-" {
+		contents, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		contents, err = ioutil.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bundle, err := lookup.ReadBundle(bytes.NewReader(contents)); err == nil {
+		return []*lookup.Bundle{bundle}, nil
+	} else if bytes.HasPrefix(bytes.TrimSpace(contents), []byte("{")) {
+		return nil, err
+	}
+
+	ring, err := lookup.ReadKeys(contents)
+	if err != nil {
+		return nil, errors.New("Not a key bundle or public key")
+	}
+
+	return lookup.BundlesFromKeys(ring)
+}
+
+// listKeys is `pipethis keys list`.
+func listKeys(args []string) error {
+	flags := flag.NewFlagSet("keys list", flag.ExitOnError)
+	keyring := flags.String("keyring", lookup.DefaultKeyring(), "Keyring directory to list")
+	flags.Parse(args)
+
+	bundles, err := lookup.NewKeyring(*keyring).Bundles()
+	if err != nil {
+		return err
+	}
+
+	for _, bundle := range bundles {
+		fmt.Printf("%s  %s\n", bundle.User.Fingerprint, bundle.User.FullName)
+		fmt.Printf("    authors: %s\n", strings.Join(bundle.TrustedAuthors(), ", "))
+		if len(bundle.URLs) > 0 {
+			fmt.Printf("    urls: %s\n", strings.Join(bundle.URLs, ", "))
+		}
+	}
+
+	if len(bundles) == 0 {
+		log.Println("The keyring in", *keyring, "is empty")
+	}
+	return nil
+}
+
+// showKeys is `pipethis keys show <fingerprint>`.
+func showKeys(args []string) error {
+	flags := flag.NewFlagSet("keys show", flag.ExitOnError)
+	keyring := flags.String("keyring", lookup.DefaultKeyring(), "Keyring directory to look in")
+	armored := flags.Bool("armor", false, "Print the armored public key too")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("keys show needs one fingerprint")
+	}
+
+	bundle, err := lookup.NewKeyring(*keyring).Find(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	format := "%15s: %s\n"
+	fmt.Print(bundle.User)
+	fmt.Printf(format, "Looked up as", bundle.Query)
+	fmt.Printf(format, "Trusted for", strings.Join(bundle.TrustedAuthors(), ", "))
+	if len(bundle.URLs) > 0 {
+		fmt.Printf(format, "Trusted at", strings.Join(bundle.URLs, ", "))
+	} else {
+		fmt.Printf(format, "Trusted at", "anywhere")
+	}
+	if bundle.Added != nil {
+		fmt.Printf(format, "Added", bundle.Added.Format(time.RFC3339)+" by "+bundle.AddedBy)
+	}
+	if *armored {
+		fmt.Println()
+		fmt.Print(bundle.Key)
+	}
+
+	return nil
+}
+
+// removeKeys is `pipethis keys remove <fingerprint>...`.
+func removeKeys(args []string) error {
+	flags := flag.NewFlagSet("keys remove", flag.ExitOnError)
+	keyring := flags.String("keyring", lookup.DefaultKeyring(), "Keyring directory to remove the keys from")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("keys remove needs at least one fingerprint")
+	}
+
+	for _, id := range flags.Args() {
+		bundle, err := lookup.NewKeyring(*keyring).Remove(id)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Removed", bundle.User.Fingerprint)
+	}
+
+	return nil
+}
+
+// currentUser is who's running pipethis, for the keyring's records.
+func currentUser() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ellotheth/pipethis/lookup"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeysTest struct {
+	suite.Suite
+	dir string
+}
+
+func (s *KeysTest) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+}
+
+func (s *KeysTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+// bundle writes a bundle for the Ed25519 fixture key.
+func (s *KeysTest) bundle() string {
+	ring, err := readKeyFile("fixtures/ed25519.asc")
+	s.Require().NoError(err)
+
+	user := lookup.User{Username: "gemma", Fingerprint: "22b5f4df9cbf8ff3659a6e49c5df7aca675e5260"}
+	bundle, err := lookup.NewBundle("gemma-ed25519@example.com", user, ring)
+	s.Require().NoError(err)
+
+	contents, err := json.Marshal(bundle)
+	s.Require().NoError(err)
+
+	filename := filepath.Join(s.dir, "gemma.bundle.json")
+	s.Require().NoError(ioutil.WriteFile(filename, contents, 0644))
+	return filename
+}
+
+func (s *KeysTest) TestKeysNeedsKnownCommand() {
+	s.Error(keys(nil))
+	s.EqualError(keys([]string{"frobnicate"}), `Unknown keys command "frobnicate"; use one of: add, export, import, list, remove, show`)
+}
+
+func (s *KeysTest) TestImportedBundlesVerifyOffline() {
+	keyring := filepath.Join(s.dir, "keyring")
+	s.NoError(keys([]string{"import", "-keyring", keyring, s.bundle()}))
+
+	service, err := lookup.NewKeyService("bundle", false, lookup.Config{Options: map[string]string{"keyring": keyring}})
+	s.Require().NoError(err)
+
+	script := &Script{filename: "fixtures/signed.ed25519"}
+	author, err := script.Author()
+	s.Require().NoError(err)
+
+	ring, err := lookup.Key(service, author, true)
+	s.Require().NoError(err)
+
+	sig := Signature{script: script, filename: "fixtures/signed.ed25519.sig"}
+	sig.UseKey(ring)
+	s.NoError(sig.Verify())
+}
+
+func (s *KeysTest) TestImportRejectsBrokenBundles() {
+	broken := filepath.Join(s.dir, "broken.json")
+	contents, _ := ioutil.ReadFile(s.bundle())
+	ioutil.WriteFile(broken, []byte(strings.Replace(string(contents), "22b5f4df", "00000000", 1)), 0644)
+
+	keyring := filepath.Join(s.dir, "keyring")
+	s.Error(addKeys([]string{"-keyring", keyring, broken}))
+
+	_, err := os.Stat(keyring)
+	s.True(os.IsNotExist(err))
+}
+
+func (s *KeysTest) TestAddRecordsMetadata() {
+	keyring := filepath.Join(s.dir, "keyring")
+	s.NoError(keys([]string{"add", "-keyring", keyring, "-author", "gemma", "-author", "gemma@example.com", "-url", "https://get.example.com/*", "fixtures/ed25519.asc"}))
+
+	bundle, err := lookup.NewKeyring(keyring).Find("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260")
+	s.Require().NoError(err)
+	s.Equal("", bundle.Query)
+	s.Equal([]string{"gemma", "gemma@example.com"}, bundle.TrustedAuthors())
+	s.Equal([]string{"https://get.example.com/*"}, bundle.URLs)
+	s.NotEmpty(bundle.AddedBy)
+	s.WithinDuration(time.Now(), *bundle.Added, time.Minute)
+
+	s.NoError(keys([]string{"list", "-keyring", keyring}))
+	s.NoError(keys([]string{"show", "-keyring", keyring, "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"}))
+	s.Error(keys([]string{"show", "-keyring", keyring, "C5DF7ACA675E5260"}))
+	s.Error(keys([]string{"show", "-keyring", keyring}))
+
+	s.NoError(keys([]string{"remove", "-keyring", keyring, "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"}))
+	s.Error(keys([]string{"remove", "-keyring", keyring, "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"}))
+}
+
+func (s *KeysTest) TestAddOnlyReplacesWithFlag() {
+	keyring := filepath.Join(s.dir, "keyring")
+	s.NoError(keys([]string{"add", "-keyring", keyring, "-author", "gemma", "-url", "https://get.example.com/*", "fixtures/ed25519.asc"}))
+
+	// adding it again doesn't quietly widen what it's trusted for
+	s.Error(keys([]string{"add", "-keyring", keyring, "-author", "mallory", "fixtures/ed25519.asc"}))
+	bundle, err := lookup.NewKeyring(keyring).Find("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260")
+	s.Require().NoError(err)
+	s.Equal([]string{"gemma"}, bundle.TrustedAuthors())
+	s.Equal([]string{"https://get.example.com/*"}, bundle.URLs)
+
+	s.NoError(keys([]string{"add", "-keyring", keyring, "-replace", "-author", "gemma@example.com", "fixtures/ed25519.asc"}))
+	bundle, err = lookup.NewKeyring(keyring).Find("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260")
+	s.Require().NoError(err)
+	s.Equal([]string{"gemma@example.com"}, bundle.TrustedAuthors())
+	s.Empty(bundle.URLs)
+}
+
+func (s *KeysTest) TestAddReadsEveryArmoredKey() {
+	ed25519, _ := ioutil.ReadFile("fixtures/ed25519.asc")
+	rsa, _ := ioutil.ReadFile("fixtures/rsa4096.asc")
+	both := filepath.Join(s.dir, "both.asc")
+	s.Require().NoError(ioutil.WriteFile(both, append(ed25519, rsa...), 0644))
+
+	keyring := filepath.Join(s.dir, "keyring")
+	s.NoError(keys([]string{"add", "-keyring", keyring, both}))
+
+	bundles, err := lookup.NewKeyring(keyring).Bundles()
+	s.NoError(err)
+	s.Require().Len(bundles, 2)
+
+	// without -author, each one is only trusted for its own fingerprint
+	for _, bundle := range bundles {
+		s.Equal([]string{bundle.User.Fingerprint}, bundle.TrustedAuthors())
+	}
+}
+
+func (s *KeysTest) TestAddChecksEveryFileFirst() {
+	keyring := filepath.Join(s.dir, "keyring")
+	s.NoError(keys([]string{"add", "-keyring", keyring, "-author", "gemma", "fixtures/ed25519.asc"}))
+
+	// the RSA key would be fine, but the Ed25519 one is already there
+	s.Error(keys([]string{"add", "-keyring", keyring, "-author", "gemma", "fixtures/rsa4096.asc", "fixtures/ed25519.asc"}))
+	s.Error(keys([]string{"add", "-keyring", keyring, "-author", "gemma", "fixtures/rsa4096.asc", "fixtures/signed.ed25519"}))
+	s.Error(keys([]string{"add", "-keyring", keyring, "-author", "gemma", "-replace", "fixtures/rsa4096.asc", "fixtures/rsa4096.asc"}))
+
+	bundles, err := lookup.NewKeyring(keyring).Bundles()
+	s.NoError(err)
+	s.Len(bundles, 1)
+}
+
+func (s *KeysTest) TestAddRejectsOtherFiles() {
+	s.Error(addKeys([]string{"-keyring", filepath.Join(s.dir, "keyring"), "fixtures/signed.ed25519"}))
+}
+
+func TestKeysTest(t *testing.T) {
+	suite.Run(t, new(KeysTest))
+}
@@ -0,0 +1,284 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ellotheth/pipethis/lookup"
+)
+
+// rawAuthorPattern grabs everything after PIPETHIS_AUTHOR up to the next
+// space, so lint can tell when authorPattern stops short.
+const rawAuthorPattern = `.*PIPETHIS_AUTHOR\s+(\S+)`
+
+// lintProblem is one thing wrong with a script, and how to fix it.
+type lintProblem struct {
+	problem string
+	fix     string
+}
+
+func (p lintProblem) String() string {
+	return fmt.Sprintf("problem: %s\n    fix: %s", p.problem, p.fix)
+}
+
+// linter checks a script the same way a pipethis consumer would, and collects
+// everything that would trip them up.
+type linter struct {
+	script   *Script
+	install  *install
+	problems []lintProblem
+}
+
+func (l *linter) report(problem, fix string) {
+	l.problems = append(l.problems, lintProblem{problem: problem, fix: fix})
+}
+
+// lint is the `pipethis lint <script> [-sig <signature>]` subcommand. It
+// reports every problem it finds and fails if there were any.
+func lint(args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	var (
+		sigSource = flags.String("sig", "", `Detached signature to check. (default "<script>.sig")`)
+		keyFile   = flags.String("key", "", "PGP public key to verify the signature with, instead of looking up the author")
+		newVerify = verifyFlags(flags)
+		newClient = clientFlags(flags)
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pipethis lint [ OPTIONS ] <script>")
+		flags.PrintDefaults()
+	}
+
+	// let the options go before or after the script
+	flags.Parse(args)
+	location := flags.Arg(0)
+	if flags.NArg() > 0 {
+		flags.Parse(flags.Args()[1:])
+	}
+	if location == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("lint needs exactly one script")
+	}
+
+	if _, err := newClient(); err != nil {
+		return err
+	}
+
+	options, err := newVerify()
+	if err != nil {
+		return err
+	}
+
+	var key openpgp.KeyRing
+	if *keyFile != "" {
+		if key, err = readKeyFile(*keyFile); err != nil {
+			return errors.New("Couldn't read the public key in " + *keyFile + ": " + err.Error())
+		}
+	}
+
+	install, err := newInstall(context.Background(), options, location, *sigSource)
+	if err != nil {
+		return err
+	}
+	defer install.Remove()
+
+	showProgress = false
+	if err := install.fetch(true, false); err != nil {
+		return err
+	}
+
+	l := &linter{script: install.script, install: install}
+	l.checkAuthor()
+	l.checkLineEndings()
+	l.checkSignature(key)
+
+	for _, problem := range l.problems {
+		fmt.Println(problem)
+		fmt.Println()
+	}
+
+	if len(l.problems) > 0 {
+		return fmt.Errorf("Found %d problem(s) in %s", len(l.problems), location)
+	}
+
+	log.Println("No problems found in", location)
+	return nil
+}
+
+// checkAuthor makes sure the PIPETHIS_AUTHOR token is there, and that
+// Script.Author() reads all of it.
+func (l *linter) checkAuthor() {
+	body, err := l.script.Body()
+	if err != nil {
+		l.report("Couldn't read the script: "+err.Error(), "Check the script location")
+		return
+	}
+	defer body.Close()
+
+	raw := regexp.MustCompile(rawAuthorPattern)
+	lines := []int{}
+	token := ""
+
+	scanner := bufio.NewScanner(body)
+	for n := 1; scanner.Scan(); n++ {
+		if !strings.Contains(scanner.Text(), "PIPETHIS_AUTHOR") {
+			continue
+		}
+
+		lines = append(lines, n)
+		if matches := raw.FindStringSubmatch(scanner.Text()); matches != nil && token == "" {
+			token = matches[1]
+		}
+	}
+
+	if len(lines) == 0 {
+		l.report(
+			"No PIPETHIS_AUTHOR token found",
+			"Add a line like `# PIPETHIS_AUTHOR <your username or key fingerprint>` near the top of the script",
+		)
+		return
+	}
+
+	if len(lines) > 1 {
+		l.report(
+			fmt.Sprintf("Found %d PIPETHIS_AUTHOR lines; only the first one (line %d) is used", len(lines), lines[0]),
+			"Remove the extra PIPETHIS_AUTHOR lines",
+		)
+	}
+
+	author, err := l.script.Author()
+	switch {
+	case err != nil:
+		l.report(
+			fmt.Sprintf("PIPETHIS_AUTHOR on line %d isn't followed by an author pipethis can read", lines[0]),
+			"Put your username or key fingerprint right after PIPETHIS_AUTHOR, separated by a space",
+		)
+	case author != token:
+		l.report(
+			fmt.Sprintf("PIPETHIS_AUTHOR reads as %q, but the script says %q", author, token),
+			"Authors can only be an email address, or a name made of letters, numbers and underscores; use your email, username or key fingerprint instead",
+		)
+	}
+}
+
+// checkLineEndings looks for CRLF line endings, which break the script for
+// most shells and usually mean the signature was made over different bytes.
+func (l *linter) checkLineEndings() {
+	contents, err := ioutil.ReadFile(l.script.Name())
+	if err != nil {
+		return
+	}
+
+	if bytes.Contains(contents, []byte("\r\n")) {
+		l.report(
+			"The script has CRLF (Windows) line endings",
+			"Convert the script to LF line endings (e.g. with dos2unix) before signing it",
+		)
+	}
+}
+
+// checkSignature verifies the script the same way pipethis would before
+// running it, with key instead of the author's if it's set. If that fails,
+// it tries to work out why.
+func (l *linter) checkSignature(key openpgp.KeyRing) {
+	install := l.install
+	if install.fetchErr != nil && !install.script.IsClearsigned() {
+		l.report(
+			install.fetchErr.Error(),
+			"Sign the script with `gpg --detach-sign -a -o "+install.script.Source()+".sig "+install.script.Source()+"`",
+		)
+		return
+	}
+
+	if key != nil {
+		author, _ := install.script.Author()
+		install.signature.UseKey(key)
+		install.trustedFor = formatPGP + " " + author
+	}
+
+	format, err := install.trust()
+	if err != nil {
+		l.report(
+			"Couldn't check the signature: "+err.Error(),
+			"Make sure PIPETHIS_AUTHOR matches the identity on your published key, or pass the key with -key",
+		)
+		return
+	}
+
+	_, err = install.check(format)
+	if err == nil {
+		return
+	}
+
+	contents, readErr := ioutil.ReadFile(install.script.Name())
+	if readErr != nil || format != formatPGP {
+		l.reportMismatch(err)
+		return
+	}
+
+	key = install.signature.trust.PGPKeys
+	lf := bytes.Replace(contents, []byte("\r\n"), []byte("\n"), -1)
+	crlf := bytes.Replace(lf, []byte("\n"), []byte("\r\n"), -1)
+
+	switch {
+	case !bytes.Equal(crlf, contents) && verifiesOver(key, crlf, install.signature.Name()):
+		l.report(
+			"The signature was made over a copy of the script with CRLF line endings",
+			"Convert the script to LF line endings, then sign it again",
+		)
+	case !bytes.Equal(lf, contents) && verifiesOver(key, lf, install.signature.Name()):
+		l.report(
+			"The signature was made over a copy of the script with LF line endings, but the script has CRLF line endings",
+			"Publish the script with LF line endings, exactly as it was signed",
+		)
+	default:
+		l.reportMismatch(err)
+	}
+}
+
+func (l *linter) reportMismatch(err error) {
+	l.report(
+		"The signature doesn't match the script and the author's key: "+err.Error(),
+		"Sign the current version of the script with the key that belongs to PIPETHIS_AUTHOR",
+	)
+}
+
+// verifiesOver checks the signature in sigFile against contents instead of
+// the script file.
+func verifiesOver(key openpgp.KeyRing, contents []byte, sigFile string) bool {
+	signature, err := ioutil.ReadFile(sigFile)
+	if err != nil {
+		return false
+	}
+
+	_, err = pgpVerifier{}.Verify(bytes.NewReader(contents), signature, Trust{PGPKeys: key})
+	return err == nil
+}
+
+// readKeyFile loads an armored or binary public key ring from filename.
+func readKeyFile(filename string) (openpgp.EntityList, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return lookup.ReadKeys(contents)
+}
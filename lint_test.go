@@ -0,0 +1,185 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/suite"
+)
+
+type LintTest struct {
+	suite.Suite
+	entity *openpgp.Entity
+}
+
+func (s *LintTest) SetupSuite() {
+	entity, err := openpgp.NewEntity("Lint Test", "", "lint@example.com", nil)
+	s.Require().NoError(err)
+	s.entity = entity
+}
+
+// writeScript saves contents to a temporary script file, and signs signed
+// into <script>.sig if it's not nil.
+func (s *LintTest) writeScript(contents string, signed []byte) *Script {
+	f, err := ioutil.TempFile("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer f.Close()
+
+	f.WriteString(contents)
+
+	if signed != nil {
+		sig := &bytes.Buffer{}
+		s.Require().NoError(openpgp.ArmoredDetachSign(sig, s.entity, bytes.NewReader(signed), nil))
+		s.Require().NoError(ioutil.WriteFile(f.Name()+".sig", sig.Bytes(), 0600))
+	}
+
+	return &Script{filename: f.Name(), source: f.Name()}
+}
+
+func (s *LintTest) cleanup(script *Script) {
+	os.Remove(script.Name())
+	os.Remove(script.Name() + ".sig")
+}
+
+func (s *LintTest) TestCheckAuthorAcceptsValidAuthor() {
+	script := s.writeScript("# PIPETHIS_AUTHOR gemma\necho hi\n", nil)
+	defer s.cleanup(script)
+
+	l := &linter{script: script}
+	l.checkAuthor()
+	s.Empty(l.problems)
+}
+
+func (s *LintTest) TestCheckAuthorReportsMissingAuthor() {
+	script := s.writeScript("echo hi\n", nil)
+	defer s.cleanup(script)
+
+	l := &linter{script: script}
+	l.checkAuthor()
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].problem, "No PIPETHIS_AUTHOR")
+}
+
+func (s *LintTest) TestCheckAuthorReportsTruncatedAuthor() {
+	script := s.writeScript("# PIPETHIS_AUTHOR gemma-o'brien\necho hi\n", nil)
+	defer s.cleanup(script)
+
+	l := &linter{script: script}
+	l.checkAuthor()
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].problem, `reads as "gemma"`)
+}
+
+func (s *LintTest) TestCheckAuthorReportsUnreadableAuthor() {
+	script := s.writeScript("# PIPETHIS_AUTHOR <gemma>\necho hi\n", nil)
+	defer s.cleanup(script)
+
+	l := &linter{script: script}
+	l.checkAuthor()
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].problem, "isn't followed by an author")
+}
+
+func (s *LintTest) TestCheckAuthorReportsExtraAuthors() {
+	script := s.writeScript("# PIPETHIS_AUTHOR gemma\n# PIPETHIS_AUTHOR other\n", nil)
+	defer s.cleanup(script)
+
+	l := &linter{script: script}
+	l.checkAuthor()
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].problem, "Found 2 PIPETHIS_AUTHOR lines")
+}
+
+func (s *LintTest) TestCheckLineEndingsReportsCRLF() {
+	script := s.writeScript("# PIPETHIS_AUTHOR gemma\r\necho hi\r\n", nil)
+	defer s.cleanup(script)
+
+	l := &linter{script: script}
+	l.checkLineEndings()
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].problem, "CRLF")
+}
+
+// installed downloads script and its signature the way lint does.
+func (s *LintTest) installed(script *Script, options *verifyOptions) *linter {
+	if options == nil {
+		options = &verifyOptions{serviceName: "pipethis", keyring: script.Name() + ".keyring", policy: &Policy{}, single: true}
+	}
+
+	install, err := newInstall(context.Background(), options, script.Source(), "")
+	s.Require().NoError(err)
+	s.Require().NoError(install.fetch(true, false))
+
+	return &linter{script: install.script, install: install}
+}
+
+func (s *LintTest) TestCheckSignatureAcceptsValidSignature() {
+	contents := "# PIPETHIS_AUTHOR gemma\necho hi\n"
+	script := s.writeScript(contents, []byte(contents))
+	defer s.cleanup(script)
+
+	l := s.installed(script, nil)
+	defer l.install.Remove()
+	l.checkSignature(openpgp.EntityList{s.entity})
+	s.Empty(l.problems)
+}
+
+func (s *LintTest) TestCheckSignatureReportsCRLFSignature() {
+	contents := "# PIPETHIS_AUTHOR gemma\necho hi\n"
+	script := s.writeScript(contents, []byte("# PIPETHIS_AUTHOR gemma\r\necho hi\r\n"))
+	defer s.cleanup(script)
+
+	l := s.installed(script, nil)
+	defer l.install.Remove()
+	l.checkSignature(openpgp.EntityList{s.entity})
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].problem, "CRLF line endings")
+}
+
+func (s *LintTest) TestCheckSignatureReportsMismatch() {
+	script := s.writeScript("# PIPETHIS_AUTHOR gemma\necho hi\n", []byte("something else"))
+	defer s.cleanup(script)
+
+	l := s.installed(script, nil)
+	defer l.install.Remove()
+	l.checkSignature(openpgp.EntityList{s.entity})
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].problem, "doesn't match")
+}
+
+func (s *LintTest) TestCheckSignatureReportsMissingSignature() {
+	script := s.writeScript("# PIPETHIS_AUTHOR gemma\necho hi\n", nil)
+	defer s.cleanup(script)
+
+	l := s.installed(script, nil)
+	defer l.install.Remove()
+	l.checkSignature(openpgp.EntityList{s.entity})
+	s.Len(l.problems, 1)
+	s.Contains(l.problems[0].fix, "gpg --detach-sign")
+}
+
+func (s *LintTest) TestCheckSignatureUsesEveryFormat() {
+	script := &Script{filename: "fixtures/signed.ssh", source: "fixtures/signed.ssh"}
+	l := s.installed(script, &verifyOptions{allowedSigners: "fixtures/allowed_signers", sshNamespace: "file", policy: &Policy{}, single: true})
+	defer l.install.Remove()
+
+	l.checkSignature(nil)
+	s.Empty(l.problems)
+}
+
+func TestLintTest(t *testing.T) {
+	suite.Run(t, new(LintTest))
+}
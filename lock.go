@@ -0,0 +1,247 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+// defaultLockfile is where `pipethis lock` writes, and --locked reads.
+const defaultLockfile = "pipethis.lock"
+
+// Lock records exactly which scripts and signatures were verified, and who
+// signed them, so later runs can insist on the same ones.
+type Lock struct {
+	Scripts []LockedScript `json:"scripts"`
+}
+
+// LockedScript is one verified script in a lock.
+type LockedScript struct {
+	// URL is the script location as it was asked for, and Resolved is where
+	// it came from after any redirects.
+	URL      string `json:"url"`
+	Resolved string `json:"resolved,omitempty"`
+	SHA256   string `json:"sha256"`
+
+	// Signature is where the signature came from. It's empty for clearsigned
+	// scripts, but SignatureSHA256 is still the digest of the signature that
+	// was detached from them.
+	Signature       string `json:"signature,omitempty"`
+	SignatureSHA256 string `json:"signature_sha256"`
+	Format          string `json:"format"`
+	Signer          string `json:"signer"`
+}
+
+// LoadLock reads the lock in filename.
+func LoadLock(filename string) (*Lock, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{}
+	if err := json.Unmarshal(contents, lock); err != nil {
+		return nil, errors.New("Invalid lock file " + filename + ": " + err.Error())
+	}
+
+	return lock, nil
+}
+
+// Save writes the lock to filename, sorted by URL.
+func (l *Lock) Save(filename string) error {
+	sort.Slice(l.Scripts, func(i, j int) bool { return l.Scripts[i].URL < l.Scripts[j].URL })
+
+	contents, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, append(contents, '\n'), 0644)
+}
+
+// Find returns the locked script for url, or nil if there isn't one.
+func (l *Lock) Find(url string) *LockedScript {
+	for i := range l.Scripts {
+		if l.Scripts[i].URL == url {
+			return &l.Scripts[i]
+		}
+	}
+
+	return nil
+}
+
+// Set adds locked to the lock, replacing anything for the same URL.
+func (l *Lock) Set(locked LockedScript) {
+	if existing := l.Find(locked.URL); existing != nil {
+		*existing = locked
+		return
+	}
+
+	l.Scripts = append(l.Scripts, locked)
+}
+
+// Check makes sure the verified script at url is the one that was locked.
+func (l *Lock) Check(url string, actual LockedScript) error {
+	locked := l.Find(url)
+	if locked == nil {
+		return fmt.Errorf("%s isn't in the lock file (use pipethis lock to add it)", url)
+	}
+
+	switch {
+	case actual.SHA256 != locked.SHA256:
+		return fmt.Errorf("The script's SHA-256 is %s, but it was locked at %s", actual.SHA256, locked.SHA256)
+	case actual.SignatureSHA256 != locked.SignatureSHA256:
+		return fmt.Errorf("The signature's SHA-256 is %s, but it was locked at %s", actual.SignatureSHA256, locked.SignatureSHA256)
+	case actual.Format != locked.Format || !sameKey(locked.Signer, actual.Signer):
+		return fmt.Errorf("The script was signed by %s (%s), but it was locked to %s (%s)", actual.Signer, actual.Format, locked.Signer, locked.Format)
+	}
+
+	return nil
+}
+
+// lockedScript describes a verified install for the lock.
+func lockedScript(url string, i *install, signer Signer) (LockedScript, error) {
+	format, err := i.signature.Format()
+	if err != nil {
+		return LockedScript{}, err
+	}
+
+	digest, err := fileSHA256(i.signature.Name())
+	if err != nil {
+		return LockedScript{}, err
+	}
+
+	return LockedScript{
+		URL:             url,
+		Resolved:        i.script.Resolved(),
+		SHA256:          i.script.Digests()["sha256"],
+		Signature:       i.signature.Source(),
+		SignatureSHA256: digest,
+		Format:          format,
+		Signer:          signer.Key,
+	}, nil
+}
+
+// fileSHA256 is the hex SHA-256 of the file filename.
+func fileSHA256(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// lockCommand is `pipethis lock <script>...`. It downloads and verifies the
+// scripts the same way pipethis would, and records what it found in the lock
+// file.
+func lockCommand(args []string) error {
+	flags := flag.NewFlagSet("lock", flag.ExitOnError)
+	var (
+		lockfile     = flags.String("lockfile", defaultLockfile, "Lock file to write. Scripts that are already in it are updated.")
+		manifestFile = flags.String("manifest", "", "Lock every installer in this run-manifest manifest too")
+		jobs         = flags.Int("jobs", 4, "How many scripts to download and verify at a time")
+		fingerprints = &stringsFlag{}
+		newVerify    = verifyFlags(flags)
+		newClient    = clientFlags(flags)
+	)
+	flags.Var(fingerprints, "fingerprint", "Key that has to have signed the script, like a manifest's fingerprint. Every script needs one, in the same order as the scripts.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pipethis lock [ OPTIONS ] -fingerprint <key>... <script>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	// nobody's asked which of an author's keys is right, so each script has
+	// to say which key it's locked to
+	if len(*fingerprints) != flags.NArg() {
+		flags.Usage()
+		return fmt.Errorf("lock needs one -fingerprint for every script (got %d for %d)", len(*fingerprints), flags.NArg())
+	}
+
+	installers := []Installer{}
+	for n, location := range flags.Args() {
+		installers = append(installers, Installer{Name: location, URL: location, Fingerprint: (*fingerprints)[n]})
+	}
+	if *manifestFile != "" {
+		manifest, err := LoadManifest(*manifestFile)
+		if err != nil {
+			return fmt.Errorf("%s: %s", *manifestFile, err)
+		}
+		installers = append(installers, manifest.Installers...)
+	}
+
+	if len(installers) == 0 {
+		flags.Usage()
+		return errors.New("lock needs at least one script or a manifest")
+	}
+	if *jobs < 1 {
+		return errors.New("-jobs has to be at least 1")
+	}
+
+	lock, err := LoadLock(*lockfile)
+	if os.IsNotExist(err) {
+		lock, err = &Lock{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := newClient(); err != nil {
+		return err
+	}
+
+	options, err := newVerify()
+	if err != nil {
+		return err
+	}
+	options.single = true
+	showProgress = false
+
+	results, err := verifyInstallers(context.Background(), installers, options, *jobs)
+	for _, result := range results {
+		if result.install != nil {
+			defer result.install.Remove()
+		}
+	}
+	if err != nil {
+		printSummary(results)
+		return errors.New("Nothing was locked: " + err.Error())
+	}
+
+	for n, result := range results {
+		locked, err := lockedScript(installers[n].URL, result.install, result.signer)
+		if err != nil {
+			return fmt.Errorf("%s: %s", result.name, err)
+		}
+
+		lock.Set(locked)
+		log.Println("Locked", locked.URL, "at SHA-256", locked.SHA256, "signed by", locked.Signer)
+	}
+
+	return lock.Save(*lockfile)
+}
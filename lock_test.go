@@ -0,0 +1,155 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LockTest struct {
+	suite.Suite
+	dir      string
+	keyring  string
+	lockfile string
+	script   string
+
+	// fingerprint is the key that signed script
+	fingerprint string
+}
+
+func (s *LockTest) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+
+	s.keyring = filepath.Join(s.dir, "keyring")
+	s.Require().NoError(keys([]string{"add", "-keyring", s.keyring, "-author", "gemma-ed25519@example.com", "fixtures/ed25519.asc"}))
+
+	s.lockfile = filepath.Join(s.dir, "pipethis.lock")
+	s.script, err = filepath.Abs("fixtures/signed.ed25519")
+	s.Require().NoError(err)
+	s.fingerprint = "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"
+}
+
+func (s *LockTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+	showProgress = true
+}
+
+func (s *LockTest) lock(args ...string) error {
+	return lockCommand(append([]string{"-lookup-with", "pipethis", "-keyring", s.keyring, "-lockfile", s.lockfile}, args...))
+}
+
+func (s *LockTest) TestLockRecordsVerifiedScripts() {
+	s.Require().NoError(s.lock("-fingerprint", s.fingerprint, s.script))
+
+	lock, err := LoadLock(s.lockfile)
+	s.Require().NoError(err)
+	s.Require().Len(lock.Scripts, 1)
+
+	sigDigest, err := fileSHA256("fixtures/signed.ed25519.sig")
+	s.Require().NoError(err)
+
+	s.Equal(LockedScript{
+		URL:             s.script,
+		Resolved:        s.script,
+		SHA256:          s.digest(),
+		Signature:       s.script + ".sig",
+		SignatureSHA256: sigDigest,
+		Format:          formatPGP,
+		Signer:          "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260",
+	}, lock.Scripts[0])
+
+	// locking again updates the script instead of adding it twice
+	s.NoError(s.lock("-fingerprint", s.fingerprint, s.script))
+	lock, err = LoadLock(s.lockfile)
+	s.Require().NoError(err)
+	s.Len(lock.Scripts, 1)
+}
+
+func (s *LockTest) TestLockNeedsVerifiedScripts() {
+	unsigned := filepath.Join(s.dir, "unsigned.sh")
+	ioutil.WriteFile(unsigned, []byte("#!/bin/sh\n# PIPETHIS_AUTHOR gemma-ed25519@example.com\n"), 0644)
+
+	s.Error(s.lock("-fingerprint", s.fingerprint, "-fingerprint", s.fingerprint, s.script, unsigned))
+	_, err := os.Stat(s.lockfile)
+	s.True(os.IsNotExist(err))
+
+	s.Error(s.lock())
+}
+
+func (s *LockTest) TestLockNeedsFingerprints() {
+	s.EqualError(s.lock(s.script), "lock needs one -fingerprint for every script (got 0 for 1)")
+
+	s.Error(s.lock("-fingerprint", strings.Repeat("0", 40), s.script))
+	_, err := os.Stat(s.lockfile)
+	s.True(os.IsNotExist(err))
+}
+
+func (s *LockTest) TestCheck() {
+	locked := LockedScript{URL: "https://get.example.com/install.sh", SHA256: "abc", SignatureSHA256: "def", Format: formatPGP, Signer: "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"}
+	lock := &Lock{}
+	lock.Set(locked)
+
+	actual := locked
+	actual.Signer = "22b5f4df9cbf8ff3659a6e49c5df7aca675e5260"
+	s.NoError(lock.Check(locked.URL, actual))
+
+	s.EqualError(lock.Check("https://get.example.com/other.sh", locked), "https://get.example.com/other.sh isn't in the lock file (use pipethis lock to add it)")
+
+	actual = locked
+	actual.SHA256 = "123"
+	s.EqualError(lock.Check(locked.URL, actual), "The script's SHA-256 is 123, but it was locked at abc")
+
+	actual = locked
+	actual.SignatureSHA256 = "456"
+	s.Error(lock.Check(locked.URL, actual))
+
+	actual = locked
+	actual.Signer = "SHA256:abcdef"
+	actual.Format = formatSSH
+	s.Error(lock.Check(locked.URL, actual))
+}
+
+func (s *LockTest) TestRunManifestLocked() {
+	manifest := filepath.Join(s.dir, "installers.yaml")
+	ioutil.WriteFile(manifest, []byte("installers:\n  - url: "+s.script+"\n    fingerprint: 22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260\n"), 0644)
+	run := func() error {
+		return runManifest([]string{"-locked", "-lockfile", s.lockfile, "-lookup-with", "pipethis", "-keyring", s.keyring, "-target", "/bin/sh", manifest})
+	}
+
+	s.Error(run())
+
+	s.Require().NoError(s.lock("-manifest", manifest))
+	s.NoError(run())
+
+	lock, err := LoadLock(s.lockfile)
+	s.Require().NoError(err)
+	lock.Scripts[0].SHA256 = "0000"
+	s.Require().NoError(lock.Save(s.lockfile))
+
+	s.EqualError(run(), "Nothing was run: "+s.script+": The script's SHA-256 is "+s.digest()+", but it was locked at 0000")
+}
+
+func (s *LockTest) digest() string {
+	digest, err := fileSHA256(s.script)
+	s.Require().NoError(err)
+	return digest
+}
+
+func TestLockTest(t *testing.T) {
+	suite.Run(t, new(LockTest))
+}
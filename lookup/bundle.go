@@ -0,0 +1,147 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// Bundle is an author's identity the way a KeyService resolved it, with the
+// public key that goes with it. Bundles carry lookups to hosts that can't
+// make them themselves.
+type Bundle struct {
+	// Query is the author that was looked up.
+	Query string `json:"query"`
+	User  User   `json:"user"`
+	// Key is the armored public key.
+	Key string `json:"key"`
+
+	// AddedBy and Added record who put the bundle in a keyring, and when.
+	AddedBy string     `json:"added_by,omitempty"`
+	Added   *time.Time `json:"added,omitempty"`
+	// Authors are the PIPETHIS_AUTHORs the key is trusted for, besides
+	// Query.
+	Authors []string `json:"authors,omitempty"`
+	// URLs are the script locations the key is trusted for, like
+	// https://get.example.com/*. Empty means anywhere.
+	URLs []string `json:"urls,omitempty"`
+}
+
+// BundlesFromKeys makes a bundle for each key in ring, with a User built from
+// the key's identities.
+func BundlesFromKeys(ring openpgp.EntityList) ([]*Bundle, error) {
+	bundles := []*Bundle{}
+	for _, entity := range ring {
+		bundle, err := NewBundle("", userFromEntity(entity), openpgp.EntityList{entity})
+		if err != nil {
+			return nil, err
+		}
+		bundles = append(bundles, bundle)
+	}
+
+	return bundles, nil
+}
+
+// NewBundle packs up user and their key ring.
+func NewBundle(query string, user User, ring openpgp.EntityList) (*Bundle, error) {
+	armored := &bytes.Buffer{}
+	writer, err := armor.Encode(armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range ring {
+		if err := entity.Serialize(writer); err != nil {
+			return nil, err
+		}
+	}
+	writer.Close()
+
+	bundle := &Bundle{Query: query, User: user, Key: armored.String()}
+	if _, err := bundle.Ring(); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// ReadBundle decodes a bundle, and makes sure its key is the one its user was
+// matched with.
+func ReadBundle(reader io.Reader) (*Bundle, error) {
+	bundle := &Bundle{}
+	if err := json.NewDecoder(reader).Decode(bundle); err != nil {
+		return nil, errors.New("Invalid key bundle: " + err.Error())
+	}
+
+	if _, err := bundle.Ring(); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// Ring parses the bundled key, and returns the one with the user's
+// fingerprint.
+func (b Bundle) Ring() (openpgp.EntityList, error) {
+	if b.User.Fingerprint == "" {
+		return nil, errors.New("The key bundle doesn't have a fingerprint")
+	}
+
+	ring, err := ReadKeys([]byte(b.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	return keyWithFingerprint(ring, b.User)
+}
+
+// TrustedAuthors are all the authors the key is trusted for.
+func (b Bundle) TrustedAuthors() []string {
+	authors := []string{}
+	if b.Query != "" {
+		authors = append(authors, b.Query)
+	}
+	for _, author := range b.Authors {
+		if author != b.Query {
+			authors = append(authors, author)
+		}
+	}
+
+	return authors
+}
+
+// Matches is true if query is one of the authors the key is trusted for.
+// Authors that are whole fingerprints match without case or a 0x, and
+// nothing else (like a key ID) matches them.
+func (b Bundle) Matches(query string) bool {
+	if query == "" {
+		return false
+	}
+
+	requested := strings.TrimPrefix(strings.ToLower(query), "0x")
+	for _, author := range b.TrustedAuthors() {
+		if query == author {
+			return true
+		}
+		if fingerprintPattern.MatchString(query) && fingerprintPattern.MatchString(author) && requested == strings.TrimPrefix(strings.ToLower(author), "0x") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/suite"
+)
+
+type BundleTest struct {
+	suite.Suite
+	entity *openpgp.Entity
+	other  *openpgp.Entity
+}
+
+func (s *BundleTest) SetupSuite() {
+	var err error
+	s.entity, err = openpgp.NewEntity("Joe Doe", "", "joe@example.com", nil)
+	s.Require().NoError(err)
+	s.other, err = openpgp.NewEntity("Someone Else", "", "else@example.com", nil)
+	s.Require().NoError(err)
+}
+
+func (s *BundleTest) user() User {
+	user := userFromEntity(s.entity)
+	user.Username = "joedoe"
+	user.Source = "keybase"
+	return user
+}
+
+func (s *BundleTest) TestBundleRoundTrips() {
+	bundle, err := NewBundle("joedoe", s.user(), openpgp.EntityList{s.entity})
+	s.Require().NoError(err)
+
+	contents, err := json.Marshal(bundle)
+	s.Require().NoError(err)
+
+	read, err := ReadBundle(bytes.NewReader(contents))
+	s.NoError(err)
+	s.Equal(bundle, read)
+
+	ring, err := read.Ring()
+	s.NoError(err)
+	s.Equal(fingerprint(s.entity), fingerprint(ring[0]))
+}
+
+func (s *BundleTest) TestBundleNeedsMatchingKey() {
+	_, err := NewBundle("joedoe", s.user(), openpgp.EntityList{s.other})
+	s.Error(err)
+
+	_, err = NewBundle("joedoe", User{}, openpgp.EntityList{s.entity})
+	s.Error(err)
+
+	_, err = ReadBundle(strings.NewReader("not json"))
+	s.Error(err)
+}
+
+func (s *BundleTest) TestBundleMatches() {
+	bundle, err := NewBundle("joe_doe", s.user(), openpgp.EntityList{s.entity})
+	s.Require().NoError(err)
+
+	bundle.Authors = []string{"joe@example.com", "joe_doe"}
+	s.Equal([]string{"joe_doe", "joe@example.com"}, bundle.TrustedAuthors())
+
+	fpr := fingerprint(s.entity)
+	for _, query := range []string{"joe_doe", "joe@example.com"} {
+		s.True(bundle.Matches(query), query)
+	}
+
+	// the key's identities (or its fingerprint) aren't enough; it has to be
+	// trusted for the author
+	for _, query := range []string{"", "joedoe", "JOE@example.com", "else@example.com", fpr, fpr[:16]} {
+		s.False(bundle.Matches(query), query)
+	}
+
+	// fingerprints match as fingerprints, but key IDs never do
+	bundle.Authors = append(bundle.Authors, "0x"+strings.ToUpper(fpr))
+	for _, query := range []string{fpr, strings.ToUpper(fpr), "0x" + fpr} {
+		s.True(bundle.Matches(query), query)
+	}
+	for _, query := range []string{fpr[len(fpr)-16:], "0x" + fpr[len(fpr)-16:]} {
+		s.False(bundle.Matches(query), query)
+	}
+}
+
+func (s *BundleTest) TestBundlesFromKeys() {
+	bundles, err := BundlesFromKeys(openpgp.EntityList{s.entity, s.other})
+	s.NoError(err)
+	s.Len(bundles, 2)
+	s.Equal(fingerprint(s.other), bundles[1].User.Fingerprint)
+	s.Equal([]string{"else@example.com"}, bundles[1].User.Emails)
+}
+
+func TestBundleTest(t *testing.T) {
+	suite.Run(t, new(BundleTest))
+}
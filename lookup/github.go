@@ -0,0 +1,127 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// GitHub logins are letters, numbers and single hyphens, up to 39 characters.
+var githubLoginPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9]|-[a-zA-Z0-9]){0,38}$`)
+
+// GitHubService implements the KeyService interface for the GPG keys people
+// publish on GitHub (or GitHub Enterprise), at https://github.com/<login>.gpg.
+// It also implements SSHKeyService, for the SSH keys at
+// https://github.com/<login>.keys.
+type GitHubService struct {
+	client *http.Client
+	base   string
+}
+
+func init() {
+	Register("github", func(config Config) (KeyService, error) {
+		return NewGitHubService(config.HTTPClient(), config.Option("github-url", "https://github.com")), nil
+	})
+}
+
+// NewGitHubService creates a GitHubService for the GitHub site at base.
+func NewGitHubService(client *http.Client, base string) *GitHubService {
+	return &GitHubService{client: client, base: strings.TrimRight(base, "/")}
+}
+
+func (g GitHubService) keys(login string) (openpgp.EntityList, error) {
+	if !githubLoginPattern.MatchString(login) {
+		return nil, errors.New("Invalid GitHub login " + login)
+	}
+
+	return fetchKeys(g.client, g.base+"/"+login+".gpg")
+}
+
+// Matches treats query as a GitHub login, and returns one User for every GPG
+// key that login has published.
+func (g GitHubService) Matches(query string) ([]User, error) {
+	ring, err := g.keys(query)
+	if _, ok := err.(notFound); ok {
+		return []User{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []User{}
+	for _, entity := range ring {
+		user := userFromEntity(entity)
+		user.Username = query
+		user.GitHub = query
+
+		matches = append(matches, user)
+	}
+
+	return matches, nil
+}
+
+// Key fetches the user's published GPG keys again, and returns the one with
+// the user's fingerprint.
+func (g GitHubService) Key(user User) (openpgp.EntityList, error) {
+	ring, err := g.keys(user.GitHub)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyWithFingerprint(ring, user)
+}
+
+// SSHKeys treats query as a GitHub login, and returns every SSH public key
+// that login has published.
+func (g GitHubService) SSHKeys(query string) ([]ssh.PublicKey, error) {
+	if !githubLoginPattern.MatchString(query) {
+		return nil, errors.New("Invalid GitHub login " + query)
+	}
+
+	resp, err := g.client.Get(g.base + "/" + query + ".keys")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []ssh.PublicKey{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Couldn't get SSH keys for %s: %s", query, resp.Status)
+	}
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []ssh.PublicKey{}
+	for len(bytes.TrimSpace(contents)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(contents)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+		contents = rest
+	}
+
+	return keys, nil
+}
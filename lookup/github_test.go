@@ -0,0 +1,145 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+)
+
+type GitHubTest struct {
+	suite.Suite
+	first  *openpgp.Entity
+	second *openpgp.Entity
+	server *httptest.Server
+}
+
+func (s *GitHubTest) SetupSuite() {
+	var err error
+	s.first, err = openpgp.NewEntity("Gemma", "", "gemma@example.com", nil)
+	s.Require().NoError(err)
+	s.second, err = openpgp.NewEntity("Gemma", "laptop", "gemma@example.org", nil)
+	s.Require().NoError(err)
+
+	// GitHub sends one armored block per key
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ellotheth.gpg":
+			for _, entity := range []*openpgp.Entity{s.first, s.second} {
+				armored, _ := armor.Encode(w, openpgp.PublicKeyType, nil)
+				entity.Serialize(armored)
+				armored.Close()
+				fmt.Fprintln(w)
+			}
+		case "/ellotheth.keys":
+			fmt.Fprintln(w, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINwQo4L8IwVH+a+f8EUjv0VuvJ4SsH38FuzQ8YaPLBvm")
+			fmt.Fprintln(w, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBeHgfsSGSs9ycMbA/HIUFuMc8r9U3sFLoQI6SV2EcfM")
+		case "/broken.keys":
+			fmt.Fprintln(w, "not a key")
+		case "/nokeys.gpg":
+			fmt.Fprintln(w, "This user hasn't uploaded any GPG keys.")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func (s *GitHubTest) TearDownSuite() {
+	s.server.Close()
+}
+
+func (s *GitHubTest) TestMatchesReturnsOneUserPerKey() {
+	github := NewGitHubService(http.DefaultClient, s.server.URL+"/")
+
+	users, err := github.Matches("ellotheth")
+	s.NoError(err)
+	s.Len(users, 2)
+
+	s.Equal("ellotheth", users[0].Username)
+	s.Equal("ellotheth", users[0].GitHub)
+	s.Equal(fingerprint(s.first), users[0].Fingerprint)
+	s.Equal([]string{"gemma@example.com"}, users[0].Emails)
+
+	s.Equal("ellotheth", users[1].GitHub)
+	s.Equal(fingerprint(s.second), users[1].Fingerprint)
+}
+
+func (s *GitHubTest) TestMatchesIsEmptyWithoutKeys() {
+	github := NewGitHubService(http.DefaultClient, s.server.URL)
+
+	for _, login := range []string{"nokeys", "nobody"} {
+		users, err := github.Matches(login)
+		s.NoError(err, login)
+		s.Empty(users, login)
+	}
+}
+
+func (s *GitHubTest) TestMatchesRejectsInvalidLogins() {
+	github := NewGitHubService(http.DefaultClient, s.server.URL)
+
+	for _, login := range []string{"", "-foo", "foo--bar", "foo/bar", "foo@example.com"} {
+		_, err := github.Matches(login)
+		s.Error(err, login)
+	}
+}
+
+func (s *GitHubTest) TestKeyReturnsMatchedFingerprint() {
+	github := NewGitHubService(http.DefaultClient, s.server.URL)
+
+	ring, err := github.Key(User{GitHub: "ellotheth", Fingerprint: fingerprint(s.second)})
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fingerprint(s.second), fingerprint(ring[0]))
+
+	_, err = github.Key(User{GitHub: "ellotheth", Fingerprint: "abcdef"})
+	s.Error(err)
+}
+
+func (s *GitHubTest) TestSSHKeysReturnsPublishedKeys() {
+	github := NewGitHubService(http.DefaultClient, s.server.URL)
+
+	keys, err := github.SSHKeys("ellotheth")
+	s.NoError(err)
+	s.Len(keys, 2)
+	s.Equal("SHA256:xRBJWBgrbiS4A8NL36dNtiY71Zak3+TARKVQx2HZhwg", ssh.FingerprintSHA256(keys[0]))
+
+	keys, err = github.SSHKeys("nobody")
+	s.NoError(err)
+	s.Empty(keys)
+
+	_, err = github.SSHKeys("broken")
+	s.Error(err)
+
+	_, err = github.SSHKeys("foo/bar")
+	s.Error(err)
+}
+
+func (s *GitHubTest) TestLookupSSHKeysNeedsSSHKeyService() {
+	_, err := SSHKeys(&KeybaseService{}, "ellotheth")
+	s.Error(err)
+
+	keys, err := SSHKeys(NewGitHubService(http.DefaultClient, s.server.URL), "ellotheth")
+	s.NoError(err)
+	s.Len(keys, 2)
+
+	_, err = SSHKeys(NewGitHubService(http.DefaultClient, s.server.URL), "nobody")
+	s.EqualError(err, "No SSH keys found for nobody")
+}
+
+func TestGitHubTest(t *testing.T) {
+	suite.Run(t, new(GitHubTest))
+}
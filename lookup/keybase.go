@@ -12,13 +12,19 @@ package lookup
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
+// I think I set this up to match Keybase's own username pattern. I think.
+var keybaseUserPattern = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
+
 type keybaseResponse struct {
 	Status struct {
 		Code int    `json:"code"`
@@ -42,31 +48,87 @@ type keybaseUserVal struct {
 	Value string `json:"val"`
 }
 
+// keybaseLookup is the user/lookup.json response: the user's sigchain
+// summary, with their primary key and the state of each of their proofs.
+type keybaseLookup struct {
+	Status struct {
+		Code int    `json:"code"`
+		Name string `json:"name"`
+	} `json:"status"`
+	Them []*keybaseThem `json:"them"`
+}
+
+type keybaseThem struct {
+	Basics struct {
+		Username string `json:"username"`
+	} `json:"basics"`
+	Profile struct {
+		FullName string `json:"full_name"`
+	} `json:"profile"`
+	PublicKeys struct {
+		Primary struct {
+			Fingerprint string `json:"key_fingerprint"`
+			Bundle      string `json:"bundle"`
+		} `json:"primary"`
+	} `json:"public_keys"`
+	ProofsSummary struct {
+		All []keybaseProof `json:"all"`
+	} `json:"proofs_summary"`
+}
+
+type keybaseProof struct {
+	Type     string `json:"proof_type"`
+	Nametag  string `json:"nametag"`
+	State    int    `json:"state"`
+	HumanURL string `json:"human_url"`
+}
+
+// Keybase's proof state for a proof that passed its last check.
+const keybaseProofOK = 1
+
 // KeybaseService implements the KeyService interface for https://keybase.io
-type KeybaseService struct{}
+type KeybaseService struct {
+	client *http.Client
+	base   string
+}
 
-func (k KeybaseService) lookup(query string) ([]byte, error) {
-	if matches, _ := regexp.MatchString(`^[a-zA-Z0-9_\-\.]+$`, query); !matches {
-		return nil, errors.New("Invalid user requested")
-	}
+func init() {
+	Register("keybase", func(config Config) (KeyService, error) {
+		return NewKeybaseService(config.HTTPClient(), config.Option("keybase-url", "https://keybase.io")), nil
+	})
+}
 
-	resp, err := http.Get("https://keybase.io/_/api/1.0/user/autocomplete.json?q=" + query)
+// NewKeybaseService creates a KeybaseService for the Keybase site at base.
+func NewKeybaseService(client *http.Client, base string) *KeybaseService {
+	return &KeybaseService{client: client, base: strings.TrimRight(base, "/")}
+}
+
+func (k KeybaseService) get(path string, result interface{}) error {
+	resp, err := k.client.Get(k.base + path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	results, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Couldn't get %s from Keybase: %s", path, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return results, nil
+	return json.Unmarshal(body, result)
 }
 
-func (k KeybaseService) parse(body []byte) (*keybaseResponse, error) {
+func (k KeybaseService) lookup(query string) (*keybaseResponse, error) {
+	if !keybaseUserPattern.MatchString(query) {
+		return nil, errors.New("Invalid user requested")
+	}
+
 	lookup := &keybaseResponse{}
-	if err := json.Unmarshal(body, lookup); err != nil {
+	if err := k.get("/_/api/1.0/user/autocomplete.json?q="+url.QueryEscape(query), lookup); err != nil {
 		return nil, err
 	}
 	if lookup.Status.Code != 0 {
@@ -76,66 +138,125 @@ func (k KeybaseService) parse(body []byte) (*keybaseResponse, error) {
 	return lookup, nil
 }
 
-// Matches finds all the Keybase users that match query in any of their details
-// (username, Twitter identity, Github identity, public key fingerprint,
-// etc.). At most 10 matches will be found. If no matches are found, Matches
-// returns an error.
-func (k KeybaseService) Matches(query string) ([]User, error) {
-	results, err := k.lookup(query)
-	if err != nil {
+// sigchains fetches the lookup data for usernames. The results are in the same
+// order, with nil for users Keybase doesn't know.
+func (k KeybaseService) sigchains(usernames []string) ([]*keybaseThem, error) {
+	for _, username := range usernames {
+		if !keybaseUserPattern.MatchString(username) {
+			return nil, errors.New("Invalid user requested")
+		}
+	}
+
+	lookup := &keybaseLookup{}
+	if err := k.get("/_/api/1.0/user/lookup.json?usernames="+strings.Join(usernames, ","), lookup); err != nil {
 		return nil, err
 	}
+	if lookup.Status.Code != 0 {
+		return nil, errors.New("Bad status code: " + lookup.Status.Name)
+	}
+	if len(lookup.Them) != len(usernames) {
+		return nil, fmt.Errorf("Asked Keybase about %d users and got %d back", len(usernames), len(lookup.Them))
+	}
+
+	return lookup.Them, nil
+}
+
+// userFromSigchain builds a User out of Keybase's lookup data. The social
+// identities only come from proofs that are live; every proof is listed in
+// Proofs, live or not.
+func userFromSigchain(them *keybaseThem) User {
+	user := User{
+		Username:    them.Basics.Username,
+		Fingerprint: strings.ToLower(them.PublicKeys.Primary.Fingerprint),
+		FullName:    them.Profile.FullName,
+	}
+
+	for _, found := range them.ProofsSummary.All {
+		proof := Proof{Service: found.Type, Name: found.Nametag, URL: found.HumanURL, Live: found.State == keybaseProofOK}
+		user.Proofs = append(user.Proofs, proof)
+		if !proof.Live {
+			continue
+		}
+
+		switch found.Type {
+		case "twitter":
+			user.Twitter = found.Nametag
+		case "github":
+			user.GitHub = found.Nametag
+		case "hackernews":
+			user.HackerNews = found.Nametag
+		case "reddit":
+			user.Reddit = found.Nametag
+		case "generic_web_site", "dns":
+			user.Sites = append(user.Sites, found.Nametag)
+		}
+	}
 
-	lookup, err := k.parse(results)
+	return user
+}
+
+// Matches finds all the Keybase users that match query in any of their details
+// (username, Twitter identity, Github identity, public key fingerprint,
+// etc.). At most 10 matches will be found. Each match's details come from its
+// sigchain rather than the search results, so only proofs that are live are
+// shown as the user's identities. Users without a primary key are left out.
+func (k KeybaseService) Matches(query string) ([]User, error) {
+	lookup, err := k.lookup(query)
 	if err != nil {
 		return nil, err
 	}
 
 	matches := []User{}
+	if len(lookup.Users) == 0 {
+		return matches, nil
+	}
 
+	usernames := []string{}
 	for _, match := range lookup.Users {
-		user := User{
-			Username:    match.Details.Username.Value,
-			Fingerprint: match.Details.Fingerprint.Value,
-			GitHub:      match.Details.GitHub.Value,
-			Twitter:     match.Details.Twitter.Value,
-			HackerNews:  match.Details.HackerNews.Value,
-			Reddit:      match.Details.Reddit.Value,
-		}
+		usernames = append(usernames, match.Details.Username.Value)
+	}
+
+	sigchains, err := k.sigchains(usernames)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, site := range match.Details.Sites {
-			user.Sites = append(user.Sites, site.Value)
+	for _, them := range sigchains {
+		if them == nil || them.PublicKeys.Primary.Fingerprint == "" {
+			continue
 		}
 
-		matches = append(matches, user)
+		matches = append(matches, userFromSigchain(them))
 	}
 
 	return matches, nil
 }
 
 // Key finds the PGP public key for one Keybase user by Keybase username and
-// returns the key ring representation of the key. If the Keybase username is
-// invalid, or the key itself is missing or invalid, Key returns an error.
+// returns the key ring representation of the key. Keybase has to still have
+// the key with the user's fingerprint as the user's primary key. If the
+// Keybase username is invalid, or the key itself is missing, invalid or
+// different, Key returns an error.
 func (k KeybaseService) Key(user User) (openpgp.EntityList, error) {
+	sigchains, err := k.sigchains([]string{user.Username})
+	if err != nil {
+		return nil, err
+	}
 
-	// I think I set this up to match Keybase's own username pattern. I think.
-	if matches, _ := regexp.MatchString(`^[a-zA-Z0-9_\-\.]+$`, user.Username); !matches {
-		return nil, errors.New("Invalid user requested")
+	them := sigchains[0]
+	if them == nil {
+		return nil, errors.New("Keybase doesn't know " + user.Username)
 	}
 
-	resp, err := http.Get("https://keybase.io/" + user.Username + "/key.asc")
-	if err != nil {
-		return nil, err
+	primary := them.PublicKeys.Primary
+	if !strings.EqualFold(primary.Fingerprint, user.Fingerprint) {
+		return nil, fmt.Errorf("Keybase's key for %s is %s, not %s", user.Username, primary.Fingerprint, user.Fingerprint)
 	}
-	defer resp.Body.Close()
 
-	ring, err := openpgp.ReadArmoredKeyRing(resp.Body)
+	ring, err := ReadKeys([]byte(primary.Bundle))
 	if err != nil {
 		return nil, err
 	}
-	if len(ring) != 1 {
-		return nil, errors.New("More than one key returned, not sure what to do")
-	}
 
-	return ring, nil
+	return keyWithFingerprint(ring, user)
 }
@@ -0,0 +1,156 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeybaseTest struct {
+	suite.Suite
+	entity  *openpgp.Entity
+	other   *openpgp.Entity
+	server  *httptest.Server
+	primary map[string]*openpgp.Entity
+}
+
+func (s *KeybaseTest) SetupSuite() {
+	var err error
+	s.entity, err = openpgp.NewEntity("Gemma", "", "gemma@example.com", nil)
+	s.Require().NoError(err)
+	s.other, err = openpgp.NewEntity("Gemma", "new", "gemma@example.org", nil)
+	s.Require().NoError(err)
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_/api/1.0/user/autocomplete.json":
+			completions := []map[string]interface{}{}
+			if r.URL.Query().Get("q") == "gemma" {
+				for _, name := range []string{"gemma", "gemma_nokey", "gemma_gone"} {
+					completions = append(completions, map[string]interface{}{
+						"components": map[string]interface{}{
+							"username":        map[string]string{"val": name},
+							"key_fingerprint": map[string]string{"val": "claimed"},
+							"twitter":         map[string]string{"val": "claimed"},
+						},
+					})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]interface{}{"code": 0}, "completions": completions})
+		case "/_/api/1.0/user/lookup.json":
+			them := []interface{}{}
+			for _, name := range strings.Split(r.URL.Query().Get("usernames"), ",") {
+				them = append(them, s.them(name))
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": map[string]interface{}{"code": 0}, "them": them})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func (s *KeybaseTest) SetupTest() {
+	s.primary = map[string]*openpgp.Entity{"gemma": s.entity}
+}
+
+func (s *KeybaseTest) TearDownSuite() {
+	s.server.Close()
+}
+
+// them is the lookup data for one user: gemma has a key and proofs,
+// gemma_nokey has neither, and anyone else doesn't exist.
+func (s *KeybaseTest) them(name string) interface{} {
+	switch name {
+	case "gemma":
+		entity := s.primary[name]
+		bundle := &bytes.Buffer{}
+		writer, _ := armor.Encode(bundle, openpgp.PublicKeyType, nil)
+		entity.Serialize(writer)
+		writer.Close()
+
+		return map[string]interface{}{
+			"basics":      map[string]string{"username": name},
+			"profile":     map[string]string{"full_name": "Gemma"},
+			"public_keys": map[string]interface{}{"primary": map[string]string{"key_fingerprint": fingerprint(entity), "bundle": bundle.String()}},
+			"proofs_summary": map[string]interface{}{"all": []map[string]interface{}{
+				{"proof_type": "github", "nametag": "ellotheth", "state": 1, "human_url": "https://gist.github.com/ellotheth/1"},
+				{"proof_type": "twitter", "nametag": "ellotheth", "state": 2},
+				{"proof_type": "dns", "nametag": "example.com", "state": 1},
+			}},
+		}
+	case "gemma_nokey":
+		return map[string]interface{}{"basics": map[string]string{"username": name}}
+	}
+
+	return nil
+}
+
+func (s *KeybaseTest) TestMatchesUseSigchain() {
+	keybase := NewKeybaseService(http.DefaultClient, s.server.URL+"/")
+
+	users, err := keybase.Matches("gemma")
+	s.NoError(err)
+	s.Require().Len(users, 1)
+
+	user := users[0]
+	s.Equal("gemma", user.Username)
+	s.Equal(fingerprint(s.entity), user.Fingerprint)
+	s.Equal("ellotheth", user.GitHub)
+	s.Equal("", user.Twitter)
+	s.Equal([]string{"example.com"}, user.Sites)
+	s.Equal([]Proof{
+		{Service: "github", Name: "ellotheth", URL: "https://gist.github.com/ellotheth/1", Live: true},
+		{Service: "twitter", Name: "ellotheth"},
+		{Service: "dns", Name: "example.com", Live: true},
+	}, user.Proofs)
+	s.Contains(user.String(), "Proof: twitter ellotheth (claimed, NOT verified)")
+	s.Contains(user.String(), "Proof: github ellotheth (live)")
+
+	users, err = keybase.Matches("nobody")
+	s.NoError(err)
+	s.Empty(users)
+
+	_, err = keybase.Matches("foo/bar")
+	s.Error(err)
+}
+
+func (s *KeybaseTest) TestKeyChecksFingerprint() {
+	keybase := NewKeybaseService(http.DefaultClient, s.server.URL)
+	user := User{Username: "gemma", Fingerprint: fingerprint(s.entity)}
+
+	ring, err := keybase.Key(user)
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fingerprint(s.entity), fingerprint(ring[0]))
+
+	// the key changed between the match and the download
+	s.primary["gemma"] = s.other
+	_, err = keybase.Key(user)
+	s.EqualError(err, "Keybase's key for gemma is "+fingerprint(s.other)+", not "+fingerprint(s.entity))
+
+	_, err = keybase.Key(User{Username: "gemma_gone", Fingerprint: fingerprint(s.entity)})
+	s.Error(err)
+
+	_, err = keybase.Key(User{Username: "../gemma"})
+	s.Error(err)
+}
+
+func TestKeybaseTest(t *testing.T) {
+	suite.Run(t, new(KeybaseTest))
+}
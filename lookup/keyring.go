@@ -0,0 +1,185 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// DefaultKeyring is the directory of the pipethis keyring:
+// $PIPETHIS_HOME/keyring, or ~/.pipethis/keyring.
+func DefaultKeyring() string {
+	home := os.Getenv("PIPETHIS_HOME")
+	if home == "" {
+		home = filepath.Join(os.Getenv("HOME"), ".pipethis")
+	}
+
+	return filepath.Join(home, "keyring")
+}
+
+// Keyring is pipethis's own keyring, kept apart from GnuPG's. It's a
+// directory with one bundle per key, named after the key's fingerprint.
+type Keyring struct {
+	dir string
+}
+
+// NewKeyring opens the keyring in dir. It doesn't have to exist until
+// something is added to it.
+func NewKeyring(dir string) *Keyring {
+	return &Keyring{dir: dir}
+}
+
+// Dir is the keyring's directory.
+func (k Keyring) Dir() string {
+	return k.dir
+}
+
+func (k Keyring) filename(fingerprint string) string {
+	return filepath.Join(k.dir, strings.ToLower(fingerprint)+".json")
+}
+
+// Bundles reads every bundle in the keyring, sorted by fingerprint.
+func (k Keyring) Bundles() ([]*Bundle, error) {
+	filenames, err := filepath.Glob(filepath.Join(k.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(filenames)
+
+	bundles := []*Bundle{}
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		bundle, err := ReadBundle(file)
+		file.Close()
+		if err != nil {
+			return nil, errors.New(filename + ": " + err.Error())
+		}
+
+		bundles = append(bundles, bundle)
+	}
+
+	return bundles, nil
+}
+
+// Add writes bundle into the keyring. A bundle that's already there for the
+// same key is only replaced (along with what it's trusted for) if replace is
+// set. It returns the name of the file it wrote.
+func (k Keyring) Add(bundle *Bundle, replace bool) (string, error) {
+	if _, err := bundle.Ring(); err != nil {
+		return "", err
+	}
+
+	filename := k.filename(bundle.User.Fingerprint)
+	if _, err := os.Stat(filename); err == nil && !replace {
+		return "", errors.New(bundle.User.Fingerprint + " is already in the keyring; replace it to change what it's trusted for")
+	}
+
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return "", err
+	}
+
+	contents, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return filename, ioutil.WriteFile(filename, append(contents, '\n'), 0600)
+}
+
+// Find returns the bundle for the key with a full fingerprint.
+func (k Keyring) Find(id string) (*Bundle, error) {
+	if err := checkFingerprint(id); err != nil {
+		return nil, err
+	}
+
+	bundles, err := k.Bundles()
+	if err != nil {
+		return nil, err
+	}
+
+	requested := strings.TrimPrefix(strings.ToLower(id), "0x")
+	for _, bundle := range bundles {
+		if strings.ToLower(bundle.User.Fingerprint) == requested {
+			return bundle, nil
+		}
+	}
+
+	return nil, errors.New("No key in the keyring with fingerprint " + id)
+}
+
+// Remove deletes the bundle for the key with a full fingerprint.
+func (k Keyring) Remove(id string) (*Bundle, error) {
+	bundle, err := k.Find(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return bundle, os.Remove(k.filename(bundle.User.Fingerprint))
+}
+
+// KeyringService implements the KeyService interface for the pipethis
+// keyring. It never touches the network, or GnuPG.
+type KeyringService struct {
+	bundles []*Bundle
+}
+
+func init() {
+	factory := func(config Config) (KeyService, error) {
+		return NewKeyringService(NewKeyring(config.Option("keyring", DefaultKeyring())))
+	}
+
+	Register("pipethis", factory)
+	Register("bundle", factory)
+}
+
+// NewKeyringService loads every bundle in keyring.
+func NewKeyringService(keyring *Keyring) (*KeyringService, error) {
+	bundles, err := keyring.Bundles()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyringService{bundles: bundles}, nil
+}
+
+// Matches returns the user from every bundle that's trusted for query.
+func (k KeyringService) Matches(query string) ([]User, error) {
+	matches := []User{}
+	for _, bundle := range k.bundles {
+		if bundle.Matches(query) {
+			matches = append(matches, bundle.User)
+		}
+	}
+
+	return matches, nil
+}
+
+// Key returns the key with the user's fingerprint.
+func (k KeyringService) Key(user User) (openpgp.EntityList, error) {
+	for _, bundle := range k.bundles {
+		if strings.EqualFold(bundle.User.Fingerprint, user.Fingerprint) {
+			return bundle.Ring()
+		}
+	}
+
+	return nil, errors.New("No key in the keyring with fingerprint " + user.Fingerprint)
+}
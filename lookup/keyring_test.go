@@ -0,0 +1,157 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyringTest struct {
+	suite.Suite
+	entity  *openpgp.Entity
+	other   *openpgp.Entity
+	dir     string
+	keyring *Keyring
+}
+
+func (s *KeyringTest) SetupSuite() {
+	var err error
+	s.entity, err = openpgp.NewEntity("Joe Doe", "", "joe@example.com", nil)
+	s.Require().NoError(err)
+	s.other, err = openpgp.NewEntity("Someone Else", "", "else@example.com", nil)
+	s.Require().NoError(err)
+}
+
+func (s *KeyringTest) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	s.keyring = NewKeyring(filepath.Join(s.dir, "keyring"))
+}
+
+func (s *KeyringTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *KeyringTest) add(query string, entity *openpgp.Entity) *Bundle {
+	bundle, err := NewBundle(query, userFromEntity(entity), openpgp.EntityList{entity})
+	s.Require().NoError(err)
+
+	filename, err := s.keyring.Add(bundle, true)
+	s.Require().NoError(err)
+	s.Equal(filepath.Join(s.keyring.Dir(), fingerprint(entity)+".json"), filename)
+
+	return bundle
+}
+
+func (s *KeyringTest) TestMissingKeyringIsEmpty() {
+	bundles, err := s.keyring.Bundles()
+	s.NoError(err)
+	s.Empty(bundles)
+}
+
+func (s *KeyringTest) TestAddReplacesAndFindMatchesIDs() {
+	s.add("joedoe", s.entity)
+	s.add("joe", s.entity)
+	s.add("else", s.other)
+
+	bundles, err := s.keyring.Bundles()
+	s.NoError(err)
+	s.Len(bundles, 2)
+
+	fpr := fingerprint(s.entity)
+	for _, id := range []string{fpr, "0x" + strings.ToUpper(fpr)} {
+		bundle, err := s.keyring.Find(id)
+		s.NoError(err, id)
+		s.Equal("joe", bundle.Query, id)
+	}
+
+	// long key IDs can be forged
+	for _, id := range []string{"abcdef", fpr[len(fpr)-16:], "0x" + fpr[len(fpr)-16:]} {
+		_, err = s.keyring.Find(id)
+		s.Error(err, id)
+	}
+}
+
+func (s *KeyringTest) TestAddOnlyReplacesWhenAsked() {
+	s.add("joedoe", s.entity)
+
+	bundle, err := NewBundle("joe", userFromEntity(s.entity), openpgp.EntityList{s.entity})
+	s.Require().NoError(err)
+	_, err = s.keyring.Add(bundle, false)
+	s.Error(err)
+
+	found, err := s.keyring.Find(fingerprint(s.entity))
+	s.Require().NoError(err)
+	s.Equal("joedoe", found.Query)
+}
+
+func (s *KeyringTest) TestRemove() {
+	s.add("joedoe", s.entity)
+
+	bundle, err := s.keyring.Remove(fingerprint(s.entity))
+	s.NoError(err)
+	s.Equal("joedoe", bundle.Query)
+
+	_, err = s.keyring.Remove(fingerprint(s.entity))
+	s.Error(err)
+}
+
+func (s *KeyringTest) TestServiceOnlyMatchesTrustedAuthors() {
+	s.add("joedoe", s.entity)
+	s.add("joedoe", s.other)
+
+	for _, name := range []string{"pipethis", "bundle"} {
+		service, err := NewKeyService(name, false, Config{Options: map[string]string{"keyring": s.keyring.Dir()}})
+		s.Require().NoError(err)
+
+		users, err := service.Matches("joedoe")
+		s.NoError(err)
+		s.Len(users, 2)
+
+		users, err = service.Matches("else@example.com")
+		s.NoError(err)
+		s.Empty(users)
+
+		// a key is only trusted for its fingerprint if it was added for it
+		users, err = service.Matches(fingerprint(s.other))
+		s.NoError(err)
+		s.Empty(users)
+
+		users, err = service.Matches("joedoe")
+		s.NoError(err)
+		s.Require().Len(users, 2)
+		ring, err := service.Key(users[1])
+		s.NoError(err)
+		s.Equal(users[1].Fingerprint, fingerprint(ring[0]))
+
+		_, err = service.Key(User{Fingerprint: "abcdef"})
+		s.Error(err)
+	}
+}
+
+func (s *KeyringTest) TestServiceRejectsBrokenBundles() {
+	s.Require().NoError(os.MkdirAll(s.keyring.Dir(), 0700))
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(s.keyring.Dir(), "broken.json"), []byte(`{"user": {"fingerprint": "abcdef"}}`), 0600))
+
+	_, err := NewKeyringService(s.keyring)
+	s.Error(err)
+}
+
+func TestKeyringTest(t *testing.T) {
+	suite.Run(t, new(KeyringTest))
+}
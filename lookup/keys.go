@@ -0,0 +1,162 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// fingerprint is the hex representation of an entity's primary key
+// fingerprint, the same way Keybase shows it.
+func fingerprint(entity *openpgp.Entity) string {
+	return fmt.Sprintf("%x", entity.PrimaryKey.Fingerprint)
+}
+
+// userFromEntity builds a User out of the identities attached to a public key.
+func userFromEntity(entity *openpgp.Entity) User {
+	user := User{Fingerprint: fingerprint(entity)}
+
+	for _, identity := range entity.Identities {
+		if user.FullName == "" {
+			user.FullName = identity.UserId.Name
+		}
+		if identity.UserId.Email != "" {
+			user.Emails = append(user.Emails, identity.UserId.Email)
+		}
+	}
+
+	return user
+}
+
+// hasEmail is true if any of the user's emails is email, ignoring case.
+func hasEmail(user User, email string) bool {
+	for _, candidate := range user.Emails {
+		if strings.EqualFold(candidate, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadKeys parses a key ring that could be binary, or any number of armored
+// public key blocks one after the other.
+func ReadKeys(contents []byte) (openpgp.EntityList, error) {
+	ring := openpgp.EntityList{}
+
+	// armor.Decode buffers its input, unless it's already buffered. share the
+	// buffer so the next block is still there after the first one.
+	reader := bufio.NewReader(bytes.NewReader(contents))
+	for {
+		block, err := armor.Decode(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if block.Type != openpgp.PublicKeyType {
+			continue
+		}
+
+		keys, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		ring = append(ring, keys...)
+	}
+
+	if len(ring) > 0 {
+		return ring, nil
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(contents))
+}
+
+// hasFingerprint is true if entity has exactly the fingerprint requested.
+func hasFingerprint(entity *openpgp.Entity, requested string) bool {
+	return fingerprint(entity) == strings.TrimPrefix(strings.ToLower(requested), "0x")
+}
+
+// checkFingerprint makes sure fpr is a whole fingerprint. Key IDs aren't
+// enough to pick a key by, since anyone can make a key with the same one.
+func checkFingerprint(fpr string) error {
+	if keyIDPattern.MatchString(fpr) {
+		return errors.New("Key IDs like " + fpr + " can be forged; use the full fingerprint")
+	}
+	if !fingerprintPattern.MatchString(fpr) {
+		return errors.New("Invalid fingerprint " + fpr)
+	}
+
+	return nil
+}
+
+// keyWithFingerprint picks the one key in ring that has the fingerprint the
+// user was matched with.
+func keyWithFingerprint(ring openpgp.EntityList, user User) (openpgp.EntityList, error) {
+	if err := checkFingerprint(user.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	for _, entity := range ring {
+		if hasFingerprint(entity, user.Fingerprint) {
+			return openpgp.EntityList{entity}, nil
+		}
+	}
+
+	return nil, errors.New("No key found with fingerprint " + user.Fingerprint)
+}
+
+// notFound is the error fetchKeys returns when a location doesn't have any
+// keys.
+type notFound string
+
+func (n notFound) Error() string {
+	return "No keys found at " + string(n)
+}
+
+// fetchKeys downloads and parses the key ring at location.
+func fetchKeys(client *http.Client, location string) (openpgp.EntityList, error) {
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notFound(location)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Couldn't get keys from %s: %s", location, resp.Status)
+	}
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// some services say "no keys here" with a 200 and a human-readable
+	// message. binary OpenPGP packets always start with the high bit set.
+	if !bytes.Contains(contents, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) && (len(contents) == 0 || contents[0]&0x80 == 0) {
+		return nil, notFound(location)
+	}
+
+	return ReadKeys(contents)
+}
@@ -0,0 +1,261 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+var (
+	fingerprintPattern = regexp.MustCompile(`^(0x)?([0-9a-fA-F]{40}|[0-9a-fA-F]{64})$`)
+	keyIDPattern       = regexp.MustCompile(`^(0x)?([0-9a-fA-F]{8}|[0-9a-fA-F]{16})$`)
+
+	// vksHosts are the keyservers that get the VKS API by default.
+	vksHosts = map[string]bool{"keys.openpgp.org": true}
+)
+
+// KeyserverService implements the KeyService interface for OpenPGP keyservers.
+// It speaks HKP (the SKS/Hockeypuck protocol), and the VKS API from
+// https://keys.openpgp.org.
+type KeyserverService struct {
+	client   *http.Client
+	base     string
+	protocol string
+}
+
+func init() {
+	Register("keyserver", func(config Config) (KeyService, error) {
+		return NewKeyserverService(
+			config.HTTPClient(),
+			config.Option("keyserver", "https://keys.openpgp.org"),
+			config.Option("keyserver-protocol", ""),
+		)
+	})
+}
+
+// NewKeyserverService creates a KeyserverService for the keyserver at base,
+// which can use the https, http, hkps or hkp schemes. protocol is "hkp" or
+// "vks"; if it's empty, VKS is used for keys.openpgp.org and HKP for
+// everything else.
+func NewKeyserverService(client *http.Client, base string, protocol string) (*KeyserverService, error) {
+	parsed, err := url.Parse(base)
+	if err != nil || parsed.Host == "" {
+		return nil, errors.New("Invalid keyserver URL " + base)
+	}
+
+	switch parsed.Scheme {
+	case "hkps", "https":
+		parsed.Scheme = "https"
+	case "hkp", "http":
+		if parsed.Scheme == "hkp" && parsed.Port() == "" {
+			parsed.Host += ":11371"
+		}
+		parsed.Scheme = "http"
+	default:
+		return nil, errors.New("Unsupported keyserver scheme " + parsed.Scheme)
+	}
+
+	if protocol == "" {
+		protocol = "hkp"
+		if vksHosts[parsed.Hostname()] {
+			protocol = "vks"
+		}
+	}
+	if protocol != "hkp" && protocol != "vks" {
+		return nil, errors.New("Unsupported keyserver protocol " + protocol)
+	}
+
+	return &KeyserverService{
+		client:   client,
+		base:     strings.TrimRight(parsed.String(), "/"),
+		protocol: protocol,
+	}, nil
+}
+
+// Matches finds the keys on the keyserver with an identity or fingerprint that
+// matches query. The VKS API only searches by exact email address or
+// fingerprint. Key IDs aren't searched at all, since anyone can make a key
+// with the same one.
+func (k KeyserverService) Matches(query string) ([]User, error) {
+	if keyIDPattern.MatchString(query) {
+		return nil, errors.New("Key IDs like " + query + " can be forged; use the full fingerprint or an email address")
+	}
+
+	if k.protocol == "vks" {
+		return k.vksMatches(query)
+	}
+
+	return k.hkpMatches(query)
+}
+
+// Key gets the public key with the user's fingerprint from the keyserver. If
+// the keyserver sends back anything else, Key returns an error.
+func (k KeyserverService) Key(user User) (openpgp.EntityList, error) {
+	if err := checkFingerprint(user.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	location, err := k.keyLocation(user.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	ring, err := fetchKeys(k.client, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyWithFingerprint(ring, user)
+}
+
+func (k KeyserverService) keyLocation(fpr string) (string, error) {
+	fpr = strings.TrimPrefix(strings.ToLower(fpr), "0x")
+
+	if k.protocol == "hkp" {
+		return k.base + "/pks/lookup?op=get&options=mr&search=0x" + fpr, nil
+	}
+
+	if err := checkFingerprint(fpr); err != nil {
+		return "", err
+	}
+
+	return k.base + "/vks/v1/by-fingerprint/" + strings.ToUpper(fpr), nil
+}
+
+func (k KeyserverService) vksMatches(query string) ([]User, error) {
+	var location string
+
+	switch {
+	case fingerprintPattern.MatchString(query):
+		location, _ = k.keyLocation(query)
+	case emailPattern.MatchString(query):
+		location = k.base + "/vks/v1/by-email/" + url.PathEscape(query)
+	default:
+		return nil, errors.New("The VKS API can only look up email addresses and fingerprints")
+	}
+
+	ring, err := fetchKeys(k.client, location)
+	if _, ok := err.(notFound); ok {
+		return []User{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []User{}
+	for _, entity := range ring {
+		user := userFromEntity(entity)
+		if fingerprintPattern.MatchString(query) && !hasFingerprint(entity, query) {
+			continue
+		}
+		if !fingerprintPattern.MatchString(query) && !hasEmail(user, query) {
+			continue
+		}
+
+		matches = append(matches, user)
+	}
+
+	return matches, nil
+}
+
+func (k KeyserverService) hkpMatches(query string) ([]User, error) {
+	search := query
+	if fingerprintPattern.MatchString(query) {
+		search = "0x" + strings.TrimPrefix(strings.ToLower(query), "0x")
+	}
+
+	resp, err := k.client.Get(k.base + "/pks/lookup?op=index&options=mr&search=" + url.QueryEscape(search))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []User{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Keyserver search failed: %s", resp.Status)
+	}
+
+	return parseHKPIndex(resp.Body)
+}
+
+// parseHKPIndex reads the machine-readable HKP index format:
+//
+//	info:1:1
+//	pub:<fingerprint or key ID>:<algorithm>:<length>:<created>:<expires>:<flags>
+//	uid:<escaped user ID>:<created>:<expires>:<flags>
+//
+// Revoked, disabled and expired keys are skipped.
+func parseHKPIndex(body io.Reader) ([]User, error) {
+	matches := []User{}
+	var current *User
+
+	finish := func() {
+		if current != nil {
+			matches = append(matches, *current)
+			current = nil
+		}
+	}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+
+		switch fields[0] {
+		case "pub":
+			finish()
+			if len(fields) < 2 || !fingerprintPattern.MatchString(fields[1]) {
+				continue
+			}
+			if len(fields) > 6 && strings.ContainsAny(fields[6], "rde") {
+				continue
+			}
+			current = &User{Fingerprint: strings.ToLower(fields[1])}
+		case "uid":
+			if current == nil || len(fields) < 2 {
+				continue
+			}
+			if len(fields) > 4 && strings.ContainsAny(fields[4], "rde") {
+				continue
+			}
+
+			uid, err := url.PathUnescape(fields[1])
+			if err != nil {
+				continue
+			}
+
+			addr, err := mail.ParseAddress(uid)
+			if err != nil {
+				if current.FullName == "" {
+					current.FullName = uid
+				}
+				continue
+			}
+			if current.FullName == "" {
+				current.FullName = addr.Name
+			}
+			current.Emails = append(current.Emails, addr.Address)
+		}
+	}
+	finish()
+
+	return matches, scanner.Err()
+}
@@ -0,0 +1,204 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyserverTest struct {
+	suite.Suite
+	entity *openpgp.Entity
+	other  *openpgp.Entity
+}
+
+func (s *KeyserverTest) SetupSuite() {
+	var err error
+	s.entity, err = openpgp.NewEntity("Joe Doe", "", "joe@example.com", nil)
+	s.Require().NoError(err)
+	s.other, err = openpgp.NewEntity("Someone Else", "", "else@example.com", nil)
+	s.Require().NoError(err)
+}
+
+func (s *KeyserverTest) serve(w http.ResponseWriter, entities ...*openpgp.Entity) {
+	armored, _ := armor.Encode(w, openpgp.PublicKeyType, nil)
+	for _, entity := range entities {
+		entity.Serialize(armored)
+	}
+	armored.Close()
+}
+
+// server is a keyserver that knows about s.entity, and hands it out when
+// it's asked for s.other's key too.
+func (s *KeyserverTest) server() *httptest.Server {
+	fpr := fingerprint(s.entity)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		switch {
+		case r.URL.Path == "/pks/lookup" && query.Get("op") == "index" && query.Get("search") == "joe@example.com":
+			fmt.Fprintf(w, "info:1:3\n")
+			fmt.Fprintf(w, "pub:%s:1:2048:1234567890::\n", strings.ToUpper(fpr))
+			fmt.Fprintf(w, "uid:Joe%%20Doe%%20%%3Cjoe@example.com%%3E:1234567890::\n")
+			fmt.Fprintf(w, "uid:Joe%%20Doe%%20%%3Cold@example.com%%3E:1234567890::r\n")
+			fmt.Fprintf(w, "pub:%s:1:2048:1234567890::r\n", fingerprint(s.other))
+			fmt.Fprintf(w, "uid:Revoked%%20%%3Cjoe@example.com%%3E:1234567890::\n")
+		case r.URL.Path == "/pks/lookup" && query.Get("op") == "get" && query.Get("search") == "0x"+fpr:
+			s.serve(w, s.entity)
+		case r.URL.Path == "/pks/lookup" && query.Get("op") == "get" && query.Get("search") == "0x"+fingerprint(s.other):
+			s.serve(w, s.entity)
+		case r.URL.Path == "/vks/v1/by-email/joe@example.com":
+			s.serve(w, s.entity)
+		case r.URL.Path == "/vks/v1/by-fingerprint/"+strings.ToUpper(fpr):
+			s.serve(w, s.entity)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func (s *KeyserverTest) TestNewPicksProtocolAndScheme() {
+	cases := []struct {
+		base     string
+		protocol string
+		url      string
+		expected string
+	}{
+		{"https://keys.openpgp.org", "", "https://keys.openpgp.org", "vks"},
+		{"hkps://keys.openpgp.org/", "", "https://keys.openpgp.org", "vks"},
+		{"https://keys.openpgp.org", "hkp", "https://keys.openpgp.org", "hkp"},
+		{"hkps://keyserver.ubuntu.com", "", "https://keyserver.ubuntu.com", "hkp"},
+		{"hkp://keyserver.ubuntu.com", "", "http://keyserver.ubuntu.com:11371", "hkp"},
+		{"http://localhost:8080", "vks", "http://localhost:8080", "vks"},
+	}
+
+	for _, c := range cases {
+		service, err := NewKeyserverService(nil, c.base, c.protocol)
+		s.NoError(err, c.base)
+		s.Equal(c.url, service.base, c.base)
+		s.Equal(c.expected, service.protocol, c.base)
+	}
+}
+
+func (s *KeyserverTest) TestNewBailsOnBadConfig() {
+	for _, base := range []string{"", "keys.openpgp.org", "ftp://keys.openpgp.org"} {
+		_, err := NewKeyserverService(nil, base, "")
+		s.Error(err, base)
+	}
+
+	_, err := NewKeyserverService(nil, "https://keys.openpgp.org", "ldap")
+	s.Error(err)
+}
+
+func (s *KeyserverTest) TestHKPMatchesParsesIndex() {
+	server := s.server()
+	defer server.Close()
+
+	service, _ := NewKeyserverService(http.DefaultClient, server.URL, "hkp")
+	users, err := service.Matches("joe@example.com")
+	s.NoError(err)
+	s.Equal([]User{{
+		Fingerprint: fingerprint(s.entity),
+		FullName:    "Joe Doe",
+		Emails:      []string{"joe@example.com"},
+	}}, users)
+}
+
+func (s *KeyserverTest) TestHKPMatchesIsEmptyWhenNotFound() {
+	server := s.server()
+	defer server.Close()
+
+	service, _ := NewKeyserverService(http.DefaultClient, server.URL, "hkp")
+	users, err := service.Matches("nobody@example.com")
+	s.NoError(err)
+	s.Empty(users)
+}
+
+func (s *KeyserverTest) TestHKPKeyReturnsRequestedFingerprint() {
+	server := s.server()
+	defer server.Close()
+
+	service, _ := NewKeyserverService(http.DefaultClient, server.URL, "hkp")
+	ring, err := service.Key(User{Fingerprint: fingerprint(s.entity)})
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(fingerprint(s.entity), fingerprint(ring[0]))
+}
+
+func (s *KeyserverTest) TestHKPKeyRefusesWrongFingerprint() {
+	server := s.server()
+	defer server.Close()
+
+	service, _ := NewKeyserverService(http.DefaultClient, server.URL, "hkp")
+	_, err := service.Key(User{Fingerprint: fingerprint(s.other)})
+	s.EqualError(err, "No key found with fingerprint "+fingerprint(s.other))
+
+	// key IDs aren't enough to pick a key
+	_, err = service.Key(User{Fingerprint: fingerprint(s.entity)[24:]})
+	s.EqualError(err, "Key IDs like "+fingerprint(s.entity)[24:]+" can be forged; use the full fingerprint")
+	_, err = service.Matches("0x" + fingerprint(s.entity)[24:])
+	s.Error(err)
+
+	_, err = service.Key(User{Fingerprint: "not a fingerprint"})
+	s.Error(err)
+}
+
+func (s *KeyserverTest) TestVKSMatchesByEmailAndFingerprint() {
+	server := s.server()
+	defer server.Close()
+
+	service, _ := NewKeyserverService(http.DefaultClient, server.URL, "vks")
+
+	for _, query := range []string{"joe@example.com", fingerprint(s.entity), "0x" + strings.ToUpper(fingerprint(s.entity))} {
+		users, err := service.Matches(query)
+		s.NoError(err, query)
+		s.Len(users, 1, query)
+		s.Equal(fingerprint(s.entity), users[0].Fingerprint, query)
+	}
+}
+
+func (s *KeyserverTest) TestVKSMatchesRejectsOtherQueries() {
+	service, _ := NewKeyserverService(http.DefaultClient, "https://keys.openpgp.org", "")
+	_, err := service.Matches("gemma")
+	s.Error(err)
+}
+
+func (s *KeyserverTest) TestVKSMatchesIsEmptyWhenNotFound() {
+	server := s.server()
+	defer server.Close()
+
+	service, _ := NewKeyserverService(http.DefaultClient, server.URL, "vks")
+	users, err := service.Matches("nobody@example.com")
+	s.NoError(err)
+	s.Empty(users)
+}
+
+func (s *KeyserverTest) TestVKSKeyReturnsRequestedFingerprint() {
+	server := s.server()
+	defer server.Close()
+
+	service, _ := NewKeyserverService(http.DefaultClient, server.URL, "vks")
+	ring, err := service.Key(User{Fingerprint: fingerprint(s.entity)})
+	s.NoError(err)
+	s.Len(ring, 1)
+}
+
+func TestKeyserverTest(t *testing.T) {
+	suite.Run(t, new(KeyserverTest))
+}
@@ -16,7 +16,7 @@ import (
 	"strconv"
 	"strings"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
 )
 
 // LocalPGPService implements the KeyService interface for a local GnuPG
@@ -26,6 +26,20 @@ type LocalPGPService struct {
 	ring     openpgp.EntityList
 }
 
+func init() {
+	Register("local", func(config Config) (KeyService, error) {
+		service, err := NewLocalPGPService()
+		if err != nil {
+			return nil, err
+		}
+		if service == nil {
+			return nil, errors.New("The local public keyring is empty")
+		}
+
+		return service, nil
+	})
+}
+
 // NewLocalPGPService creates a new LocalPGPService if it finds a local
 // public keyring; otherwise it bails.
 func NewLocalPGPService() (*LocalPGPService, error) {
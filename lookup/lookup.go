@@ -18,7 +18,8 @@ import (
 	"strconv"
 	"strings"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/ssh"
 )
 
 // KeyService defines the interface for third-party identity verification and
@@ -33,17 +34,30 @@ type KeyService interface {
 	Key(user User) (openpgp.EntityList, error)
 }
 
+// SSHKeyService is implemented by KeyServices that can also find the SSH
+// public keys an author signs with. SSHKeys gets all of them for one author.
+type SSHKeyService interface {
+	SSHKeys(query string) ([]ssh.PublicKey, error)
+}
+
 // User represents an author's identity.
 type User struct {
-	Username    string
-	Fingerprint string
-	FullName    string
-	Twitter     string
-	GitHub      string
-	HackerNews  string
-	Reddit      string
-	Sites       []string
-	Emails      []string
+	Username    string   `json:"username,omitempty"`
+	Fingerprint string   `json:"fingerprint"`
+	FullName    string   `json:"full_name,omitempty"`
+	Twitter     string   `json:"twitter,omitempty"`
+	GitHub      string   `json:"github,omitempty"`
+	HackerNews  string   `json:"hacker_news,omitempty"`
+	Reddit      string   `json:"reddit,omitempty"`
+	Sites       []string `json:"sites,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+	// Proofs are the identities the user claims on other services, and
+	// whether they checked out.
+	Proofs []Proof `json:"proofs,omitempty"`
+
+	// Source is the name of the KeyService that found the User, when it came
+	// from a ChainService.
+	Source string `json:"source,omitempty"`
 }
 
 // String returns a representation of all the User's identity details.
@@ -51,6 +65,9 @@ func (u User) String() string {
 	format := "%15s: %s\n"
 	s := ""
 
+	if u.Source != "" {
+		s = s + fmt.Sprintf(format, "Source", u.Source)
+	}
 	s = s + fmt.Sprintf(format, "Identifier", u.Username)
 	s = s + fmt.Sprintf(format, "Twitter", u.Twitter)
 	s = s + fmt.Sprintf(format, "Github", u.GitHub)
@@ -66,25 +83,67 @@ func (u User) String() string {
 		s = s + fmt.Sprintf(format, "Email", email)
 	}
 
+	for _, proof := range u.Proofs {
+		s = s + fmt.Sprintf(format, "Proof", proof)
+	}
+
 	return s
 }
 
-// NewKeyService creates the KeyService implementation requested by name. If
-// fromPipe is true, it creates a LocalPGPService type.
-func NewKeyService(name string, fromPipe bool) (KeyService, error) {
-	// force the local keyring when reading the script from a pipe
+// Proof is an identity a user claims on another service, like a Twitter
+// account or a website. Live is true if the proof checked out.
+type Proof struct {
+	Service string `json:"service"`
+	Name    string `json:"name"`
+	URL     string `json:"url,omitempty"`
+	Live    bool   `json:"live"`
+}
+
+// String shows the proof, and whether it's live or only claimed.
+func (p Proof) String() string {
+	status := "live"
+	if !p.Live {
+		status = "claimed, NOT verified"
+	}
+
+	return fmt.Sprintf("%s %s (%s)", p.Service, p.Name, status)
+}
+
+// NewKeyService creates the KeyService implementations requested by names,
+// which is a comma-separated list of registered services. More than one name
+// creates a ChainService that tries each of them in order. If fromPipe is
+// true, it only uses the pipethis keyring, since there's no way to ask which
+// match to trust.
+func NewKeyService(names string, fromPipe bool, config Config) (KeyService, error) {
+	// force the pipethis keyring when reading the script from a pipe
 	if fromPipe {
-		name = "local"
+		names = "pipethis"
 	}
 
-	switch name {
-	case "keybase":
-		return &KeybaseService{}, nil
-	case "local":
-		return NewLocalPGPService()
+	chain := &ChainService{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		service, err := newService(name, config)
+		if err != nil {
+			return nil, err
+		}
+
+		chain.names = append(chain.names, name)
+		chain.services = append(chain.services, service)
 	}
 
-	return nil, errors.New("Unrecognized key service")
+	switch len(chain.services) {
+	case 0:
+		return nil, errors.New("Unrecognized key service")
+	case 1:
+		return chain.services[0], nil
+	}
+
+	return chain, nil
 }
 
 // chooseMatch prints all the matches provided, prompts for a choice, and
@@ -121,7 +180,7 @@ func chooseMatch(matches []User) (User, error) {
 
 func chooseSingleMatch(matches []User) (User, error) {
 	if len(matches) != 1 {
-		return User{}, fmt.Errorf("Found %d author matches; need exactly 1 when reading from STDIN", len(matches))
+		return User{}, fmt.Errorf("Found %d author matches; need exactly 1 when there's nobody to choose between them", len(matches))
 	}
 
 	return matches[0], nil
@@ -133,14 +192,57 @@ func chooseSingleMatch(matches []User) (User, error) {
 // error if no matches were found, if no match was chosen, or if no PGP public
 // was found.
 func Key(service KeyService, query string, single bool) (openpgp.KeyRing, error) {
-	// get possible matches from the key service
+	match, ring, err := Resolve(service, query, single)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Verifying your script against\n%v", match)
+
+	return ring, nil
+}
+
+// KeyWithFingerprint looks up an author query in the provided KeyService like
+// Key, but instead of asking, it picks the match with fingerprint. It returns
+// an error if none of the matches has it.
+func KeyWithFingerprint(service KeyService, query, fingerprint string) (openpgp.KeyRing, error) {
+	if err := checkFingerprint(fingerprint); err != nil {
+		return nil, err
+	}
+
 	matches, err := service.Matches(query)
 	if err != nil {
 		return nil, err
 	}
 
+	requested := strings.TrimPrefix(strings.ToLower(fingerprint), "0x")
+	for _, match := range matches {
+		if strings.TrimPrefix(strings.ToLower(match.Fingerprint), "0x") != requested {
+			continue
+		}
+
+		ring, err := service.Key(match)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Verifying your script against\n%v", match)
+
+		return ring, nil
+	}
+
+	return nil, fmt.Errorf("None of the author matches for %s has the fingerprint %s", query, fingerprint)
+}
+
+// Resolve does the lookup for Key, and returns the chosen User along with
+// their public key.
+func Resolve(service KeyService, query string, single bool) (User, openpgp.EntityList, error) {
+	// get possible matches from the key service
+	matches, err := service.Matches(query)
+	if err != nil {
+		return User{}, nil, err
+	}
+
 	if len(matches) < 1 {
-		return nil, errors.New("No author matches found for " + query)
+		return User{}, nil, errors.New("No author matches found for " + query)
 	}
 
 	// verify that the author is who the user was expecting by showing all the
@@ -153,15 +255,39 @@ func Key(service KeyService, query string, single bool) (openpgp.KeyRing, error)
 	}
 
 	if err != nil {
-		return nil, err
+		return User{}, nil, err
 	}
 
 	// get the public key for the selected author
 	ring, err := service.Key(match)
+	if err != nil {
+		return User{}, nil, err
+	}
+
+	return match, ring, nil
+}
+
+// SSHKeys looks up the SSH public keys for an author query in the provided
+// KeyService. It returns an error if the service can't find SSH keys, or if it
+// didn't find any for the author.
+func SSHKeys(service KeyService, query string) ([]ssh.PublicKey, error) {
+	sshService, ok := service.(SSHKeyService)
+	if !ok {
+		return nil, errors.New("The key service can't look up SSH keys")
+	}
+
+	keys, err := sshService.SSHKeys(query)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Verifying your script against\n%v", match)
 
-	return ring, nil
+	if len(keys) < 1 {
+		return nil, errors.New("No SSH keys found for " + query)
+	}
+
+	for _, key := range keys {
+		log.Println("Verifying your script against SSH key", ssh.FingerprintSHA256(key))
+	}
+
+	return keys, nil
 }
@@ -10,13 +10,30 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package lookup
 
 import (
+	"errors"
 	"os"
 	"strings"
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/stretchr/testify/suite"
 )
 
+type fakeService struct {
+	users  []User
+	err    error
+	keyFor User
+}
+
+func (f *fakeService) Matches(query string) ([]User, error) {
+	return f.users, f.err
+}
+
+func (f *fakeService) Key(user User) (openpgp.EntityList, error) {
+	f.keyFor = user
+	return nil, f.err
+}
+
 type LookupTest struct {
 	home string
 	suite.Suite
@@ -54,26 +71,157 @@ func (s *LookupTest) TestUserString() {
 	s.Equal(expected, user.String())
 }
 
+func (s *LookupTest) TestUserStringIncludesSource() {
+	user := User{Username: "me", Source: "keybase"}
+
+	s.True(strings.HasPrefix(user.String(), "         Source: keybase\n     Identifier: me\n"))
+}
+
 func (s *LookupTest) TestNewKeyServiceBailsOnUnrecognizedType() {
-	service, err := NewKeyService("foo", false)
+	service, err := NewKeyService("foo", false, Config{})
 	s.Nil(service)
 	s.EqualError(err, "Unrecognized key service")
 }
 
 func (s *LookupTest) TestNewKeyServiceAcceptsKeybaseWithoutPipe() {
-	service, err := NewKeyService("keybase", false)
+	service, err := NewKeyService("keybase", false, Config{})
 
 	s.NoError(err)
 	s.IsType(&KeybaseService{}, service)
 }
 
-func (s *LookupTest) TestNewKeyServiceForcesLocalWithPipe() {
-	_, err := NewKeyService("keybase", true)
-	s.Error(err)
+func (s *LookupTest) TestNewKeyServiceForcesKeyringWithPipe() {
+	service, err := NewKeyService("keybase", true, Config{Options: map[string]string{"keyring": "not-a-real-keyring"}})
+	s.NoError(err)
+	s.IsType(&KeyringService{}, service)
+}
+
+func (s *LookupTest) TestNewKeyServiceBailsOnUnrecognizedTypeInChain() {
+	service, err := NewKeyService("keybase,foo", false, Config{})
+	s.Nil(service)
+	s.EqualError(err, "Unrecognized key service")
+}
+
+func (s *LookupTest) TestNewKeyServiceBuildsChain() {
+	service, err := NewKeyService("keybase, keybase", false, Config{})
+	s.NoError(err)
 
-	perr, ok := err.(*os.PathError)
+	chain, ok := service.(*ChainService)
 	s.True(ok)
-	s.Equal(os.Getenv("HOME")+"/.gnupg/pubring.gpg", perr.Path)
+	s.Equal([]string{"keybase", "keybase"}, chain.names)
+}
+
+func (s *LookupTest) TestRegisterPanicsOnDuplicate() {
+	s.Panics(func() {
+		Register("keybase", func(Config) (KeyService, error) { return &KeybaseService{}, nil })
+	})
+}
+
+func (s *LookupTest) TestServicesListsBuiltins() {
+	s.Contains(Services(), "keybase")
+	s.Contains(Services(), "local")
+}
+
+func (s *LookupTest) TestConfigOption() {
+	config := Config{Options: map[string]string{"foo": "bar", "empty": ""}}
+
+	s.Equal("bar", config.Option("foo", "baz"))
+	s.Equal("baz", config.Option("empty", "baz"))
+	s.Equal("baz", config.Option("missing", "baz"))
+	s.Equal("baz", Config{}.Option("foo", "baz"))
+}
+
+func (s *LookupTest) TestChainMatchesMergesAndLabels() {
+	chain := &ChainService{
+		names: []string{"first", "second"},
+		services: []KeyService{
+			&fakeService{users: []User{{Username: "foo"}}},
+			&fakeService{users: []User{{Username: "bar"}, {Username: "baz"}}},
+		},
+	}
+
+	users, err := chain.Matches("query")
+	s.NoError(err)
+	s.Equal([]User{
+		{Username: "foo", Source: "first"},
+		{Username: "bar", Source: "second"},
+		{Username: "baz", Source: "second"},
+	}, users)
+}
+
+func (s *LookupTest) TestChainMatchesSkipsFailures() {
+	chain := &ChainService{
+		names: []string{"first", "second"},
+		services: []KeyService{
+			&fakeService{err: errors.New("nope")},
+			&fakeService{users: []User{{Username: "bar"}}},
+		},
+	}
+
+	users, err := chain.Matches("query")
+	s.NoError(err)
+	s.Equal([]User{{Username: "bar", Source: "second"}}, users)
+}
+
+func (s *LookupTest) TestChainMatchesFailsWhenEverythingFails() {
+	chain := &ChainService{
+		names: []string{"first", "second"},
+		services: []KeyService{
+			&fakeService{err: errors.New("nope")},
+			&fakeService{err: errors.New("still nope")},
+		},
+	}
+
+	users, err := chain.Matches("query")
+	s.Nil(users)
+	s.EqualError(err, "first: nope; second: still nope")
+}
+
+func (s *LookupTest) TestChainKeyUsesSource() {
+	second := &fakeService{}
+	chain := &ChainService{
+		names:    []string{"first", "second"},
+		services: []KeyService{&fakeService{err: errors.New("wrong service")}, second},
+	}
+
+	_, err := chain.Key(User{Username: "bar", Source: "second"})
+	s.NoError(err)
+	s.Equal("bar", second.keyFor.Username)
+
+	_, err = chain.Key(User{Username: "bar", Source: "third"})
+	s.Error(err)
+}
+
+func (s *LookupTest) TestCachedServiceRemembersMatches() {
+	service := &fakeService{users: []User{{Username: "foo"}}}
+	cached := NewCachedService(service)
+
+	users, err := cached.Matches("query")
+	s.NoError(err)
+	s.Equal([]User{{Username: "foo"}}, users)
+
+	service.users = []User{{Username: "bar"}}
+	users, err = cached.Matches("query")
+	s.NoError(err)
+	s.Equal([]User{{Username: "foo"}}, users)
+
+	users, err = cached.Matches("other query")
+	s.NoError(err)
+	s.Equal([]User{{Username: "bar"}}, users)
+}
+
+func (s *LookupTest) TestCachedServiceForgetsFailures() {
+	service := &fakeService{err: errors.New("nope")}
+	cached := NewCachedService(service)
+
+	_, err := cached.Matches("query")
+	s.EqualError(err, "nope")
+
+	service.err = nil
+	service.users = []User{{Username: "foo"}}
+	users, err := cached.Matches("query")
+	s.NoError(err)
+	s.Equal([]User{{Username: "foo"}}, users)
 }
 
 func (s *LookupTest) TestChooseSingleMatchBailsWithoutMatches() {
@@ -0,0 +1,221 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Config holds the settings a KeyService is created with. Options are
+// service-specific, like the address of a keyserver. Client is the HTTP client
+// for services that use the network.
+type Config struct {
+	Options map[string]string
+	Client  *http.Client
+}
+
+// HTTPClient returns the configured client, or http.DefaultClient.
+func (c Config) HTTPClient() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+
+	return http.DefaultClient
+}
+
+// Option returns the named option, or fallback if it isn't set.
+func (c Config) Option(name string, fallback string) string {
+	if value, ok := c.Options[name]; ok && value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+// Factory creates a KeyService from its configuration.
+type Factory func(config Config) (KeyService, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes a KeyService available by name to NewKeyService. It panics if
+// the name is already taken or the factory is nil, the same way
+// database/sql.Register does.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("lookup: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("lookup: Register called twice for " + name)
+	}
+
+	factories[name] = factory
+}
+
+// Services returns the sorted names of all the registered KeyServices.
+func Services() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := []string{}
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func newService(name string, config Config) (KeyService, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+
+	if !ok {
+		return nil, errors.New("Unrecognized key service")
+	}
+
+	return factory(config)
+}
+
+// ChainService tries a list of KeyServices in order. Matches from every
+// service are merged, and each one is labelled with the name of the service
+// that found it so Key knows where to go back to.
+type ChainService struct {
+	names    []string
+	services []KeyService
+}
+
+// Matches collects the matches for query from every service in the chain. It
+// only returns an error if none of the services found anything and at least
+// one of them failed.
+func (c *ChainService) Matches(query string) ([]User, error) {
+	matches := []User{}
+	failures := []string{}
+
+	for idx, service := range c.services {
+		users, err := service.Matches(query)
+		if err != nil {
+			failures = append(failures, c.names[idx]+": "+err.Error())
+			continue
+		}
+
+		for _, user := range users {
+			user.Source = c.names[idx]
+			matches = append(matches, user)
+		}
+	}
+
+	if len(matches) == 0 && len(failures) > 0 {
+		return nil, errors.New(strings.Join(failures, "; "))
+	}
+
+	return matches, nil
+}
+
+// Key gets the PGP public key for user from the service that matched it.
+func (c *ChainService) Key(user User) (openpgp.EntityList, error) {
+	for idx, name := range c.names {
+		if name == user.Source {
+			return c.services[idx].Key(user)
+		}
+	}
+
+	return nil, errors.New("No key service in the chain matched " + user.Source)
+}
+
+// SSHKeys gets the SSH keys for query from the first service in the chain
+// that has any.
+func (c *ChainService) SSHKeys(query string) ([]ssh.PublicKey, error) {
+	failures := []string{}
+
+	for idx, service := range c.services {
+		sshService, ok := service.(SSHKeyService)
+		if !ok {
+			continue
+		}
+
+		keys, err := sshService.SSHKeys(query)
+		if err != nil {
+			failures = append(failures, c.names[idx]+": "+err.Error())
+			continue
+		}
+		if len(keys) > 0 {
+			return keys, nil
+		}
+	}
+
+	if len(failures) > 0 {
+		return nil, errors.New(strings.Join(failures, "; "))
+	}
+
+	return []ssh.PublicKey{}, nil
+}
+
+// CachedService remembers the matches a KeyService found for each query, so
+// a lookup that was started early (like while the script was downloading)
+// isn't done again when it's needed.
+type CachedService struct {
+	service KeyService
+
+	mu      sync.Mutex
+	matches map[string][]User
+}
+
+// NewCachedService wraps service in a CachedService.
+func NewCachedService(service KeyService) *CachedService {
+	return &CachedService{service: service, matches: map[string][]User{}}
+}
+
+// Matches returns the matches service found for query the last time, or
+// asks it now. Failures aren't remembered.
+func (c *CachedService) Matches(query string) ([]User, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if users, ok := c.matches[query]; ok {
+		return users, nil
+	}
+
+	users, err := c.service.Matches(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.matches[query] = users
+	return users, nil
+}
+
+// Key gets the PGP public key for user from the service.
+func (c *CachedService) Key(user User) (openpgp.EntityList, error) {
+	return c.service.Key(user)
+}
+
+// SSHKeys gets the SSH keys for query from the service, if it can find them.
+func (c *CachedService) SSHKeys(query string) ([]ssh.PublicKey, error) {
+	sshService, ok := c.service.(SSHKeyService)
+	if !ok {
+		return nil, errors.New("The key service can't look up SSH keys")
+	}
+
+	return sshService.SSHKeys(query)
+}
@@ -0,0 +1,114 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// zbase32 is the z-base-32 encoding WKD uses for hashed local parts.
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+var emailPattern = regexp.MustCompile(`^[^@\s/]+@[a-zA-Z0-9\-]+(\.[a-zA-Z0-9\-]+)+$`)
+
+// WKDService implements the KeyService interface for the OpenPGP Web Key
+// Directory, where people publish their keys on the domain of their email
+// address.
+type WKDService struct {
+	client *http.Client
+}
+
+func init() {
+	Register("wkd", func(config Config) (KeyService, error) {
+		return &WKDService{client: config.HTTPClient()}, nil
+	})
+}
+
+// wkdLocations builds the advanced and direct WKD locations for email, in the
+// order they should be tried.
+func wkdLocations(email string) ([]string, error) {
+	if !emailPattern.MatchString(email) {
+		return nil, errors.New("WKD needs an email address, not " + email)
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], strings.ToLower(email[at+1:])
+
+	hash := sha1.Sum([]byte(strings.ToLower(local)))
+	path := "/hu/" + zbase32.EncodeToString(hash[:]) + "?l=" + url.QueryEscape(local)
+
+	return []string{
+		"https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + path,
+		"https://" + domain + "/.well-known/openpgpkey" + path,
+	}, nil
+}
+
+// fetch gets the keys published for email, trying the advanced method first
+// and falling back to the direct method.
+func (w WKDService) fetch(email string) (openpgp.EntityList, error) {
+	locations, err := wkdLocations(email)
+	if err != nil {
+		return nil, err
+	}
+
+	failures := []string{}
+	for _, location := range locations {
+		ring, err := fetchKeys(w.client, location)
+		if err == nil {
+			return ring, nil
+		}
+
+		failures = append(failures, err.Error())
+	}
+
+	return nil, errors.New(strings.Join(failures, "; "))
+}
+
+// Matches finds the keys published in the Web Key Directory for query, which
+// must be an email address. Only keys with an identity for that exact address
+// are matches.
+func (w WKDService) Matches(query string) ([]User, error) {
+	ring, err := w.fetch(query)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []User{}
+	for _, entity := range ring {
+		user := userFromEntity(entity)
+		if !hasEmail(user, query) {
+			continue
+		}
+
+		user.Username = query
+		matches = append(matches, user)
+	}
+
+	return matches, nil
+}
+
+// Key fetches the published keys for the user's address again, and returns
+// the one with the user's fingerprint.
+func (w WKDService) Key(user User) (openpgp.EntityList, error) {
+	ring, err := w.fetch(user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyWithFingerprint(ring, user)
+}
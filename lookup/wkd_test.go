@@ -0,0 +1,161 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package lookup
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/suite"
+)
+
+type WKDTest struct {
+	suite.Suite
+	entity *openpgp.Entity
+	other  *openpgp.Entity
+}
+
+func (s *WKDTest) SetupSuite() {
+	var err error
+	s.entity, err = openpgp.NewEntity("Joe Doe", "", "Joe.Doe@example.com", nil)
+	s.Require().NoError(err)
+	s.other, err = openpgp.NewEntity("Someone Else", "", "else@example.com", nil)
+	s.Require().NoError(err)
+}
+
+// server stands in for every domain, and serves the keys in handlers by
+// host and path.
+func (s *WKDTest) server(handlers map[string][]*openpgp.Entity) (*httptest.Server, *http.Client) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entities, ok := handlers[r.Host+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		for _, entity := range entities {
+			entity.Serialize(w)
+		}
+	}))
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	return server, client
+}
+
+func (s *WKDTest) TestLocationsUseZBase32Hash() {
+	locations, err := wkdLocations("Joe.Doe@Example.ORG")
+	s.NoError(err)
+	s.Equal([]string{
+		"https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+		"https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+	}, locations)
+}
+
+func (s *WKDTest) TestLocationsRequireEmail() {
+	for _, query := range []string{"gemma", "gemma@", "@example.com", "gemma@localhost", "a/b@example.com"} {
+		_, err := wkdLocations(query)
+		s.Error(err, query)
+	}
+}
+
+func (s *WKDTest) TestMatchesUsesAdvancedMethod() {
+	server, client := s.server(map[string][]*openpgp.Entity{
+		"openpgpkey.example.com/.well-known/openpgpkey/example.com/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q": {s.entity},
+	})
+	defer server.Close()
+
+	wkd := WKDService{client: client}
+	users, err := wkd.Matches("joe.doe@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal("joe.doe@example.com", users[0].Username)
+	s.Equal(fingerprint(s.entity), users[0].Fingerprint)
+	s.Equal("Joe Doe", users[0].FullName)
+	s.Equal([]string{"Joe.Doe@example.com"}, users[0].Emails)
+}
+
+func (s *WKDTest) TestMatchesFallsBackToDirectMethod() {
+	server, client := s.server(map[string][]*openpgp.Entity{
+		"example.com/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q": {s.entity},
+	})
+	defer server.Close()
+
+	wkd := WKDService{client: client}
+	users, err := wkd.Matches("joe.doe@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+}
+
+func (s *WKDTest) TestMatchesSkipsKeysForOtherEmails() {
+	server, client := s.server(map[string][]*openpgp.Entity{
+		"example.com/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q": {s.other, s.entity},
+	})
+	defer server.Close()
+
+	wkd := WKDService{client: client}
+	users, err := wkd.Matches("joe.doe@example.com")
+	s.NoError(err)
+	s.Len(users, 1)
+	s.Equal(fingerprint(s.entity), users[0].Fingerprint)
+}
+
+func (s *WKDTest) TestMatchesFailsWithoutKeys() {
+	server, client := s.server(map[string][]*openpgp.Entity{})
+	defer server.Close()
+
+	wkd := WKDService{client: client}
+	_, err := wkd.Matches("joe.doe@example.com")
+	s.Error(err)
+}
+
+func (s *WKDTest) TestKeyReturnsMatchedFingerprint() {
+	server, client := s.server(map[string][]*openpgp.Entity{
+		"example.com/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q": {s.other, s.entity},
+	})
+	defer server.Close()
+
+	wkd := WKDService{client: client}
+	ring, err := wkd.Key(User{Username: "joe.doe@example.com", Fingerprint: fingerprint(s.entity)})
+	s.NoError(err)
+	s.Len(ring, 1)
+	s.Equal(s.entity.PrimaryKey.Fingerprint, ring[0].PrimaryKey.Fingerprint)
+
+	_, err = wkd.Key(User{Username: "joe.doe@example.com", Fingerprint: "abcdef"})
+	s.Error(err)
+}
+
+func (s *WKDTest) TestReadKeysAcceptsArmor() {
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	s.NoError(err)
+	s.NoError(s.entity.Serialize(w))
+	w.Close()
+
+	ring, err := ReadKeys(buf.Bytes())
+	s.NoError(err)
+	s.Len(ring, 1)
+}
+
+func TestWKDTest(t *testing.T) {
+	suite.Run(t, new(WKDTest))
+}
@@ -15,6 +15,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"io"
@@ -22,9 +23,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
 
-	"github.com/ellotheth/pipethis/lookup"
+	"github.com/ellotheth/pipethis/fetch"
 )
 
 var (
@@ -39,6 +41,16 @@ type ReadSeekCloser interface {
 	io.Closer
 }
 
+// commands are the subcommands that can replace the script location as the
+// first argument. Each one gets the rest of the command line.
+var commands = map[string]func(args []string) error{
+	"lint":         lint,
+	"keys":         keys,
+	"lock":         lockCommand,
+	"serve":        serve,
+	"run-manifest": runManifest,
+}
+
 func main() {
 	// do log.Panic() instead of log.Fatal(), and all the deferred cleanup will
 	// still happen.
@@ -49,14 +61,29 @@ func main() {
 		}
 	}()
 
+	// `pipethis run <script>` is the same as `pipethis <script>`
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	} else if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	var (
-		target      = flag.String("target", os.Getenv("SHELL"), "Executable to run the script")
-		inspect     = flag.Bool("inspect", false, "Open an editor to inspect the file before running it")
-		editor      = flag.String("editor", os.Getenv("EDITOR"), "Editor to inspect the script")
-		noVerify    = flag.Bool("no-verify", false, "Don't verify the author or signature")
-		sigSource   = flag.String("signature", "", `Detached signature to verify. (default "<script location>.sig")`)
-		serviceName = flag.String("lookup-with", "keybase", "Key lookup service to use. Could be 'keybase' or 'local'.")
-		version     = flag.Bool("version", false, "Print the pipethis version information and exit")
+		target    = flag.String("target", os.Getenv("SHELL"), "Executable to run the script")
+		inspect   = flag.Bool("inspect", false, "Open an editor to inspect the file before running it")
+		editor    = flag.String("editor", os.Getenv("EDITOR"), "Editor to inspect the script")
+		noVerify  = flag.Bool("no-verify", false, "Don't verify the author or signature")
+		sigSource = flag.String("signature", "", `Detached signature to verify. (default "<script location>.sig")`)
+		locked    = flag.Bool("locked", false, "Refuse to run the script unless it, its signature and its signer match the lock file")
+		lockfile  = flag.String("lockfile", defaultLockfile, "Lock file for -locked, written by pipethis lock")
+		version   = flag.Bool("version", false, "Print the pipethis version information and exit")
+		newVerify = verifyFlags(flag.CommandLine)
+		newClient = clientFlags(flag.CommandLine)
 	)
 	flag.Parse()
 
@@ -65,13 +92,50 @@ func main() {
 		return
 	}
 
-	// download the script, store it someplace temporary
-	script, err := NewScript(flag.Arg(0))
+	if _, err := newClient(); err != nil {
+		log.Panic(err)
+	}
+
+	options, err := newVerify()
 	if err != nil {
 		log.Panic(err)
 	}
-	defer os.Remove(script.Name())
+
+	// a locked script has to be verified, and be in the lock file before
+	// there's any point downloading it
+	var lock *Lock
+	if *locked {
+		if *noVerify {
+			log.Panic("-locked can't skip verification; drop -no-verify")
+		}
+
+		if lock, err = LoadLock(*lockfile); err != nil {
+			log.Panic(err)
+		}
+		if lock.Find(flag.Arg(0)) == nil {
+			log.Panic(flag.Arg(0) + " isn't in " + *lockfile + " (use pipethis lock to add it)")
+		}
+	}
+
+	// start downloading the script, store it someplace temporary
+	install, err := newInstall(context.Background(), options, flag.Arg(0), *sigSource)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer install.Remove()
+	script := install.script
+
+	// the author's key can be looked up while the script is downloading,
+	// unless it's going to be inspected (and maybe changed) first
+	if err := install.fetch(!*noVerify, !*inspect); err != nil {
+		log.Panic(err)
+	}
+
 	log.Println("Script saved to", script.Name())
+	if script.Resolved() != script.Source() {
+		log.Println("Script downloaded from", script.Resolved())
+	}
+	log.Println("Script SHA-256:", script.Digests()["sha256"])
 
 	// if we're not reading from a pipe we need a target executable
 	if !script.IsPiped() {
@@ -89,29 +153,21 @@ func main() {
 
 	// by default, verify the author and signature
 	if !*noVerify {
-		author, err := script.Author()
+		signer, err := install.verify()
 		if err != nil {
 			log.Panic(err)
 		}
 
-		service, err := lookup.NewKeyService(*serviceName, script.IsPiped())
-		if err != nil {
-			log.Panic(err)
-		}
-
-		key, err := lookup.Key(service, author, script.IsPiped())
-		if err != nil {
-			log.Panic(err)
-		}
-
-		signature := NewSignature(key, script, *sigSource)
-		defer os.Remove(signature.Name())
-
-		if err := signature.Verify(); err != nil {
-			log.Panic(err)
+		if lock != nil {
+			actual, err := lockedScript(flag.Arg(0), install, signer)
+			if err != nil {
+				log.Panic(err)
+			}
+			if err := lock.Check(flag.Arg(0), actual); err != nil {
+				log.Panic(err)
+			}
+			log.Println("Script matches", *lockfile)
 		}
-
-		log.Println("Signature verified!")
 	}
 
 	// run the script
@@ -141,18 +197,24 @@ func parseToken(pattern string, reader io.Reader) string {
 	return ""
 }
 
-// getFile tries to find location locally first, then tries remote
-func getFile(location string) (io.ReadCloser, error) {
+// getFile tries to find location locally first, then fetches it with the
+// fetcher for its URL scheme. Remote downloads stop when ctx is cancelled, and
+// only show progress if progress is set.
+func getFile(ctx context.Context, location string, progress bool) (*fetch.Resource, error) {
 	if location == "" {
-		return getFromStdin()
+		body, err := getFromStdin()
+		if err != nil {
+			return nil, err
+		}
+		return &fetch.Resource{Body: body, Header: http.Header{}, Size: -1}, nil
 	}
 
 	body, err := getLocal(location)
 	if err == nil {
-		return body, nil
+		return &fetch.Resource{Body: body, Location: location, Header: http.Header{}, Size: -1}, nil
 	}
 
-	return getRemote(location)
+	return getRemote(ctx, location, progress)
 }
 
 func getFromStdin() (io.ReadCloser, error) {
@@ -169,18 +231,35 @@ func getFromStdin() (io.ReadCloser, error) {
 	return os.Stdin, nil
 }
 
-func getRemote(location string) (io.ReadCloser, error) {
-	parsed, err := url.Parse(location)
-	if err != nil || parsed.Scheme == "" {
-		return nil, errors.New("Invalid URL")
+func getRemote(ctx context.Context, location string, progress bool) (*fetch.Resource, error) {
+	resource, err := httpClient.Open(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	if !progress {
+		return resource, nil
+	}
+
+	if bar := newProgress(progressLabel(resource.Location), resource.Size); bar != nil {
+		resource.Body = bar.Reader(resource.Body)
 	}
 
-	resp, err := http.Get(location)
+	return resource, nil
+}
+
+// progressLabel is the file name at the end of location, or its scheme if it
+// doesn't have one.
+func progressLabel(location string) string {
+	parsed, err := url.Parse(location)
 	if err != nil {
-		return nil, err
+		return location
+	}
+
+	if name := path.Base(parsed.Path); name != "." && name != "/" {
+		return name
 	}
 
-	return resp.Body, nil
+	return parsed.Scheme
 }
 
 func getLocal(location string) (io.ReadCloser, error) {
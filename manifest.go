@@ -0,0 +1,323 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Manifest is a list of installers for `pipethis run-manifest`.
+type Manifest struct {
+	Installers []Installer `yaml:"installers"`
+}
+
+// Installer is one script in a manifest, with who has to have signed it and
+// how to run it.
+type Installer struct {
+	// Name labels the installer in the summary. It's the URL if it's empty.
+	Name      string `yaml:"name"`
+	URL       string `yaml:"url"`
+	Signature string `yaml:"signature"`
+
+	// Author is the PIPETHIS_AUTHOR the script has to name, and Fingerprint
+	// is the key that has to have signed it (a full PGP fingerprint, an SSH
+	// SHA256: fingerprint, a minisign key ID, or a Sigstore identity). Every
+	// installer in a manifest needs a Fingerprint, and it's what picks the
+	// author's PGP key.
+	Author      string `yaml:"author"`
+	Fingerprint string `yaml:"fingerprint"`
+
+	// Target runs the script, with Args. It's -target if it's empty.
+	Target string   `yaml:"target"`
+	Args   []string `yaml:"args"`
+}
+
+// LoadManifest reads the manifest in filename. Relative local paths in it are
+// relative to the manifest.
+func LoadManifest(filename string) (*Manifest, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := yaml.UnmarshalStrict(contents, manifest); err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Installers) == 0 {
+		return nil, errors.New("The manifest doesn't list any installers")
+	}
+
+	dir := filepath.Dir(filename)
+	for i := range manifest.Installers {
+		installer := &manifest.Installers[i]
+		if installer.URL == "" {
+			return nil, fmt.Errorf("Installer %d in the manifest doesn't have a url", i+1)
+		}
+		if installer.Fingerprint == "" {
+			return nil, fmt.Errorf("Installer %d in the manifest doesn't have a fingerprint", i+1)
+		}
+		if installer.Name == "" {
+			installer.Name = installer.URL
+		}
+
+		installer.URL = resolveLocation(dir, installer.URL)
+		installer.Signature = resolveLocation(dir, installer.Signature)
+	}
+
+	return manifest, nil
+}
+
+// resolveLocation makes location relative to dir, if it's a relative path
+// and not a URL.
+func resolveLocation(dir, location string) string {
+	if parsed, err := url.Parse(location); location == "" || (err == nil && parsed.Scheme != "") {
+		return location
+	}
+
+	return resolvePaths(dir, []string{location})[0]
+}
+
+// check makes sure the verified script is from the author and key the
+// installer expects.
+func (i Installer) check(script *Script, signer Signer) error {
+	if i.Author != "" {
+		if author, _ := script.Author(); author != i.Author {
+			return fmt.Errorf("The script's author is %q, not %q", author, i.Author)
+		}
+	}
+
+	if i.Fingerprint != "" && !sameKey(i.Fingerprint, signer.Key) {
+		return fmt.Errorf("The script was signed by %s, not %s", signer, i.Fingerprint)
+	}
+
+	return nil
+}
+
+// runManifest is `pipethis run-manifest <manifest>`. Every installer is
+// downloaded and verified at the same time, and none of them are run unless
+// all of them verify. Then they're run one at a time, in order, until one
+// fails.
+func runManifest(args []string) error {
+	flags := flag.NewFlagSet("run-manifest", flag.ExitOnError)
+	var (
+		target    = flags.String("target", os.Getenv("SHELL"), "Executable to run the scripts that don't set a target")
+		jobs      = flags.Int("jobs", 4, "How many installers to download and verify at a time")
+		locked    = flags.Bool("locked", false, "Refuse to run anything unless every installer matches the lock file")
+		lockfile  = flags.String("lockfile", defaultLockfile, "Lock file for -locked, written by pipethis lock")
+		newVerify = verifyFlags(flags)
+		newClient = clientFlags(flags)
+	)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pipethis run-manifest [ OPTIONS ] <manifest.yaml>")
+		flags.PrintDefaults()
+	}
+
+	// let the options go before or after the manifest
+	flags.Parse(args)
+	filename := flags.Arg(0)
+	if flags.NArg() > 0 {
+		flags.Parse(flags.Args()[1:])
+	}
+	if filename == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("run-manifest needs exactly one manifest")
+	}
+	if *jobs < 1 {
+		return errors.New("-jobs has to be at least 1")
+	}
+
+	manifest, err := LoadManifest(filename)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	var lock *Lock
+	if *locked {
+		if lock, err = LoadLock(*lockfile); err != nil {
+			return err
+		}
+	}
+
+	for n := range manifest.Installers {
+		installer := &manifest.Installers[n]
+		if lock != nil && lock.Find(installer.URL) == nil {
+			return fmt.Errorf("%s: %s isn't in %s (use pipethis lock to add it)", installer.Name, installer.URL, *lockfile)
+		}
+		if installer.Target == "" {
+			installer.Target = *target
+		}
+		if _, err := os.Stat(installer.Target); os.IsNotExist(err) {
+			return fmt.Errorf("%s: script executable %s does not exist", installer.Name, installer.Target)
+		}
+	}
+
+	if _, err := newClient(); err != nil {
+		return err
+	}
+
+	options, err := newVerify()
+	if err != nil {
+		return err
+	}
+	// nobody's around to pick between authors, and the downloads would
+	// scribble over each other's progress bars
+	options.single = true
+	showProgress = false
+
+	results, err := verifyInstallers(context.Background(), manifest.Installers, options, *jobs)
+	for _, result := range results {
+		if result.install != nil {
+			defer result.install.Remove()
+		}
+	}
+	if err == nil && lock != nil {
+		err = checkLock(lock, manifest.Installers, results)
+	}
+	if err != nil {
+		printSummary(results)
+		return errors.New("Nothing was run: " + err.Error())
+	}
+
+	failed := false
+	for n, result := range results {
+		if failed {
+			result.status = "not run"
+			continue
+		}
+
+		installer := manifest.Installers[n]
+		result.err = result.install.script.Run(installer.Target, append([]string{installer.URL}, installer.Args...)...)
+		if result.err != nil {
+			result.status = "failed"
+			failed = true
+			continue
+		}
+		result.status = "ran"
+	}
+
+	printSummary(results)
+	for _, result := range results {
+		if result.err != nil {
+			return fmt.Errorf("%s: %s", result.name, result.err)
+		}
+	}
+
+	return nil
+}
+
+// checkLock makes sure every verified installer matches the lock.
+func checkLock(lock *Lock, installers []Installer, results []*installResult) error {
+	for n, result := range results {
+		actual, err := lockedScript(installers[n].URL, result.install, result.signer)
+		if err == nil {
+			err = lock.Check(installers[n].URL, actual)
+		}
+		if err != nil {
+			result.status, result.err = "failed", err
+			return fmt.Errorf("%s: %s", result.name, err)
+		}
+	}
+
+	return nil
+}
+
+// installResult is what happened to one installer in a manifest.
+type installResult struct {
+	name    string
+	install *install
+	signer  Signer
+	status  string
+	err     error
+}
+
+// verifyInstallers downloads and verifies every installer, jobs at a time.
+// The first one to fail stops the rest. The results are in the same order as
+// installers, whether it worked or not.
+func verifyInstallers(ctx context.Context, installers []Installer, options *verifyOptions, jobs int) ([]*installResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := []*installResult{}
+	running := newTasks(cancel)
+	slots := make(chan struct{}, jobs)
+	for _, installer := range installers {
+		result := &installResult{name: installer.Name, status: "not verified"}
+		results = append(results, result)
+
+		installer := installer
+		running.Go(func() error {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if ctx.Err() != nil {
+				result.status = "cancelled"
+				return nil
+			}
+
+			result.err = result.verify(ctx, installer, options)
+			if result.err != nil {
+				result.status = "failed"
+				return fmt.Errorf("%s: %s", installer.Name, result.err)
+			}
+
+			result.status = "verified"
+			return nil
+		})
+	}
+
+	return results, running.Wait()
+}
+
+func (r *installResult) verify(ctx context.Context, installer Installer, options *verifyOptions) error {
+	install, err := newInstall(ctx, options, installer.URL, installer.Signature)
+	if err != nil {
+		return err
+	}
+	r.install = install
+	install.fingerprint = installer.Fingerprint
+
+	if err := install.fetch(true, true); err != nil {
+		return err
+	}
+	log.Println("Script", installer.Name, "SHA-256:", install.script.Digests()["sha256"])
+
+	if r.signer, err = install.verify(); err != nil {
+		return err
+	}
+
+	return installer.check(install.script, r.signer)
+}
+
+// printSummary logs what happened to every installer.
+func printSummary(results []*installResult) {
+	log.Println("Summary:")
+	for _, result := range results {
+		switch {
+		case result.err != nil:
+			log.Printf("  %s: %s: %s", result.name, result.status, result.err)
+		case result.signer.Key != "":
+			log.Printf("  %s: %s (signed by %s)", result.name, result.status, result.signer)
+		default:
+			log.Printf("  %s: %s", result.name, result.status)
+		}
+	}
+}
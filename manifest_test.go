@@ -0,0 +1,235 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ellotheth/pipethis/fetch"
+	"github.com/stretchr/testify/suite"
+)
+
+type ManifestTest struct {
+	suite.Suite
+	dir     string
+	keyring string
+	script  string
+}
+
+func (s *ManifestTest) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+
+	s.keyring = filepath.Join(s.dir, "keyring")
+	s.Require().NoError(keys([]string{"add", "-keyring", s.keyring, "-author", "gemma-ed25519@example.com", "fixtures/ed25519.asc"}))
+
+	s.script, err = filepath.Abs("fixtures/signed.ed25519")
+	s.Require().NoError(err)
+}
+
+func (s *ManifestTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+	showProgress = true
+}
+
+func (s *ManifestTest) manifest(contents string) string {
+	filename := filepath.Join(s.dir, "installers.yaml")
+	s.Require().NoError(ioutil.WriteFile(filename, []byte(contents), 0644))
+	return filename
+}
+
+func (s *ManifestTest) options() *verifyOptions {
+	return &verifyOptions{serviceName: "pipethis", keyring: s.keyring, policy: &Policy{}, single: true}
+}
+
+func (s *ManifestTest) TestLoadManifest() {
+	manifest, err := LoadManifest(s.manifest(`
+installers:
+  - url: https://get.example.com/install.sh
+    author: gemma
+    fingerprint: 22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260
+    args: [--prefix, /opt]
+  - name: local
+    url: scripts/setup.sh
+    signature: scripts/setup.sh.asc
+    fingerprint: 22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260
+    target: /bin/bash
+`))
+	s.Require().NoError(err)
+	s.Require().Len(manifest.Installers, 2)
+
+	s.Equal(Installer{
+		Name:        "https://get.example.com/install.sh",
+		URL:         "https://get.example.com/install.sh",
+		Author:      "gemma",
+		Fingerprint: "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260",
+		Args:        []string{"--prefix", "/opt"},
+	}, manifest.Installers[0])
+
+	s.Equal("local", manifest.Installers[1].Name)
+	s.Equal(filepath.Join(s.dir, "scripts/setup.sh"), manifest.Installers[1].URL)
+	s.Equal(filepath.Join(s.dir, "scripts/setup.sh.asc"), manifest.Installers[1].Signature)
+	s.Equal("/bin/bash", manifest.Installers[1].Target)
+}
+
+func (s *ManifestTest) TestLoadManifestRejectsMistakes() {
+	for _, contents := range []string{
+		"installers: []",
+		"installers:\n  - author: gemma",
+		"installers:\n  - url: https://get.example.com/install.sh\n    author: gemma",
+		"installers:\n  - url: https://get.example.com/install.sh\n    fingerprnt: C5DF7ACA675E5260",
+		"not: [valid",
+	} {
+		_, err := LoadManifest(s.manifest(contents))
+		s.Error(err, contents)
+	}
+}
+
+func (s *ManifestTest) TestVerifyInstallers() {
+	installers := []Installer{
+		{Name: "by author", URL: s.script, Author: "gemma-ed25519@example.com"},
+		{Name: "by key", URL: s.script, Fingerprint: "0x22b5f4df9cbf8ff3659a6e49c5df7aca675e5260"},
+	}
+
+	results, err := verifyInstallers(context.Background(), installers, s.options(), 1)
+	for _, result := range results {
+		defer result.install.Remove()
+	}
+	s.Require().NoError(err)
+
+	for _, result := range results {
+		s.Equal("verified", result.status)
+		s.Equal("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260", result.signer.Key)
+		s.FileExists(result.install.script.Name())
+	}
+}
+
+func (s *ManifestTest) TestVerifyInstallersUseTheLookupService() {
+	keyserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("op") == "index" {
+			fmt.Fprintln(w, "info:1:1")
+			fmt.Fprintln(w, "pub:22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260:22:256:1234567890::")
+			fmt.Fprintln(w, "uid:Gemma%20Ed%20%3Cgemma-ed25519@example.com%3E:1234567890::")
+			return
+		}
+		http.ServeFile(w, r, "fixtures/ed25519.asc")
+	}))
+	defer keyserver.Close()
+
+	defer func(client *fetch.Client) { httpClient = client }(httpClient)
+	var err error
+	httpClient, err = fetch.NewClient(fetch.Options{AllowInsecure: true})
+	s.Require().NoError(err)
+
+	// the key's only on the keyserver, not in the (empty) keyring
+	options := &verifyOptions{serviceName: "keyserver", keyserver: keyserver.URL, keyring: filepath.Join(s.dir, "empty"), policy: &Policy{}, single: true}
+	installers := []Installer{{Name: "by author", URL: s.script, Author: "gemma-ed25519@example.com"}}
+
+	// without a fingerprint, whatever the keyserver says can't be trusted
+	results, err := verifyInstallers(context.Background(), installers, options, 1)
+	for _, result := range results {
+		defer result.install.Remove()
+	}
+	s.Error(err)
+
+	installers[0].Fingerprint = "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"
+	results, err = verifyInstallers(context.Background(), installers, options, 1)
+	for _, result := range results {
+		defer result.install.Remove()
+	}
+	s.Require().NoError(err)
+	s.Equal("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260", results[0].signer.Key)
+}
+
+func (s *ManifestTest) TestFingerprintsPickTheAuthorsKey() {
+	s.Require().NoError(keys([]string{"add", "-keyring", s.keyring, "-author", "gemma-ed25519@example.com", "fixtures/rsa4096.asc"}))
+
+	installers := []Installer{{Name: "by author", URL: s.script, Author: "gemma-ed25519@example.com"}}
+	results, err := verifyInstallers(context.Background(), installers, s.options(), 1)
+	defer results[0].install.Remove()
+	s.Error(err)
+
+	installers[0].Fingerprint = "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"
+	results, err = verifyInstallers(context.Background(), installers, s.options(), 1)
+	defer results[0].install.Remove()
+	s.Require().NoError(err)
+	s.Equal("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260", results[0].signer.Key)
+
+	// a fingerprint the author doesn't have isn't checked afterwards; it's
+	// never looked up
+	installers[0].Fingerprint = strings.Repeat("0", 40)
+	results, err = verifyInstallers(context.Background(), installers, s.options(), 1)
+	defer results[0].install.Remove()
+	s.Error(err)
+	s.Contains(err.Error(), "None of the author matches")
+}
+
+func (s *ManifestTest) TestVerifyInstallersNeedsEveryOne() {
+	installers := []Installer{
+		{Name: "good", URL: s.script},
+		{Name: "wrong key", URL: s.script, Fingerprint: "0123456789ABCDEF"},
+		{Name: "wrong author", URL: s.script, Author: "someone-else"},
+	}
+
+	results, err := verifyInstallers(context.Background(), installers, s.options(), 3)
+	for _, result := range results {
+		if result.install != nil {
+			defer result.install.Remove()
+		}
+	}
+	s.Error(err)
+	s.Len(results, 3)
+
+	s.Contains([]string{"verified", "cancelled", "failed"}, results[0].status)
+	s.NotEqual("verified", results[1].status)
+	s.NotEqual("verified", results[2].status)
+}
+
+func (s *ManifestTest) TestCheckNeedsWholeFingerprints() {
+	signer := Signer{Key: "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"}
+	s.NoError(Installer{Fingerprint: "22b5f4df9cbf8ff3659a6e49c5df7aca675e5260"}.check(nil, signer))
+	s.Error(Installer{Fingerprint: "C5DF7ACA675E5260"}.check(nil, signer))
+	s.Error(Installer{Fingerprint: "0xC5DF7ACA675E5260"}.check(nil, signer))
+}
+
+func (s *ManifestTest) TestRunManifestRunsInOrderUntilOneFails() {
+	filename := s.manifest(`
+installers:
+  - name: first
+    url: ` + s.script + `
+    fingerprint: 22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260
+  - name: second
+    url: ` + s.script + `
+    fingerprint: 22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260
+    target: /bin/false
+  - name: third
+    url: ` + s.script + `
+    fingerprint: 22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260
+`)
+
+	err := runManifest([]string{"-lookup-with", "pipethis", "-keyring", s.keyring, "-target", "/bin/sh", filename})
+	s.EqualError(err, "second: exit status 1")
+
+	err = runManifest([]string{filename, "-lookup-with", "pipethis", "-keyring", s.keyring, "-target", "/no/such/shell"})
+	s.EqualError(err, "first: script executable /no/such/shell does not exist")
+}
+
+func TestManifestTest(t *testing.T) {
+	suite.Run(t, new(ManifestTest))
+}
@@ -0,0 +1,261 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisign and signify keys and signatures start with a two byte algorithm
+// and an eight byte key ID. "Ed" signs the message itself; "ED" (minisign
+// only) signs its BLAKE2b-512 hash.
+const (
+	minisignLegacy    = "Ed"
+	minisignPrehashed = "ED"
+)
+
+// minisignKey is an Ed25519 public key from minisign or signify.
+type minisignKey struct {
+	id  []byte
+	key ed25519.PublicKey
+}
+
+// ID is the key ID the way minisign prints it.
+func (k minisignKey) ID() string {
+	id := make([]byte, len(k.id))
+	for i := range k.id {
+		id[i] = k.id[len(k.id)-1-i]
+	}
+
+	return strings.ToUpper(hex.EncodeToString(id))
+}
+
+// minisignSignature is a minisign or signify signature. Only minisign has the
+// trusted comment, and the global signature over it.
+type minisignSignature struct {
+	algorithm       string
+	id              []byte
+	signature       []byte
+	trustedComment  string
+	globalSignature []byte
+}
+
+// decodeMinisignLines reads the base64 lines out of a minisign or signify
+// file, skipping the comments.
+func decodeMinisignLines(contents []byte) ([][]byte, string, error) {
+	lines := [][]byte{}
+	trusted := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "untrusted comment:"):
+			continue
+		case strings.HasPrefix(line, "trusted comment:"):
+			trusted = strings.TrimPrefix(line, "trusted comment: ")
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, "", err
+		}
+		lines = append(lines, decoded)
+	}
+
+	return lines, trusted, scanner.Err()
+}
+
+// parseMinisignKey reads a minisign or signify public key, either the whole
+// .pub file or just the base64 line.
+func parseMinisignKey(contents []byte) (*minisignKey, error) {
+	lines, _, err := decodeMinisignLines(contents)
+	if err != nil || len(lines) != 1 {
+		return nil, errors.New("Invalid minisign public key")
+	}
+
+	raw := lines[0]
+	if len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != minisignLegacy {
+		return nil, errors.New("Invalid minisign public key")
+	}
+
+	return &minisignKey{id: raw[2:10], key: ed25519.PublicKey(raw[10:])}, nil
+}
+
+// readMinisignKey loads a public key from location, which is a key file, or
+// the key itself.
+func readMinisignKey(location string) (*minisignKey, error) {
+	if _, err := os.Stat(location); err == nil {
+		contents, err := ioutil.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+
+		return parseMinisignKey(contents)
+	}
+
+	return parseMinisignKey([]byte(location))
+}
+
+// parseMinisignSignature reads a minisign or signify signature file.
+func parseMinisignSignature(contents []byte) (*minisignSignature, error) {
+	lines, trusted, err := decodeMinisignLines(contents)
+	if err != nil || len(lines) == 0 {
+		return nil, errors.New("Invalid minisign signature")
+	}
+
+	raw := lines[0]
+	if len(raw) != 2+8+ed25519.SignatureSize {
+		return nil, errors.New("Invalid minisign signature")
+	}
+
+	sig := &minisignSignature{
+		algorithm: string(raw[:2]),
+		id:        raw[2:10],
+		signature: raw[10:],
+	}
+	if sig.algorithm != minisignLegacy && sig.algorithm != minisignPrehashed {
+		return nil, errors.New("Unsupported minisign signature algorithm " + sig.algorithm)
+	}
+
+	// minisign's second line is the global signature; signify doesn't have
+	// one
+	if len(lines) > 1 {
+		if len(lines[1]) != ed25519.SignatureSize {
+			return nil, errors.New("Invalid minisign global signature")
+		}
+		sig.trustedComment = trusted
+		sig.globalSignature = lines[1]
+	}
+
+	return sig, nil
+}
+
+// verify checks the signature over message with whichever of keys has the
+// signature's key ID, then checks the trusted comment if there is one. It
+// returns the key that made the signature.
+func (m minisignSignature) verify(message io.Reader, keys []*minisignKey) (*minisignKey, error) {
+	var key *minisignKey
+	for _, candidate := range keys {
+		if bytes.Equal(candidate.id, m.id) {
+			key = candidate
+			break
+		}
+	}
+	if key == nil {
+		signer := minisignKey{id: m.id}
+		return nil, fmt.Errorf("The minisign signature was made by key %s, which isn't trusted", signer.ID())
+	}
+
+	var signed []byte
+	if m.algorithm == minisignPrehashed {
+		h, err := blake2b.New512(nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(h, message); err != nil {
+			return nil, err
+		}
+		signed = h.Sum(nil)
+	} else {
+		contents, err := ioutil.ReadAll(message)
+		if err != nil {
+			return nil, err
+		}
+		signed = contents
+	}
+
+	if !ed25519.Verify(key.key, signed, m.signature) {
+		return nil, errors.New("Failed to verify minisign signature")
+	}
+
+	if m.globalSignature != nil {
+		global := append(append([]byte{}, m.signature...), m.trustedComment...)
+		if !ed25519.Verify(key.key, global, m.globalSignature) {
+			return nil, errors.New("Failed to verify the minisign trusted comment")
+		}
+	}
+
+	return key, nil
+}
+
+// minisignKeys collects the trusted minisign and signify keys. The -minisign-key
+// flag wins, then the keys in the policy. The script's PIPETHIS_MINISIGN_KEY
+// token is last, and since whoever serves the script could have written it,
+// it's only a key (never a file), and it's only used once someone confirms
+// it. With single set, there's nobody to ask.
+func minisignKeys(flagKey string, policy *Policy, script *Script, single bool) ([]*minisignKey, error) {
+	locations := []string{}
+	switch {
+	case flagKey != "":
+		locations = append(locations, flagKey)
+	case len(policy.Minisign.Keys) > 0:
+		locations = append(locations, policy.Minisign.Keys...)
+	}
+
+	if len(locations) == 0 {
+		token := script.Token("PIPETHIS_MINISIGN_KEY")
+		if token == "" || single {
+			return nil, errors.New("No minisign public key found (do you need to set -minisign-key?)")
+		}
+
+		key, err := parseMinisignKey([]byte(token))
+		if err != nil {
+			return nil, err
+		}
+		if !confirm(fmt.Sprintf("The script says it's signed with the minisign key %s (ID %s). Is that the key you expect?", token, key.ID())) {
+			return nil, errors.New("The minisign key wasn't confirmed")
+		}
+
+		return []*minisignKey{key}, nil
+	}
+
+	keys := []*minisignKey{}
+	for _, location := range locations {
+		key, err := readMinisignKey(location)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// minisignVerifier checks minisign and signify signatures. The signer's name
+// is the trusted comment, if there is one.
+type minisignVerifier struct{}
+
+func (minisignVerifier) Verify(artifact io.Reader, signature []byte, trust Trust) (Signer, error) {
+	parsed, err := parseMinisignSignature(signature)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	key, err := parsed.verify(artifact, trust.MinisignKeys)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	return Signer{Name: parsed.trustedComment, Key: key.ID()}, nil
+}
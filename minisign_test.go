@@ -0,0 +1,233 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/blake2b"
+)
+
+type MinisignTest struct {
+	suite.Suite
+	dir     string
+	message []byte
+	id      []byte
+	private ed25519.PrivateKey
+	public  string
+}
+
+// SetupTest makes a key pair, and writes the public key the way `minisign -G`
+// does.
+func (s *MinisignTest) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+
+	s.message = []byte("#!/bin/sh\necho hello\n")
+
+	pub, private, err := ed25519.GenerateKey(rand.Reader)
+	s.Require().NoError(err)
+	s.private = private
+	s.id = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	s.public = base64.StdEncoding.EncodeToString(append(append([]byte(minisignLegacy), s.id...), pub...))
+	s.write("minisign.pub", "untrusted comment: minisign public key 0807060504030201\n"+s.public+"\n")
+}
+
+func (s *MinisignTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *MinisignTest) write(name string, contents string) string {
+	filename := filepath.Join(s.dir, name)
+	s.Require().NoError(ioutil.WriteFile(filename, []byte(contents), 0644))
+	return filename
+}
+
+// minisign signs the message the way `minisign -S` does (prehashed is the
+// default since 0.8).
+func (s *MinisignTest) minisign(algorithm string, comment string) string {
+	signed := s.message
+	if algorithm == minisignPrehashed {
+		digest := blake2b.Sum512(s.message)
+		signed = digest[:]
+	}
+
+	signature := ed25519.Sign(s.private, signed)
+	global := ed25519.Sign(s.private, append(append([]byte{}, signature...), comment...))
+
+	return "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), s.id...), signature...)) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+}
+
+// signify signs the message the way `signify -S` does.
+func (s *MinisignTest) signify() string {
+	signature := ed25519.Sign(s.private, s.message)
+
+	return "untrusted comment: verify with key.pub\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(minisignLegacy), s.id...), signature...)) + "\n"
+}
+
+func (s *MinisignTest) key() []*minisignKey {
+	key, err := parseMinisignKey([]byte(s.public))
+	s.Require().NoError(err)
+	return []*minisignKey{key}
+}
+
+func (s *MinisignTest) TestParseKeyReadsFilesAndStrings() {
+	key, err := readMinisignKey(filepath.Join(s.dir, "minisign.pub"))
+	s.NoError(err)
+	s.Equal("0807060504030201", key.ID())
+
+	key, err = readMinisignKey(s.public)
+	s.NoError(err)
+	s.Equal("0807060504030201", key.ID())
+
+	_, err = readMinisignKey("not a key")
+	s.Error(err)
+
+	_, err = readMinisignKey(base64.StdEncoding.EncodeToString([]byte("Ed12345678")))
+	s.Error(err)
+}
+
+func (s *MinisignTest) TestVerifyAcceptsEveryAlgorithm() {
+	for _, contents := range []string{s.minisign(minisignPrehashed, "timestamp:1 file:install.sh"), s.minisign(minisignLegacy, "hashed"), s.signify()} {
+		sig, err := parseMinisignSignature([]byte(contents))
+		s.Require().NoError(err)
+
+		key, err := sig.verify(strings.NewReader(string(s.message)), s.key())
+		s.NoError(err)
+		s.Equal("0807060504030201", key.ID())
+	}
+}
+
+func (s *MinisignTest) TestVerifyRejectsChangedMessage() {
+	for _, contents := range []string{s.minisign(minisignPrehashed, "comment"), s.signify()} {
+		sig, err := parseMinisignSignature([]byte(contents))
+		s.Require().NoError(err)
+
+		_, err = sig.verify(strings.NewReader("echo pwned"), s.key())
+		s.EqualError(err, "Failed to verify minisign signature")
+	}
+}
+
+func (s *MinisignTest) TestVerifyRejectsChangedTrustedComment() {
+	contents := strings.Replace(s.minisign(minisignPrehashed, "timestamp:1"), "timestamp:1", "timestamp:2", 1)
+
+	sig, err := parseMinisignSignature([]byte(contents))
+	s.Require().NoError(err)
+	s.Equal("timestamp:2", sig.trustedComment)
+
+	_, err = sig.verify(strings.NewReader(string(s.message)), s.key())
+	s.EqualError(err, "Failed to verify the minisign trusted comment")
+}
+
+func (s *MinisignTest) TestVerifyNeedsMatchingKeyID() {
+	sig, err := parseMinisignSignature([]byte(s.signify()))
+	s.Require().NoError(err)
+
+	key := s.key()[0]
+	other := &minisignKey{id: []byte{8, 7, 6, 5, 4, 3, 2, 1}, key: key.key}
+
+	_, err = sig.verify(strings.NewReader(string(s.message)), []*minisignKey{other})
+	s.EqualError(err, "The minisign signature was made by key 0807060504030201, which isn't trusted")
+
+	_, err = sig.verify(strings.NewReader(string(s.message)), []*minisignKey{other, key})
+	s.NoError(err)
+}
+
+func (s *MinisignTest) TestParseRejectsOtherAlgorithms() {
+	contents := strings.Replace(s.signify(), base64.StdEncoding.EncodeToString([]byte(minisignLegacy))[:2], "AA", 1)
+
+	_, err := parseMinisignSignature([]byte(contents))
+	s.Error(err)
+
+	_, err = parseMinisignSignature([]byte("untrusted comment: nothing\n"))
+	s.Error(err)
+}
+
+func (s *MinisignTest) TestKeysComeFromFlagPolicyThenScript() {
+	defer func(original func(string) bool) { confirm = original }(confirm)
+	asked := ""
+	answer := true
+	confirm = func(question string) bool {
+		asked = question
+		return answer
+	}
+
+	script := &Script{filename: s.write("install.sh", "# PIPETHIS_MINISIGN_KEY "+s.public+"\n")}
+	policy := &Policy{Minisign: MinisignPolicy{Keys: []string{filepath.Join(s.dir, "minisign.pub")}}}
+
+	keys, err := minisignKeys("", &Policy{}, script, false)
+	s.NoError(err)
+	s.Len(keys, 1)
+	s.Contains(asked, s.public)
+
+	answer = false
+	_, err = minisignKeys("", &Policy{}, script, false)
+	s.EqualError(err, "The minisign key wasn't confirmed")
+
+	// with nobody to ask, the script's key is never used
+	asked = ""
+	_, err = minisignKeys("", &Policy{}, script, true)
+	s.Error(err)
+	s.Empty(asked)
+
+	keys, err = minisignKeys("", policy, &Script{filename: s.write("empty.sh", "")}, true)
+	s.NoError(err)
+	s.Len(keys, 1)
+
+	_, err = minisignKeys("not a key", policy, script, false)
+	s.Error(err)
+
+	_, err = minisignKeys("", &Policy{}, &Script{filename: filepath.Join(s.dir, "empty.sh")}, false)
+	s.Error(err)
+}
+
+func (s *MinisignTest) TestScriptKeysAreNeverFiles() {
+	defer func(original func(string) bool) { confirm = original }(confirm)
+	confirm = func(string) bool { return true }
+
+	script := &Script{filename: s.write("install.sh", "# PIPETHIS_MINISIGN_KEY "+filepath.Join(s.dir, "minisign.pub")+"\n")}
+	_, err := minisignKeys("", &Policy{}, script, false)
+	s.EqualError(err, "Invalid minisign public key")
+}
+
+func (s *MinisignTest) TestSignatureDispatchesOnFormat() {
+	script := &Script{filename: s.write("install.sh", string(s.message))}
+
+	for format, contents := range map[string]string{formatMinisign: s.minisign(minisignPrehashed, "comment"), formatSignify: s.signify()} {
+		sig := Signature{script: script, filename: s.write("install.sh.sig", contents)}
+
+		actual, err := sig.Format()
+		s.NoError(err)
+		s.Equal(format, actual)
+
+		s.Error(sig.Verify())
+
+		sig.UseMinisignKeys(s.key())
+		s.NoError(sig.Verify())
+	}
+}
+
+func TestMinisignTest(t *testing.T) {
+	suite.Run(t, new(MinisignTest))
+}
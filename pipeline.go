@@ -0,0 +1,124 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+)
+
+// tasks runs functions at the same time. The first one to fail cancels the
+// rest, and its error is the one Wait returns.
+type tasks struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	cancel func()
+	err    error
+}
+
+func newTasks(cancel func()) *tasks {
+	return &tasks{cancel: cancel}
+}
+
+// Go runs task in its own goroutine.
+func (t *tasks) Go(task func() error) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		if err := task(); err != nil {
+			t.once.Do(func() {
+				t.err = err
+				t.cancel()
+			})
+		}
+	}()
+}
+
+// Wait waits for every task to finish, and returns the first error.
+func (t *tasks) Wait() error {
+	t.wg.Wait()
+	return t.err
+}
+
+// maxWatchedLine is as much of one line as a tokenWatcher keeps.
+const maxWatchedLine = 4096
+
+// tokenWatcher looks for a header token like PIPETHIS_AUTHOR in a script
+// while it's being written, one line at a time, so it can be used before the
+// rest of the script has arrived. It uses the same patterns as
+// Script.Token().
+type tokenWatcher struct {
+	pattern *regexp.Regexp
+	line    []byte
+	found   chan string
+	done    bool
+}
+
+func newTokenWatcher(pattern string) *tokenWatcher {
+	return &tokenWatcher{pattern: regexp.MustCompile(pattern), found: make(chan string, 1)}
+}
+
+func (w *tokenWatcher) Write(p []byte) (int, error) {
+	n := len(p)
+	for !w.done && len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			w.keep(p)
+			break
+		}
+
+		w.keep(p[:end])
+		w.check()
+		p = p[end+1:]
+	}
+
+	return n, nil
+}
+
+func (w *tokenWatcher) keep(p []byte) {
+	if room := maxWatchedLine - len(w.line); room < len(p) {
+		p = p[:room]
+	}
+	w.line = append(w.line, p...)
+}
+
+func (w *tokenWatcher) check() {
+	matches := w.pattern.FindSubmatch(bytes.TrimSuffix(w.line, []byte("\r")))
+	w.line = w.line[:0]
+	if matches == nil {
+		return
+	}
+
+	w.found <- string(matches[1])
+	close(w.found)
+	w.done = true
+}
+
+// Close checks the last line, and gives up on the token if it wasn't found.
+func (w *tokenWatcher) Close() error {
+	if !w.done {
+		w.check()
+	}
+	if !w.done {
+		close(w.found)
+		w.done = true
+	}
+
+	return nil
+}
+
+// Wait blocks until the token is found, or the watcher is closed without
+// finding it.
+func (w *tokenWatcher) Wait() (string, bool) {
+	token, ok := <-w.found
+	return token, ok
+}
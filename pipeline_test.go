@@ -0,0 +1,93 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type PipelineTest struct {
+	suite.Suite
+}
+
+func (s *PipelineTest) TestFirstFailureCancelsTheRest() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running := newTasks(cancel)
+	running.Go(func() error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	running.Go(func() error {
+		return errors.New("broken")
+	})
+
+	s.EqualError(running.Wait(), "broken")
+	s.Error(ctx.Err())
+}
+
+func (s *PipelineTest) TestTasksSucceed() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	running := newTasks(cancel)
+	for i := 0; i < 3; i++ {
+		running.Go(func() error { return nil })
+	}
+
+	s.NoError(running.Wait())
+	s.NoError(ctx.Err())
+}
+
+func (s *PipelineTest) TestTokenWatcherFindsAuthorEarly() {
+	watcher := newTokenWatcher(authorPattern)
+	reader, writer := io.Pipe()
+
+	go func() {
+		io.Copy(writer, iotest.OneByteReader(strings.NewReader("#!/bin/sh\r\n# PIPETHIS_AUTHOR gemma@example.com\r\n")))
+		// the rest of the script hasn't arrived yet
+	}()
+	go io.Copy(watcher, reader)
+
+	author, ok := watcher.Wait()
+	s.True(ok)
+	s.Equal("gemma@example.com", author)
+}
+
+func (s *PipelineTest) TestTokenWatcherChecksLastLine() {
+	watcher := newTokenWatcher(authorPattern)
+	watcher.Write([]byte("echo hi\n# PIPETHIS_AUTHOR gemma"))
+	watcher.Close()
+
+	author, ok := watcher.Wait()
+	s.True(ok)
+	s.Equal("gemma", author)
+}
+
+func (s *PipelineTest) TestTokenWatcherGivesUp() {
+	watcher := newTokenWatcher(authorPattern)
+	watcher.Write([]byte(strings.Repeat("x", 2*maxWatchedLine) + " PIPETHIS_AUTHOR gemma\n"))
+	watcher.Close()
+
+	_, ok := watcher.Wait()
+	s.False(ok)
+}
+
+func TestPipelineTest(t *testing.T) {
+	suite.Run(t, new(PipelineTest))
+}
@@ -0,0 +1,161 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Policy is the local configuration for what pipethis should trust, beyond
+// the keys it looks up for script authors. It's loaded from a JSON file:
+//
+//	{
+//	  "sigstore": {
+//	    "identity": "release@example.com",
+//	    "issuer": "https://accounts.google.com",
+//	    "fulcio_roots": ["fulcio.pem"],
+//	    "rekor_keys": ["rekor.pub"]
+//	  },
+//	  "minisign": {
+//	    "keys": ["minisign.pub", "RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"]
+//	  },
+//	  "scopes": {
+//	    "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260": ["https://get.example.com/*"]
+//	  }
+//	}
+//
+// Relative file names are relative to the policy file.
+type Policy struct {
+	Sigstore SigstorePolicy `json:"sigstore"`
+	Minisign MinisignPolicy `json:"minisign"`
+	// Scopes are the script locations each key is trusted for, by PGP
+	// fingerprint, SSH SHA256 fingerprint, minisign key ID,
+	// or Sigstore identity. Keys that aren't here are trusted anywhere.
+	Scopes map[string][]string `json:"scopes"`
+}
+
+// SigstorePolicy holds the trust roots for Sigstore bundles, and the
+// certificate identity and issuer they have to be signed by.
+type SigstorePolicy struct {
+	Identity    string   `json:"identity"`
+	Issuer      string   `json:"issuer"`
+	FulcioRoots []string `json:"fulcio_roots"`
+	RekorKeys   []string `json:"rekor_keys"`
+}
+
+// MinisignPolicy holds the minisign and signify public keys to trust. Each one
+// is a key file or the key itself.
+type MinisignPolicy struct {
+	Keys []string `json:"keys"`
+}
+
+// LoadPolicy reads the policy in filename. An empty filename is an empty
+// policy.
+func LoadPolicy(filename string) (*Policy, error) {
+	policy := &Policy{}
+	if filename == "" {
+		return policy, nil
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, policy); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(filename)
+	policy.Sigstore.FulcioRoots = resolvePaths(dir, policy.Sigstore.FulcioRoots)
+	policy.Sigstore.RekorKeys = resolvePaths(dir, policy.Sigstore.RekorKeys)
+	policy.Minisign.Keys = resolveKeys(dir, policy.Minisign.Keys)
+
+	return policy, nil
+}
+
+// SigstoreTrust loads the Sigstore trust roots from the policy. The expected
+// identity and issuer come from the policy. If it doesn't set them, the
+// script's PIPETHIS_SIGSTORE_IDENTITY and PIPETHIS_SIGSTORE_ISSUER tokens are
+// only used once someone confirms them, since whoever serves the script
+// could have written them. With single set, there's nobody to ask.
+func (p Policy) SigstoreTrust(script *Script, single bool) (*sigstoreTrust, error) {
+	if len(p.Sigstore.FulcioRoots) == 0 || len(p.Sigstore.RekorKeys) == 0 {
+		return nil, errors.New("Sigstore signatures need Fulcio roots and Rekor keys in the policy (do you need to set -policy?)")
+	}
+
+	identity, issuer := p.Sigstore.Identity, p.Sigstore.Issuer
+	if identity == "" || issuer == "" {
+		if identity == "" {
+			identity = script.Token("PIPETHIS_SIGSTORE_IDENTITY")
+		}
+		if issuer == "" {
+			issuer = script.Token("PIPETHIS_SIGSTORE_ISSUER")
+		}
+
+		if identity == "" || issuer == "" || single {
+			return nil, errors.New("Sigstore signatures need the expected identity and issuer in the policy (do you need to set -policy?)")
+		}
+		if !confirm(fmt.Sprintf("The script says it's signed by %s from %s. Is that who you expect?", identity, issuer)) {
+			return nil, errors.New("The Sigstore identity wasn't confirmed")
+		}
+	}
+
+	return newSigstoreTrust(p.Sigstore.FulcioRoots, p.Sigstore.RekorKeys, identity, issuer)
+}
+
+// ScopesFor returns the script locations key is trusted for, from every
+// scope in the policy that names it.
+func (p Policy) ScopesFor(key string) []string {
+	scopes := []string{}
+	for id, locations := range p.Scopes {
+		if sameKey(id, key) {
+			scopes = append(scopes, locations...)
+		}
+	}
+
+	return scopes
+}
+
+// resolvePaths makes every relative path in paths relative to dir instead.
+func resolvePaths(dir string, paths []string) []string {
+	resolved := []string{}
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		resolved = append(resolved, path)
+	}
+
+	return resolved
+}
+
+// resolveKeys is resolvePaths for keys that might not be files: anything that
+// isn't a file relative to dir is left alone.
+func resolveKeys(dir string, keys []string) []string {
+	resolved := []string{}
+	for _, key := range keys {
+		path := key
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if _, err := os.Stat(path); err == nil {
+			key = path
+		}
+		resolved = append(resolved, key)
+	}
+
+	return resolved
+}
@@ -0,0 +1,128 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type PolicyTest struct {
+	suite.Suite
+	dir string
+}
+
+func (s *PolicyTest) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+}
+
+func (s *PolicyTest) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *PolicyTest) write(name string, contents string) string {
+	filename := filepath.Join(s.dir, name)
+	s.Require().NoError(ioutil.WriteFile(filename, []byte(contents), 0644))
+	return filename
+}
+
+func (s *PolicyTest) TestLoadEmptyName() {
+	policy, err := LoadPolicy("")
+	s.NoError(err)
+	s.Equal(&Policy{}, policy)
+}
+
+func (s *PolicyTest) TestLoadResolvesRelativePaths() {
+	filename := s.write("policy.json", `{
+		"sigstore": {
+			"identity": "gemma@example.com",
+			"issuer": "https://accounts.example.com",
+			"fulcio_roots": ["fulcio.pem", "/etc/fulcio.pem"],
+			"rekor_keys": ["keys/rekor.pub"]
+		}
+	}`)
+
+	policy, err := LoadPolicy(filename)
+	s.NoError(err)
+	s.Equal("gemma@example.com", policy.Sigstore.Identity)
+	s.Equal("https://accounts.example.com", policy.Sigstore.Issuer)
+	s.Equal([]string{filepath.Join(s.dir, "fulcio.pem"), "/etc/fulcio.pem"}, policy.Sigstore.FulcioRoots)
+	s.Equal([]string{filepath.Join(s.dir, "keys/rekor.pub")}, policy.Sigstore.RekorKeys)
+}
+
+func (s *PolicyTest) TestLoadFailsWithBadFiles() {
+	_, err := LoadPolicy(filepath.Join(s.dir, "missing.json"))
+	s.Error(err)
+
+	_, err = LoadPolicy(s.write("policy.json", "not json"))
+	s.Error(err)
+}
+
+func (s *PolicyTest) TestSigstoreTrustNeedsRoots() {
+	_, err := Policy{}.SigstoreTrust(&Script{}, false)
+	s.Error(err)
+}
+
+func (s *PolicyTest) TestSigstoreTrustAsksBeforeUsingScriptIdentity() {
+	// any self-signed certificate and public key will do
+	sigstore := &SigstoreTest{}
+	sigstore.SetT(s.T())
+	sigstore.SetupSuite()
+	defer sigstore.TearDownSuite()
+
+	script := &Script{filename: s.write("install.sh", "# PIPETHIS_SIGSTORE_IDENTITY gemma@example.org\n# PIPETHIS_SIGSTORE_ISSUER https://issuer.example.org\n")}
+	policy := Policy{Sigstore: SigstorePolicy{
+		FulcioRoots: []string{filepath.Join(sigstore.dir, "fulcio.pem")},
+		RekorKeys:   []string{filepath.Join(sigstore.dir, "rekor.pub")},
+	}}
+
+	defer func(original func(string) bool) { confirm = original }(confirm)
+	asked := ""
+	answer := true
+	confirm = func(question string) bool {
+		asked = question
+		return answer
+	}
+
+	trust, err := policy.SigstoreTrust(script, false)
+	s.NoError(err)
+	s.Contains(asked, "gemma@example.org from https://issuer.example.org")
+	s.Equal("gemma@example.org", trust.identity)
+	s.Equal("https://issuer.example.org", trust.issuer)
+
+	answer = false
+	_, err = policy.SigstoreTrust(script, false)
+	s.EqualError(err, "The Sigstore identity wasn't confirmed")
+
+	// with nobody to ask, the script's identity is never used
+	asked = ""
+	_, err = policy.SigstoreTrust(script, true)
+	s.Error(err)
+	s.Empty(asked)
+
+	policy.Sigstore.Identity = "gemma@example.com"
+	policy.Sigstore.Issuer = "https://accounts.example.com"
+	asked = ""
+	trust, err = policy.SigstoreTrust(script, true)
+	s.Empty(asked)
+	s.NoError(err)
+	s.Equal("gemma@example.com", trust.identity)
+	s.Equal("https://accounts.example.com", trust.issuer)
+}
+
+func TestPolicyTest(t *testing.T) {
+	suite.Run(t, new(PolicyTest))
+}
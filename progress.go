@@ -0,0 +1,104 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// progress shows how far along a download is, on one line of a terminal.
+type progress struct {
+	out   io.Writer
+	label string
+	total int64
+	done  int64
+	shown time.Time
+}
+
+// showProgress turns progress indicators off when false, for when there's
+// more than one download at a time.
+var showProgress = true
+
+// newProgress returns a progress indicator for a download of total bytes (-1
+// if that's unknown), or nil if STDERR isn't a terminal.
+func newProgress(label string, total int64) *progress {
+	if !showProgress {
+		return nil
+	}
+
+	stat, err := os.Stderr.Stat()
+	if err != nil || (stat.Mode()&os.ModeCharDevice) == 0 {
+		return nil
+	}
+
+	return &progress{out: os.Stderr, label: label, total: total}
+}
+
+// Write counts the bytes in b, and updates the line every so often.
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.shown) >= 100*time.Millisecond {
+		p.show()
+	}
+
+	return len(b), nil
+}
+
+// Done shows the final count and finishes the line.
+func (p *progress) Done() {
+	p.show()
+	fmt.Fprintln(p.out)
+}
+
+func (p *progress) show() {
+	p.shown = time.Now()
+	if p.total > 0 {
+		fmt.Fprintf(p.out, "\r%s: %s of %s (%d%%)", p.label, humanSize(p.done), humanSize(p.total), p.done*100/p.total)
+		return
+	}
+
+	fmt.Fprintf(p.out, "\r%s: %s", p.label, humanSize(p.done))
+}
+
+// Reader counts everything read from body. Closing it finishes the line.
+func (p *progress) Reader(body io.ReadCloser) io.ReadCloser {
+	return &progressReader{Reader: io.TeeReader(body, p), body: body, progress: p}
+}
+
+type progressReader struct {
+	io.Reader
+	body     io.Closer
+	progress *progress
+}
+
+func (r *progressReader) Close() error {
+	r.progress.Done()
+	return r.body.Close()
+}
+
+// humanSize is n bytes in the biggest unit that fits.
+func humanSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	return fmt.Sprintf("%.1f %s", size, units[unit])
+}
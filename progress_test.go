@@ -0,0 +1,57 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProgressTest struct {
+	suite.Suite
+}
+
+func (s *ProgressTest) TestReaderShowsProgress() {
+	out := &bytes.Buffer{}
+	p := &progress{out: out, label: "install.sh", total: 2048}
+
+	body := p.Reader(ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 2048))))
+	contents, err := ioutil.ReadAll(body)
+	s.NoError(err)
+	s.Len(contents, 2048)
+	s.NoError(body.Close())
+
+	s.True(strings.HasSuffix(out.String(), "\rinstall.sh: 2.0 KB of 2.0 KB (100%)\n"), out.String())
+}
+
+func (s *ProgressTest) TestUnknownTotal() {
+	out := &bytes.Buffer{}
+	p := &progress{out: out, label: "install.sh", total: -1}
+	p.Write(make([]byte, 10))
+	p.Done()
+
+	s.Equal("\rinstall.sh: 10 B\rinstall.sh: 10 B\n", out.String())
+}
+
+func (s *ProgressTest) TestHumanSize() {
+	s.Equal("0 B", humanSize(0))
+	s.Equal("1023 B", humanSize(1023))
+	s.Equal("1.5 KB", humanSize(1536))
+	s.Equal("100.0 MB", humanSize(100<<20))
+	s.Equal("2048.0 GB", humanSize(2<<40))
+}
+
+func TestProgressTest(t *testing.T) {
+	suite.Run(t, new(ProgressTest))
+}
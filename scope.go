@@ -0,0 +1,150 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ellotheth/pipethis/lookup"
+)
+
+// trustScopes gathers the script locations the signer's key is trusted for,
+// from the policy and, for PGP keys, the pipethis keyring. No scopes means
+// the key is trusted anywhere.
+func trustScopes(signer Signer, format string, policy *Policy, keyring string) ([]string, error) {
+	scopes := policy.ScopesFor(signer.Key)
+	if format != formatPGP {
+		return scopes, nil
+	}
+
+	bundles, err := lookup.NewKeyring(keyring).Bundles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bundle := range bundles {
+		if sameKey(bundle.User.Fingerprint, signer.Key) {
+			scopes = append(scopes, bundle.URLs...)
+		}
+	}
+
+	return scopes, nil
+}
+
+// checkScope makes sure the script at location is somewhere the signer is
+// trusted. An empty location is a piped script, which no scope allows.
+func checkScope(signer Signer, location string, scopes []string) error {
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	sort.Strings(scopes)
+	trusted := strings.Join(scopes, ", ")
+	if location == "" {
+		return fmt.Errorf("The signature is valid, but %s is only trusted for scripts from %s, and this one was piped in", signer, trusted)
+	}
+
+	location = scriptURL(location)
+	for _, scope := range scopes {
+		if scopeAllows(scope, location) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("The signature is valid, but %s is only trusted for scripts from %s, not %s", signer, trusted, location)
+}
+
+// scriptURL turns a script location into a URL. Local scripts become file://
+// URLs with absolute paths; anything that's already a URL is left alone.
+func scriptURL(location string) string {
+	if parsed, err := url.Parse(location); err == nil && parsed.Scheme != "" {
+		return location
+	}
+
+	if abs, err := filepath.Abs(location); err == nil {
+		location = abs
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(location)}).String()
+}
+
+// scopeAllows is true if location is covered by scope. A scope is a URL that
+// matches exactly, or a URL ending in * that matches every path under it.
+// The host can start with *. to match any subdomain.
+func scopeAllows(scope, location string) bool {
+	want, err := url.Parse(scope)
+	if err != nil || want.Scheme == "" {
+		return false
+	}
+
+	got, err := url.Parse(location)
+	if err != nil || got.User != nil {
+		return false
+	}
+
+	if !strings.EqualFold(want.Scheme, got.Scheme) || !hostAllows(want.Host, got.Host) {
+		return false
+	}
+
+	wanted := want.Path
+	if wanted == "" {
+		wanted = "/"
+	}
+	actual := path.Clean("/" + got.Path)
+
+	if strings.HasSuffix(wanted, "*") {
+		prefix := strings.TrimSuffix(wanted, "*")
+		return strings.HasPrefix(actual, prefix) || actual+"/" == prefix
+	}
+
+	return actual == wanted && (want.RawQuery == "" || want.RawQuery == got.RawQuery)
+}
+
+func hostAllows(want, got string) bool {
+	want, got = strings.ToLower(want), strings.ToLower(got)
+	if strings.HasPrefix(want, "*.") {
+		return strings.HasSuffix(got, want[1:])
+	}
+
+	return want == got
+}
+
+// sameKey is true if id names key. Hex IDs (PGP fingerprints and minisign
+// key IDs) are compared without case, with an optional 0x. A PGP key has to
+// be named by its whole fingerprint: long key IDs can be forged.
+func sameKey(id, key string) bool {
+	if id == key {
+		return true
+	}
+
+	id = strings.TrimPrefix(strings.ToLower(id), "0x")
+	key = strings.ToLower(key)
+
+	return isHex(id) && id == key
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,112 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ScopeTest struct {
+	suite.Suite
+}
+
+func (s *ScopeTest) TestScopeAllows() {
+	allowed := map[string]string{
+		"https://get.example.com/*":              "https://get.example.com/install.sh",
+		"https://get.example.com/tools/*":        "https://get.example.com/tools/v2/install.sh",
+		"https://*.example.com/*":                "https://get.example.com/install.sh",
+		"https://get.example.com/install.sh":     "https://GET.example.com/install.sh",
+		"https://get.example.com:8443/*":         "https://get.example.com:8443/install.sh",
+		"file:///opt/scripts/*":                  "file:///opt/scripts/install.sh",
+		"https://get.example.com/install.sh?v=1": "https://get.example.com/install.sh?v=1",
+	}
+	for scope, location := range allowed {
+		s.True(scopeAllows(scope, location), scope)
+	}
+
+	denied := map[string]string{
+		"https://get.example.com/*":          "http://get.example.com/install.sh",
+		"https://get.example.com/tools/*":    "https://get.example.com/tools/../install.sh",
+		"https://*.example.com/*":            "https://get.example.com.evil.com/install.sh",
+		"https://get.example.com/install.sh": "https://get.example.com/install.sh/more",
+		"https://get.example.com/":           "https://get.example.com@evil.com/",
+		"get.example.com/*":                  "https://get.example.com/install.sh",
+	}
+	for scope, location := range denied {
+		s.False(scopeAllows(scope, location), scope)
+	}
+}
+
+func (s *ScopeTest) TestCheckScope() {
+	signer := Signer{Name: "Gemma", Key: "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"}
+
+	s.NoError(checkScope(signer, "", nil))
+	s.NoError(checkScope(signer, "https://anywhere.example.com/install.sh", nil))
+	s.NoError(checkScope(signer, "https://get.example.com/install.sh", []string{"https://get.example.com/*"}))
+
+	s.EqualError(
+		checkScope(signer, "https://evil.example.com/install.sh", []string{"https://get.example.com/*"}),
+		"The signature is valid, but Gemma (22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260) is only trusted for scripts from https://get.example.com/*, not https://evil.example.com/install.sh",
+	)
+	s.Error(checkScope(signer, "", []string{"https://get.example.com/*"}))
+}
+
+func (s *ScopeTest) TestCheckScopeForLocalScripts() {
+	abs, err := filepath.Abs("fixtures")
+	s.Require().NoError(err)
+
+	signer := Signer{Key: "RWQf6LRCGA9i53ml"}
+	s.NoError(checkScope(signer, "fixtures/signed.ed25519", []string{"file://" + filepath.ToSlash(abs) + "/*"}))
+	s.Error(checkScope(signer, "fixtures/signed.ed25519", []string{"https://get.example.com/*"}))
+}
+
+func (s *ScopeTest) TestCheckScopeForOtherSchemes() {
+	signer := Signer{Key: "RWQf6LRCGA9i53ml"}
+	s.NoError(checkScope(signer, "s3://installers/tools/install.sh", []string{"s3://installers/tools/*"}))
+	s.Error(checkScope(signer, "s3://other-bucket/tools/install.sh", []string{"s3://installers/tools/*"}))
+}
+
+func (s *ScopeTest) TestTrustScopesFromPolicyAndKeyring() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	keyring := filepath.Join(dir, "keyring")
+	s.Require().NoError(addKeys([]string{"-keyring", keyring, "-url", "https://get.example.com/*", "fixtures/ed25519.asc"}))
+
+	policy := &Policy{Scopes: map[string][]string{
+		"0x22b5f4df9cbf8ff3659a6e49c5df7aca675e5260": {"https://mirror.example.com/*"},
+		"C5DF7ACA675E5260":                           {"https://forged.example.com/*"},
+		"SHA256:abc":                                 {"https://ssh.example.com/*"},
+	}}
+
+	signer := Signer{Key: "22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260"}
+	scopes, err := trustScopes(signer, formatPGP, policy, keyring)
+	s.NoError(err)
+	s.ElementsMatch([]string{"https://mirror.example.com/*", "https://get.example.com/*"}, scopes)
+
+	// the keyring only holds PGP keys
+	scopes, err = trustScopes(Signer{Key: "SHA256:abc"}, formatSSH, policy, keyring)
+	s.NoError(err)
+	s.Equal([]string{"https://ssh.example.com/*"}, scopes)
+
+	scopes, err = trustScopes(Signer{Key: "SHA256:ABC"}, formatSSH, policy, keyring)
+	s.NoError(err)
+	s.Empty(scopes)
+}
+
+func TestScopeTest(t *testing.T) {
+	suite.Run(t, new(ScopeTest))
+}
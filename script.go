@@ -11,62 +11,178 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 
-	"golang.org/x/crypto/openpgp/armor"
-	"golang.org/x/crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ellotheth/pipethis/fetch"
 )
 
+// authorPattern finds the PIPETHIS_AUTHOR token in a script: a single word, or
+// an email address. Only the first match counts.
+const authorPattern = `.*PIPETHIS_AUTHOR\s+([\w.+\-]+@[\w\-]+(?:\.[\w\-]+)+|\w+)`
+
 // Script represents a shell script to be inspected, verified, and run.
 type Script struct {
 	author      string
 	source      string
+	resolved    string
+	header      http.Header
+	digests     map[string]string
 	filename    string
 	clearsigned bool
 }
 
 // NewScript copies the shell script specified in location (which may be local
-// or remote) to a temporary file and loads it into a Script.
+// or remote) to a temporary file and loads it into a Script. The script is
+// streamed to disk, and can't be any bigger than the HTTP client's maximum
+// body size. The temporary file stays empty until the whole script is there.
 func NewScript(location string) (*Script, error) {
-	script := &Script{source: location}
-
-	body, err := getFile(location)
+	script, body, err := openScript(context.Background(), location)
 	if err != nil {
 		return nil, err
 	}
 	defer body.Close()
 
+	if err := script.download(body); err != nil {
+		os.Remove(script.Name())
+		return nil, err
+	}
+
+	return script, nil
+}
+
+// openScript starts NewScript: the Script knows where it's coming from and
+// where it'll be saved, but the body still has to go through
+// Script.download. The download stops when ctx is cancelled.
+func openScript(ctx context.Context, location string) (*Script, io.ReadCloser, error) {
+	script := &Script{source: location, digests: map[string]string{}}
+
+	resource, err := getFile(ctx, location, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	script.resolved = resource.Location
+	script.header = resource.Header
+
+	// claim a name for the script
 	file, err := ioutil.TempFile("", "pipethis-")
 	if err != nil {
-		return nil, err
+		resource.Body.Close()
+		return nil, nil, err
 	}
-	defer file.Close()
+	file.Close()
 
 	script.filename = file.Name()
 
-	contents, err := ioutil.ReadAll(body)
+	return script, resource.Body, nil
+}
+
+// download writes body to a .part file next to Script.Name(), and only renames
+// it into place once all of it has been read. Everything read is copied to
+// watchers too.
+func (s *Script) download(body io.Reader, watchers ...io.Writer) error {
+	part, err := os.OpenFile(s.filename+".part", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer os.Remove(part.Name())
+	defer part.Close()
+
+	hashes := map[string]hash.Hash{"sha256": sha256.New(), "sha512": sha512.New()}
+	writer := io.MultiWriter(append([]io.Writer{part, hashes["sha256"], hashes["sha512"]}, watchers...)...)
+
+	if _, err := io.Copy(writer, fetch.LimitReader(body, httpClient.MaxBodySize())); err != nil {
+		return err
+	}
+
+	for name, sum := range hashes {
+		s.digests[name] = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	if err := s.detachFileSignature(part); err != nil {
+		return err
+	}
+
+	if err := part.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(part.Name(), s.filename)
+}
+
+// detachFileSignature runs detachSignature over file, if it holds a
+// clearsigned script. Nothing else gets read into memory.
+func (s *Script) detachFileSignature(file *os.File) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
 
-	contents, err = script.detachSignature(contents)
+	found, err := containsMarker(file, []byte("-----BEGIN PGP SIGNED MESSAGE-----"))
+	if err != nil || !found {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	_, err = file.Write(contents)
+	contents, err = s.detachSignature(contents)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return script, nil
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err = file.WriteAt(contents, 0)
+	return err
+}
+
+// containsMarker reads through reader looking for marker, a chunk at a time.
+func containsMarker(reader io.Reader, marker []byte) (bool, error) {
+	buf := make([]byte, 32*1024)
+	carried := 0
+	for {
+		n, err := reader.Read(buf[carried:])
+		filled := carried + n
+		if bytes.Contains(buf[:filled], marker) {
+			return true, nil
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		// keep the end of the chunk, in case the marker straddles two
+		carried = len(marker) - 1
+		if carried > filled {
+			carried = filled
+		}
+		copy(buf, buf[filled-carried:filled])
+	}
 }
 
 func (s *Script) detachSignature(contents []byte) ([]byte, error) {
@@ -122,6 +238,32 @@ func (s Script) Source() string {
 	return s.source
 }
 
+// Resolved is where the shell script was really downloaded from, after any
+// redirects.
+func (s Script) Resolved() string {
+	if s.resolved == "" {
+		return s.source
+	}
+
+	return s.resolved
+}
+
+// Digests are the hex digests of the script as it was downloaded, by
+// algorithm: sha256 and sha512.
+func (s Script) Digests() map[string]string {
+	return s.digests
+}
+
+// Header is the response headers the shell script was downloaded with. It's
+// empty for local and piped scripts.
+func (s Script) Header() http.Header {
+	if s.header == nil {
+		return http.Header{}
+	}
+
+	return s.header
+}
+
 // Body opens Script.Name() for reading.
 func (s Script) Body() (ReadSeekCloser, error) {
 	return os.Open(s.Name())
@@ -140,7 +282,7 @@ func (s *Script) Author() (string, error) {
 	}
 	defer file.Close()
 
-	if author := parseToken(`.*PIPETHIS_AUTHOR\s+(\w+)`, file); author != "" {
+	if author := parseToken(authorPattern, file); author != "" {
 		s.author = author
 
 		return s.author, nil
@@ -149,6 +291,19 @@ func (s *Script) Author() (string, error) {
 	return "", errors.New("Author not found")
 }
 
+// Token parses Script.Body() for a header token like PIPETHIS_AUTHOR, and
+// returns whatever follows it up to the next space. It returns an empty string
+// if the token isn't there.
+func (s Script) Token(name string) string {
+	file, err := s.Body()
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	return parseToken(`.*`+regexp.QuoteMeta(name)+`\s+(\S+)`, file)
+}
+
 // Run creates a new process, running Script.Name() with target and any
 // additional arguments from the command line. It returns the result of the
 // process.
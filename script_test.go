@@ -10,10 +10,15 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
 	"testing"
+	"testing/iotest"
 
+	"github.com/ellotheth/pipethis/fetch"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -79,6 +84,60 @@ FiV3SWOrHc2hIbLugeNf
 	s.NoError(err)
 }
 
+func (s *ScriptTest) TestNewScriptStreamsToDisk() {
+	script, err := NewScript("fixtures/signed.ed25519")
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+
+	expected, _ := ioutil.ReadFile("fixtures/signed.ed25519")
+	actual, _ := ioutil.ReadFile(script.Name())
+	s.Equal(expected, actual)
+	s.False(script.IsClearsigned())
+
+	sum := sha256.Sum256(expected)
+	s.Equal(hex.EncodeToString(sum[:]), script.Digests()["sha256"])
+	s.Len(script.Digests()["sha512"], 128)
+}
+
+func (s *ScriptTest) TestNewScriptDetachesClearsignedScripts() {
+	script, err := NewScript("fixtures/signed.attached")
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+	defer os.Remove(script.Name() + ".sig")
+
+	s.True(script.IsClearsigned())
+	actual, _ := ioutil.ReadFile(script.Name())
+	s.Equal("# PIPETHIS_AUTHOR 5AA6F296\n\necho this is my file and there will be one match", string(actual))
+}
+
+func (s *ScriptTest) TestNewScriptEnforcesMaxSize() {
+	defer func(client *fetch.Client) { httpClient = client }(httpClient)
+
+	var err error
+	httpClient, err = fetch.NewClient(fetch.Options{MaxBodySize: 16})
+	s.Require().NoError(err)
+
+	_, err = NewScript("fixtures/signed.ed25519")
+	s.Equal(fetch.ErrTooLarge, err)
+}
+
+func (s *ScriptTest) TestContainsMarkerAcrossChunks() {
+	marker := []byte("-----BEGIN PGP SIGNED MESSAGE-----")
+	contents := append(bytes.Repeat([]byte("x"), 32*1024-10), marker...)
+
+	found, err := containsMarker(bytes.NewReader(contents), marker)
+	s.NoError(err)
+	s.True(found)
+
+	found, err = containsMarker(iotest.OneByteReader(bytes.NewReader(contents)), marker)
+	s.NoError(err)
+	s.True(found)
+
+	found, err = containsMarker(bytes.NewReader(contents[:len(contents)-1]), marker)
+	s.NoError(err)
+	s.False(found)
+}
+
 func (s *ScriptTest) TestAuthorUsesSavedName() {
 	script := Script{author: "foo"}
 
@@ -146,6 +205,9 @@ more stuff
 # more comments
 things and stuff
 		`},
+		{`bar@example.com`, `# PIPETHIS_AUTHOR bar@example.com`},
+		{`bar.baz+pipethis@mail.example.com`, `# PIPETHIS_AUTHOR bar.baz+pipethis@mail.example.com  `},
+		{`bar`, `# PIPETHIS_AUTHOR bar@localhost`},
 		{`bar_STUFF_123`, `
 // PIPETHIS_AUTHOR bar_STUFF_123 should take this one
 // PIPETHIS_AUTHOR other_author should ignore this one
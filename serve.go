@@ -0,0 +1,350 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signaturePrefix is the path the mirror serves signatures under, ahead of
+// the upstream script's URL.
+const signaturePrefix = "/.signature/"
+
+// mirrorEntry is what the mirror knows about a script it verified.
+type mirrorEntry struct {
+	LockedScript
+	Verified time.Time `json:"verified"`
+}
+
+// mirror is a caching proxy for `pipethis serve --mirror`. The first time a
+// script is asked for, it's downloaded and verified like pipethis would
+// before running it. Only scripts that verify are kept, and only kept scripts
+// are served.
+type mirror struct {
+	dir       string
+	options   *verifyOptions
+	upstreams []string
+	maxAge    time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingScript
+}
+
+// pendingScript is held while a script is looked up or verified, so requests
+// for the same script wait for each other. waiting counts the requests that
+// want it, so the last one can clean it up.
+type pendingScript struct {
+	sync.Mutex
+	waiting int
+}
+
+// newMirror keeps verified scripts in dir. It only fetches scripts from the
+// locations in upstreams (like https://get.example.com/*). Scripts that were
+// verified more than maxAge ago are verified again before they're served; if
+// maxAge is 0, they're kept forever.
+func newMirror(dir string, options *verifyOptions, upstreams []string, maxAge time.Duration) (*mirror, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &mirror{dir: dir, options: options, upstreams: upstreams, maxAge: maxAge, pending: map[string]*pendingScript{}}, nil
+}
+
+// ServeHTTP serves the script at /<upstream URL>, and its signature at
+// /.signature/<upstream URL>. A # in the upstream URL has to be sent as %23.
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Only GET and HEAD are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.EscapedPath()
+	signature := strings.HasPrefix(path, signaturePrefix)
+	if signature {
+		path = "/" + strings.TrimPrefix(path, signaturePrefix)
+	}
+
+	upstream, err := mirrorUpstream(path, r.URL.RawQuery, m.upstreams)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entry, dir, err := m.get(r.Context(), upstream)
+	if err != nil {
+		log.Println("Not mirroring", upstream+":", err)
+		http.Error(w, "Couldn't verify "+upstream+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	filename := filepath.Join(dir, "script")
+	if signature {
+		filename = filepath.Join(dir, "signature")
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	signatureURL := signaturePrefix + strings.TrimPrefix(path, "/")
+	if r.URL.RawQuery != "" {
+		signatureURL += "?" + r.URL.RawQuery
+	}
+	header.Set("X-Signature-URL", signatureURL)
+	header.Set("X-Pipethis-Source", entry.Resolved)
+	header.Set("X-Pipethis-SHA256", entry.SHA256)
+	header.Set("X-Pipethis-Signature-SHA256", entry.SignatureSHA256)
+	header.Set("X-Pipethis-Format", entry.Format)
+	header.Set("X-Pipethis-Signer", entry.Signer)
+	header.Set("X-Pipethis-Verified", entry.Verified.Format(time.RFC3339))
+
+	http.ServeContent(w, r, "", entry.Verified, file)
+}
+
+// mirrorUpstream turns the escaped request path and query back into the
+// upstream URL. It has to be one of the allowed locations, so nobody can use
+// the mirror to read its own files or reach anything else they shouldn't.
+func mirrorUpstream(path, query string, allowed []string) (string, error) {
+	upstream := strings.Replace(strings.TrimPrefix(path, "/"), "%23", "#", 1)
+	if query != "" {
+		if strings.Contains(upstream, "#") {
+			return "", errors.New("Send the query before the %23 fragment")
+		}
+		upstream += "?" + query
+	}
+
+	parsed, err := url.Parse(upstream)
+	if err != nil || !parsed.IsAbs() {
+		return "", errors.New("Ask for /<script URL>, like /https://get.example.com/install.sh")
+	}
+
+	for _, scope := range allowed {
+		if scopeAllows(scope, upstream) {
+			return upstream, nil
+		}
+	}
+
+	return "", errors.New("The mirror doesn't serve scripts from " + upstream)
+}
+
+// get returns the verified entry for upstream and the directory holding its
+// files, downloading and verifying it first if it isn't there yet (or it's
+// older than maxAge). Requests for the same script wait for the first one
+// instead of downloading it again.
+func (m *mirror) get(ctx context.Context, upstream string) (*mirrorEntry, string, error) {
+	sum := sha256.Sum256([]byte(upstream))
+	key := hex.EncodeToString(sum[:])
+	dir := filepath.Join(m.dir, key)
+
+	m.mu.Lock()
+	pending, ok := m.pending[key]
+	if !ok {
+		pending = &pendingScript{}
+		m.pending[key] = pending
+	}
+	pending.waiting++
+	m.mu.Unlock()
+
+	pending.Lock()
+	defer func() {
+		pending.Unlock()
+
+		m.mu.Lock()
+		pending.waiting--
+		if pending.waiting == 0 {
+			delete(m.pending, key)
+		}
+		m.mu.Unlock()
+	}()
+
+	entry, err := loadMirrorEntry(dir)
+	switch {
+	case err == nil && (m.maxAge == 0 || time.Since(entry.Verified) < m.maxAge):
+		return entry, dir, nil
+	case err == nil:
+		log.Println("Verifying", upstream, "again; it was last verified", entry.Verified.Format(time.RFC3339))
+	case !os.IsNotExist(err):
+		return nil, "", err
+	}
+
+	entry, err = m.add(ctx, upstream, dir)
+	return entry, dir, err
+}
+
+func loadMirrorEntry(dir string) (*mirrorEntry, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "entry.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &mirrorEntry{}
+	if err := json.Unmarshal(contents, entry); err != nil {
+		return nil, errors.New("Invalid mirror entry in " + dir + ": " + err.Error())
+	}
+
+	return entry, nil
+}
+
+// add downloads and verifies upstream, and moves it into dir once it has,
+// replacing anything that was there. Clearsigned scripts are kept with their
+// signature detached, the same way pipethis verified them.
+func (m *mirror) add(ctx context.Context, upstream, dir string) (*mirrorEntry, error) {
+	install, err := newInstall(ctx, m.options, upstream, "")
+	if err != nil {
+		return nil, err
+	}
+	defer install.Remove()
+
+	if err := install.fetch(true, true); err != nil {
+		return nil, err
+	}
+
+	signer, err := install.verify()
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := lockedScript(upstream, install, signer)
+	if err != nil {
+		return nil, err
+	}
+	entry := &mirrorEntry{LockedScript: locked, Verified: time.Now().UTC().Truncate(time.Second)}
+
+	part, err := ioutil.TempDir(m.dir, ".part-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(part)
+
+	if err := copyFile(install.script.Name(), filepath.Join(part, "script")); err != nil {
+		return nil, err
+	}
+	if err := copyFile(install.signature.Name(), filepath.Join(part, "signature")); err != nil {
+		return nil, err
+	}
+
+	contents, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(part, "entry.json"), append(contents, '\n'), 0644); err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(part, dir); err != nil {
+		return nil, err
+	}
+
+	log.Println("Mirrored", upstream, "at SHA-256", entry.SHA256, "signed by", signer)
+	return entry, nil
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// serve is `pipethis serve --mirror <dir> --upstream <location>`.
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		dir       = flags.String("mirror", "", "Directory to keep verified scripts in")
+		listen    = flags.String("listen", ":8080", "Address to serve the mirror on")
+		cert      = flags.String("tls-cert", "", "PEM certificate to serve the mirror with HTTPS")
+		key       = flags.String("tls-key", "", "PEM private key for -tls-cert")
+		maxAge    = flags.Duration("max-age", 0, "Verify mirrored scripts again once they're older than this, like 24h (default never)")
+		upstreams = &stringsFlag{}
+		newVerify = verifyFlags(flags)
+		newClient = clientFlags(flags)
+	)
+	flags.Var(upstreams, "upstream", "Script location to mirror, like https://get.example.com/*. Repeat it for more than one. At least one is required.")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: pipethis serve --mirror <dir> --upstream <location>... [ OPTIONS ]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *dir == "" || flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("serve needs a -mirror directory")
+	}
+	if len(*upstreams) == 0 {
+		flags.Usage()
+		return errors.New("serve needs at least one -upstream location to mirror")
+	}
+	if (*cert == "") != (*key == "") {
+		return errors.New("-tls-cert and -tls-key go together")
+	}
+
+	if _, err := newClient(); err != nil {
+		return err
+	}
+
+	options, err := newVerify()
+	if err != nil {
+		return err
+	}
+	// nobody's around to pick between authors, or watch progress bars, so
+	// the only authors trusted are the ones already in the keyring
+	options.single = true
+	options.serviceName = "pipethis"
+	showProgress = false
+
+	handler, err := newMirror(*dir, options, *upstreams, *maxAge)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Mirroring verified scripts from", *dir, "on", *listen)
+	if *cert != "" {
+		return http.ListenAndServeTLS(*listen, *cert, *key, handler)
+	}
+
+	return http.ListenAndServe(*listen, handler)
+}
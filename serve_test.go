@@ -0,0 +1,198 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ellotheth/pipethis/fetch"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServeTest struct {
+	suite.Suite
+	dir      string
+	options  *verifyOptions
+	client   *fetch.Client
+	upstream *httptest.Server
+	mirror   *httptest.Server
+	files    map[string]string
+}
+
+func (s *ServeTest) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+
+	keyring := filepath.Join(s.dir, "keyring")
+	s.Require().NoError(keys([]string{"add", "-keyring", keyring, "-author", "gemma-ed25519@example.com", "fixtures/ed25519.asc"}))
+
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	newVerify := verifyFlags(flags)
+	s.Require().NoError(flags.Parse([]string{"-lookup-with", "pipethis", "-keyring", keyring}))
+	s.options, err = newVerify()
+	s.Require().NoError(err)
+	s.options.single = true
+	showProgress = false
+
+	s.client = httpClient
+	httpClient, err = fetch.NewClient(fetch.Options{AllowInsecure: true})
+	s.Require().NoError(err)
+
+	s.files = map[string]string{
+		"/install.sh":     "fixtures/signed.ed25519",
+		"/install.sh.sig": "fixtures/signed.ed25519.sig",
+		"/unsigned.sh":    "fixtures/signed.ed25519",
+	}
+	s.upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filename, ok := s.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filename)
+	}))
+
+	handler, err := newMirror(filepath.Join(s.dir, "mirror"), s.options, []string{s.upstream.URL + "/*"}, 0)
+	s.Require().NoError(err)
+	s.mirror = httptest.NewServer(handler)
+}
+
+func (s *ServeTest) TearDownTest() {
+	s.mirror.Close()
+	s.upstream.Close()
+	httpClient = s.client
+	showProgress = true
+	os.RemoveAll(s.dir)
+}
+
+func (s *ServeTest) get(path string) (*http.Response, string) {
+	resp, err := http.Get(s.mirror.URL + path)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	return resp, string(contents)
+}
+
+func (s *ServeTest) TestServesVerifiedScripts() {
+	script, _ := ioutil.ReadFile("fixtures/signed.ed25519")
+	signature, _ := ioutil.ReadFile("fixtures/signed.ed25519.sig")
+
+	resp, contents := s.get("/" + s.upstream.URL + "/install.sh")
+	s.Require().Equal(http.StatusOK, resp.StatusCode, contents)
+	s.Equal(string(script), contents)
+	s.Equal(s.upstream.URL+"/install.sh", resp.Header.Get("X-Pipethis-Source"))
+	s.Equal(formatPGP, resp.Header.Get("X-Pipethis-Format"))
+	s.Equal("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260", resp.Header.Get("X-Pipethis-Signer"))
+	s.Len(resp.Header.Get("X-Pipethis-SHA256"), 64)
+	s.NotEmpty(resp.Header.Get("X-Pipethis-Verified"))
+	s.Equal("/.signature/"+s.upstream.URL+"/install.sh", resp.Header.Get("X-Signature-Url"))
+
+	resp, contents = s.get(resp.Header.Get("X-Signature-Url"))
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.Equal(string(signature), contents)
+
+	// once it's verified, it's there even when upstream isn't
+	s.upstream.Close()
+	resp, contents = s.get("/" + s.upstream.URL + "/install.sh")
+	s.Equal(http.StatusOK, resp.StatusCode)
+	s.Equal(string(script), contents)
+}
+
+func (s *ServeTest) TestMaxAge() {
+	mirror, err := newMirror(filepath.Join(s.dir, "aging"), s.options, []string{s.upstream.URL + "/*"}, time.Nanosecond)
+	s.Require().NoError(err)
+
+	first, _, err := mirror.get(context.Background(), s.upstream.URL+"/install.sh")
+	s.Require().NoError(err)
+	second, _, err := mirror.get(context.Background(), s.upstream.URL+"/install.sh")
+	s.Require().NoError(err)
+	s.Equal(first.SHA256, second.SHA256)
+	s.Empty(mirror.pending)
+
+	// a script that's too old isn't served unless it verifies again
+	s.upstream.Close()
+	_, _, err = mirror.get(context.Background(), s.upstream.URL+"/install.sh")
+	s.Error(err)
+	s.Empty(mirror.pending)
+}
+
+func (s *ServeTest) TestClientsVerifyMirroredScripts() {
+	install, err := newInstall(context.Background(), s.options, s.mirror.URL+"/"+s.upstream.URL+"/install.sh", "")
+	s.Require().NoError(err)
+	defer install.Remove()
+
+	s.Require().NoError(install.fetch(true, true))
+	signer, err := install.verify()
+	s.Require().NoError(err)
+	s.Equal("22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260", signer.Key)
+	s.Equal(s.mirror.URL+"/.signature/"+s.upstream.URL+"/install.sh", install.signature.Source())
+}
+
+func (s *ServeTest) TestOnlyServesVerifiedScripts() {
+	resp, _ := s.get("/" + s.upstream.URL + "/unsigned.sh")
+	s.Equal(http.StatusBadGateway, resp.StatusCode)
+
+	resp, _ = s.get("/.signature/" + s.upstream.URL + "/unsigned.sh")
+	s.Equal(http.StatusBadGateway, resp.StatusCode)
+
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, "mirror"))
+	s.Require().NoError(err)
+	s.Empty(entries)
+
+	for _, path := range []string{"/install.sh", "/file:///etc/passwd", "/git+file:///srv/repo%23main:install.sh", "/http://localhost:1/install.sh", "/https://example.com/install.sh"} {
+		resp, _ = s.get(path)
+		s.Equal(http.StatusBadRequest, resp.StatusCode, path)
+	}
+
+	resp, err = http.Post(s.mirror.URL+"/"+s.upstream.URL+"/install.sh", "text/plain", strings.NewReader(""))
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func (s *ServeTest) TestMirrorUpstream() {
+	allowed := []string{"git+https://example.com/*"}
+	upstream, err := mirrorUpstream("/git+https://example.com/tools.git%23v1:install.sh", "", allowed)
+	s.NoError(err)
+	s.Equal("git+https://example.com/tools.git#v1:install.sh", upstream)
+
+	_, err = mirrorUpstream("/https://example.com/install.sh", "", allowed)
+	s.Error(err)
+
+	upstream, err = mirrorUpstream("/https://example.com/install.sh", "version=2", []string{"https://example.com/*"})
+	s.NoError(err)
+	s.Equal("https://example.com/install.sh?version=2", upstream)
+
+	// without any upstreams, nothing is mirrored
+	for _, path := range []string{"/install.sh", "/https://example.com/install.sh", "/git+https://example.com/tools.git%23v1:install.sh", "/http://example.com/install.sh", "/oci://localhost:5000/team/installers:v1", "/s3://bucket/install.sh"} {
+		_, err = mirrorUpstream(path, "", nil)
+		s.Error(err, path)
+	}
+}
+
+func (s *ServeTest) TestServeNeedsUpstreams() {
+	s.EqualError(serve([]string{"-mirror", filepath.Join(s.dir, "unused")}), "serve needs at least one -upstream location to mirror")
+}
+
+func TestServeTest(t *testing.T) {
+	suite.Run(t, new(ServeTest))
+}
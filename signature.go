@@ -10,17 +10,33 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
-	"golang.org/x/crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ellotheth/pipethis/fetch"
 )
 
-// Signature represents the PGP signature to be verified against a key and
-// Script.
+// The signature formats Signature knows how to verify.
+const (
+	formatPGP      = "pgp"
+	formatSSH      = "ssh"
+	formatSigstore = "sigstore"
+	formatMinisign = "minisign"
+	formatSignify  = "signify"
+)
+
+// Signature represents the PGP, SSH, Sigstore, minisign or signify signature
+// to be verified against a key and Script.
 type Signature struct {
-	key      openpgp.KeyRing
+	trust    Trust
 	script   *Script
 	filename string
 	source   string
@@ -28,58 +44,234 @@ type Signature struct {
 
 // NewSignature loads a key ring and Script into a new Signature.
 func NewSignature(key openpgp.KeyRing, script *Script, source string) *Signature {
-	sig := &Signature{key: key, script: script, source: source}
+	sig := &Signature{trust: Trust{PGPKeys: key}, script: script, source: source}
 	sig.filename = script.Name() + ".sig"
 
 	return sig
 }
 
+// UseKey sets the PGP key ring to verify the signature with.
+func (s *Signature) UseKey(key openpgp.KeyRing) {
+	s.trust.PGPKeys = key
+}
+
+// UseSSHSigners sets the SSH keys that are allowed to sign the script, and the
+// namespace the signature has to be made in.
+func (s *Signature) UseSSHSigners(signers []sshSigner, namespace string) {
+	s.trust.SSHSigners = signers
+	s.trust.SSHNamespace = namespace
+}
+
+// UseSigstore sets the trust roots and expected identity to verify a Sigstore
+// bundle with.
+func (s *Signature) UseSigstore(trust *sigstoreTrust) {
+	s.trust.Sigstore = trust
+}
+
+// UseMinisignKeys sets the minisign or signify public keys to verify the
+// signature with.
+func (s *Signature) UseMinisignKeys(keys []*minisignKey) {
+	s.trust.MinisignKeys = keys
+}
+
 // Name is the name of the temporary file holding the signature.
 func (s Signature) Name() string {
 	return s.filename
 }
 
-// Source is the original location of the signature file. It defaults to
-// <script source>.sig.
+// signatureExtensions are tacked onto the script location to find its
+// signature, in order.
+var signatureExtensions = []string{".sig", ".asc", ".sigstore.json", ".minisig"}
+
+// Source is the original location of the signature file. It defaults to the
+// first of the default locations.
 func (s *Signature) Source() string {
-	if s.source != "" || s.script == nil || s.script.IsClearsigned() || s.script.IsPiped() {
+	if !s.defaulted() || s.script.IsClearsigned() {
 		return s.source
 	}
 
-	s.source = s.script.Source() + ".sig"
+	return s.defaults()[0]
+}
+
+// defaulted is true if Download has to look for the signature.
+func (s *Signature) defaulted() bool {
+	return s.source == "" && s.script != nil && !s.script.IsPiped()
+}
+
+// defaults are the locations to look for the signature when it wasn't set:
+// anywhere the script's response headers point to, then the signature
+// extensions on where the script was downloaded from after redirects.
+func (s *Signature) defaults() []string {
+	locations := signatureLinks(s.script.Resolved(), s.script.Header())
+	for _, extension := range signatureExtensions {
+		locations = appendMissing(locations, s.script.Resolved()+extension)
+	}
+
+	return locations
+}
 
-	return s.source
+// candidates are the locations Download tries, in order. If the source was
+// set, it's the only one.
+func (s *Signature) candidates() []string {
+	if s.defaulted() {
+		return s.defaults()
+	}
+
+	return []string{s.source}
 }
 
-// Download saves the signature to a temporary file.
+// signatureLinks finds the signature locations in the X-Signature-URL and
+// `Link: <...>; rel="signature"` headers, relative to base. Links have to use
+// base's scheme, so a server can't point pipethis at local files, git
+// repositories or anywhere else it shouldn't be able to reach.
+func signatureLinks(base string, header http.Header) []string {
+	links := []string{}
+	links = append(links, header["X-Signature-Url"]...)
+
+	for _, value := range header["Link"] {
+		for _, link := range strings.Split(value, ",") {
+			link = strings.TrimSpace(link)
+			end := strings.Index(link, ">")
+			if !strings.HasPrefix(link, "<") || end < 0 {
+				continue
+			}
+
+			for _, param := range strings.Split(link[end+1:], ";") {
+				parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), "rel") {
+					continue
+				}
+
+				for _, rel := range strings.Fields(strings.Trim(parts[1], `"`)) {
+					if strings.EqualFold(rel, "signature") {
+						links = append(links, link[1:end])
+					}
+				}
+			}
+		}
+	}
+
+	resolved := []string{}
+	parsed, err := url.Parse(base)
+	if err != nil || !parsed.IsAbs() {
+		return resolved
+	}
+
+	for _, link := range links {
+		target, err := url.Parse(strings.TrimSpace(link))
+		if err != nil {
+			continue
+		}
+
+		target = parsed.ResolveReference(target)
+		if !strings.EqualFold(target.Scheme, parsed.Scheme) {
+			continue
+		}
+		resolved = appendMissing(resolved, target.String())
+	}
+
+	return resolved
+}
+
+func appendMissing(list []string, value string) []string {
+	for _, existing := range list {
+		if existing == value {
+			return list
+		}
+	}
+
+	return append(list, value)
+}
+
+// Download saves the signature to a temporary file. When it's looking in the
+// default locations, it skips anything that doesn't look like a signature
+// (like a "404 Not Found" page).
 func (s *Signature) Download() error {
 	if s.script != nil && s.script.IsClearsigned() {
 		return nil
 	}
 
-	source := s.Source()
-	if source == "" {
+	if err := s.fetch(context.Background()); err != nil {
+		return err
+	}
+
+	return s.commit()
+}
+
+// fetch is the first half of Download. It saves the signature next to
+// Signature.Name() instead of in it, so it can run while the script is still
+// downloading, before anyone knows whether the script has its own signature
+// attached. It stops when ctx is cancelled.
+func (s *Signature) fetch(ctx context.Context) error {
+	candidates := s.candidates()
+	if candidates[0] == "" {
 		return errors.New("The signature source location is missing")
 	}
 
-	body, err := getFile(source)
+	for _, source := range candidates {
+		if err := s.downloadFrom(ctx, source); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if len(candidates) == 1 || sniffFile(s.fetched()) != "" {
+			s.source = source
+			return nil
+		}
+	}
+
+	os.Remove(s.fetched())
+	return errors.New("Couldn't open the signature source file at " + strings.Join(candidates, " or "))
+}
+
+// commit is the second half of Download: it moves the fetched signature into
+// place, or throws it away if the script turned out to be clearsigned.
+func (s *Signature) commit() error {
+	if s.script != nil && s.script.IsClearsigned() {
+		os.Remove(s.fetched())
+		return nil
+	}
+
+	return os.Rename(s.fetched(), s.Name())
+}
+
+func (s Signature) fetched() string {
+	return s.Name() + ".fetched"
+}
+
+// downloadFrom saves the signature at source to a .part file, and only
+// renames it once all of it has been read.
+func (s *Signature) downloadFrom(ctx context.Context, source string) error {
+	if s.Name() == "" {
+		return errors.New("The signature has nowhere to be saved")
+	}
+
+	// the signature downloads alongside the script, and two progress bars
+	// would draw over each other
+	resource, err := getFile(ctx, source, false)
 	if err != nil {
-		return errors.New("Couldn't open the signature source file at " + source)
+		return err
 	}
-	defer body.Close()
+	defer resource.Body.Close()
 
-	file, err := os.Create(s.Name())
+	file, err := os.Create(s.fetched() + ".part")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
-	_, err = io.Copy(file, body)
-	if err != nil {
-		return nil
+	if _, err := io.Copy(file, fetch.LimitReader(resource.Body, httpClient.MaxBodySize())); err != nil {
+		return err
 	}
 
-	return nil
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), s.fetched())
 }
 
 // Body opens Signature.Name() for reading, downloading it first if necessary.
@@ -99,29 +291,107 @@ func (s *Signature) Body() (ReadSeekCloser, error) {
 	return os.Open(s.Name())
 }
 
-// Verify checks Signature.Name() against the public key and script file, and
-// returns an error if the signature cannot be verified.
+// Format reads Signature.Body() to work out what kind of signature it is:
+// formatSSH for `ssh-keygen -Y sign` signatures, formatSigstore for Sigstore
+// bundles, formatMinisign and formatSignify for minisign and signify
+// signatures, and formatPGP for everything else.
+func (s *Signature) Format() (string, error) {
+	signature, err := s.Body()
+	if err != nil {
+		return "", err
+	}
+	signature.Close()
+
+	if format := s.sniff(); format != "" {
+		return format, nil
+	}
+
+	return formatPGP, nil
+}
+
+// sniff looks at the start of Signature.Name() for the marks of each format
+// it knows, and returns an empty string if it doesn't find any.
+func (s *Signature) sniff() string {
+	return sniffFile(s.Name())
+}
+
+// sniffFile is sniff for any file.
+func sniffFile(filename string) string {
+	signature, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer signature.Close()
+
+	header := make([]byte, 1024)
+	n, _ := io.ReadFull(signature, header)
+	header = header[:n]
+
+	switch {
+	case n == 0:
+		return ""
+	case bytes.Contains(header, []byte("-----BEGIN SSH SIGNATURE-----")):
+		return formatSSH
+	case bytes.Contains(header, []byte("-----BEGIN PGP SIGNATURE-----")):
+		return formatPGP
+	case bytes.HasPrefix(header, []byte("untrusted comment:")):
+		// minisign signatures have a trusted comment too, signify's don't
+		if bytes.Contains(header, []byte("\ntrusted comment:")) {
+			return formatMinisign
+		}
+		return formatSignify
+	case bytes.HasPrefix(bytes.TrimSpace(header), []byte("{")) && bytes.Contains(header, []byte("application/vnd.dev.sigstore.bundle")):
+		return formatSigstore
+	case header[0]&0x80 != 0:
+		// binary OpenPGP packets always have the high bit set
+		return formatPGP
+	}
+
+	return ""
+}
+
+// Verify checks Signature.Name() against the script file with the Verifier
+// for its format, and returns an error if the signature cannot be verified.
 func (s *Signature) Verify() error {
-	signed, err := s.script.Body()
+	format, err := s.Format()
 	if err != nil {
 		return err
 	}
-	defer signed.Close()
 
-	signature, err := s.Body()
+	verifier, err := VerifierFor(format)
 	if err != nil {
 		return err
 	}
-	defer signature.Close()
 
-	if _, err := openpgp.CheckDetachedSignature(s.key, signed, signature); err == nil {
-		return nil
+	_, err = s.VerifyWith(verifier)
+	return err
+}
+
+// VerifyWith checks Signature.Name() against the script file with verifier,
+// and returns who signed it. The script author is the expected signer for
+// formats that need one.
+func (s *Signature) VerifyWith(verifier Verifier) (Signer, error) {
+	signed, err := s.script.Body()
+	if err != nil {
+		return Signer{}, err
 	}
+	defer signed.Close()
 
-	signature.Seek(0, 0) // i'm sure there's a good reason i don't need to reset the script...
-	if _, err := openpgp.CheckArmoredDetachedSignature(s.key, signed, signature); err == nil {
-		return nil
+	body, err := s.Body()
+	if err != nil {
+		return Signer{}, err
+	}
+	defer body.Close()
+
+	signature, err := ioutil.ReadAll(body)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	trust := s.trust
+	if trust.Author == "" {
+		trust.Author, _ = s.script.Author()
 	}
 
-	return errors.New("Failed to verify signature")
+	return verifier.Verify(signed, signature, trust)
 }
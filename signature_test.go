@@ -10,8 +10,12 @@ the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
 package main
 
 import (
+	"context"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -87,6 +91,133 @@ func (s *SigTest) TestDownloadCopiesFile() {
 	s.Equal(expected, actual)
 }
 
+func (s *SigTest) TestDownloadSkipsDefaultsThatArentSignatures() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	script := filepath.Join(dir, "install.sh")
+	ioutil.WriteFile(script+".sig", []byte("<html>404 Not Found</html>"), os.ModePerm)
+	ioutil.WriteFile(script+".sigstore.json", []byte(`{"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json"}`), os.ModePerm)
+
+	sig := Signature{script: &Script{source: script}, filename: filepath.Join(dir, "destination")}
+	s.NoError(sig.Download())
+	s.Equal(script+".sigstore.json", sig.Source())
+
+	format, err := sig.Format()
+	s.NoError(err)
+	s.Equal(formatSigstore, format)
+
+	os.Remove(script + ".sigstore.json")
+	sig = Signature{script: &Script{source: script}, filename: filepath.Join(dir, "destination")}
+	s.Error(sig.Download())
+}
+
+func (s *SigTest) TestFetchedSignatureIsDroppedForClearsignedScripts() {
+	dir, err := ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.RemoveAll(dir)
+
+	script := &Script{source: filepath.Join(dir, "install.sh"), filename: filepath.Join(dir, "saved")}
+	ioutil.WriteFile(script.source+".sig", []byte("-----BEGIN PGP SIGNATURE-----"), os.ModePerm)
+
+	sig := NewSignature(nil, script, "")
+	s.NoError(sig.fetch(context.Background()))
+	s.FileExists(sig.fetched())
+	s.NoFileExists(sig.Name())
+
+	// the script turns out to have its own signature
+	script.clearsigned = true
+	s.NoError(sig.commit())
+	s.NoFileExists(sig.fetched())
+	s.NoFileExists(sig.Name())
+
+	script.clearsigned = false
+	s.NoError(sig.fetch(context.Background()))
+	s.NoError(sig.commit())
+	s.FileExists(sig.Name())
+	s.Equal(script.source+".sig", sig.Source())
+}
+
+func (s *SigTest) TestScriptAndSignatureFromFileURLs() {
+	abs, err := filepath.Abs("fixtures/signed.ed25519")
+	s.Require().NoError(err)
+
+	script, err := NewScript("file://" + abs)
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+
+	sig := NewSignature(nil, script, "")
+	defer os.Remove(sig.Name())
+	s.Require().NoError(sig.Download())
+	s.Equal("file://"+abs+".sig", sig.Source())
+
+	format, err := sig.Format()
+	s.NoError(err)
+	s.Equal(formatPGP, format)
+}
+
+func (s *SigTest) TestFetchStopsWhenCancelled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sig := NewSignature(nil, &Script{source: "https://get.example.com/install.sh", filename: "saved"}, "")
+	s.Equal(context.Canceled, sig.fetch(ctx))
+}
+
+func (s *SigTest) TestCandidatesFollowRedirectsAndHeaders() {
+	header := http.Header{}
+	header.Set("X-Signature-URL", "https://sigs.example.com/install.sh.sig")
+	header.Add("Link", `<https://example.com/style.css>; rel="stylesheet", </signatures/install.sh.minisig>; rel="alternate signature"`)
+
+	script := &Script{source: "https://get.example.com", resolved: "https://cdn.example.com/v2/install.sh", header: header}
+	sig := Signature{script: script}
+
+	s.Equal([]string{
+		"https://sigs.example.com/install.sh.sig",
+		"https://cdn.example.com/signatures/install.sh.minisig",
+		"https://cdn.example.com/v2/install.sh.sig",
+		"https://cdn.example.com/v2/install.sh.asc",
+		"https://cdn.example.com/v2/install.sh.sigstore.json",
+		"https://cdn.example.com/v2/install.sh.minisig",
+	}, sig.candidates())
+	s.Equal("https://sigs.example.com/install.sh.sig", sig.Source())
+
+	sig = Signature{script: script, source: "mine.sig"}
+	s.Equal([]string{"mine.sig"}, sig.candidates())
+}
+
+func (s *SigTest) TestSignatureLinksIgnoresOtherHeaders() {
+	header := http.Header{}
+	header.Add("Link", `<https://example.com/next>; rel="next"`)
+	header.Add("Link", `not a link; rel=signature`)
+	s.Empty(signatureLinks("https://example.com/install.sh", header))
+
+	header.Add("Link", `<install.sh.asc>; rel=signature`)
+	s.Equal([]string{"https://example.com/install.sh.asc"}, signatureLinks("https://example.com/install.sh", header))
+}
+
+func (s *SigTest) TestSignatureLinksStayOnTheScriptsScheme() {
+	header := http.Header{}
+	header.Add("X-Signature-URL", "file:///dev/stdin")
+	header.Add("X-Signature-URL", "git+ssh://git@example.com/sigs.git#main:install.sh.sig")
+	header.Add("X-Signature-URL", "s3://bucket/install.sh.sig")
+	header.Add("Link", `<http://example.com/install.sh.sig>; rel=signature`)
+	s.Empty(signatureLinks("https://example.com/install.sh", header))
+
+	script := &Script{source: "https://get.example.com/install.sh", resolved: "https://get.example.com/install.sh", header: header}
+	for _, candidate := range (&Signature{script: script}).candidates() {
+		s.True(strings.HasPrefix(candidate, "https://get.example.com/"), candidate)
+	}
+
+	header = http.Header{}
+	header.Add("X-Signature-URL", "oci://registry.example.com/team/installers@sha256:abc")
+	s.Equal([]string{"oci://registry.example.com/team/installers@sha256:abc"}, signatureLinks("oci://registry.example.com/team/installers@sha256:def", header))
+
+	// without a base to compare them to, there aren't any links
+	s.Empty(signatureLinks("", header))
+}
+
 func (s *SigTest) TestBodyFailsWithoutFiles() {
 	sig := Signature{}
 	_, err := sig.Body()
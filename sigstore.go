@@ -0,0 +1,593 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Fulcio certificate extensions that hold the OIDC issuer. The first is
+// the original raw string; the second is DER-encoded.
+var (
+	oidFulcioIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidFulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// sigstoreBundle is the part of a Sigstore bundle (the .sigstore.json file
+// `cosign sign-blob --bundle` writes) that pipethis needs to verify a blob
+// signature offline.
+type sigstoreBundle struct {
+	MediaType            string `json:"mediaType"`
+	VerificationMaterial struct {
+		Certificate *struct {
+			RawBytes []byte `json:"rawBytes"`
+		} `json:"certificate"`
+		X509CertificateChain *struct {
+			Certificates []struct {
+				RawBytes []byte `json:"rawBytes"`
+			} `json:"certificates"`
+		} `json:"x509CertificateChain"`
+		TlogEntries []sigstoreTlogEntry `json:"tlogEntries"`
+	} `json:"verificationMaterial"`
+	MessageSignature *struct {
+		MessageDigest struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+}
+
+// sigstoreTlogEntry is a Rekor transparency log entry, with the proof that it
+// was included in the log.
+type sigstoreTlogEntry struct {
+	LogIndex int64 `json:"logIndex,string"`
+	LogID    struct {
+		KeyID []byte `json:"keyId"`
+	} `json:"logId"`
+	KindVersion struct {
+		Kind    string `json:"kind"`
+		Version string `json:"version"`
+	} `json:"kindVersion"`
+	IntegratedTime   int64 `json:"integratedTime,string"`
+	InclusionPromise *struct {
+		SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+	} `json:"inclusionPromise"`
+	InclusionProof *struct {
+		LogIndex   int64    `json:"logIndex,string"`
+		RootHash   []byte   `json:"rootHash"`
+		TreeSize   int64    `json:"treeSize,string"`
+		Hashes     [][]byte `json:"hashes"`
+		Checkpoint struct {
+			Envelope string `json:"envelope"`
+		} `json:"checkpoint"`
+	} `json:"inclusionProof"`
+	CanonicalizedBody []byte `json:"canonicalizedBody"`
+}
+
+// hashedRekord is the body of a hashedrekord v0.0.1 Rekor entry.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// sigstoreTrust is everything a Sigstore bundle is checked against: the
+// Fulcio certificate roots, the Rekor log keys, and the identity and issuer
+// the signing certificate has to have.
+type sigstoreTrust struct {
+	roots         []*x509.Certificate
+	intermediates []*x509.Certificate
+	rekorKeys     map[string]crypto.PublicKey
+	identity      string
+	issuer        string
+}
+
+// newSigstoreTrust loads the Fulcio roots and Rekor public keys from local PEM
+// files.
+func newSigstoreTrust(fulcioRoots []string, rekorKeys []string, identity string, issuer string) (*sigstoreTrust, error) {
+	trust := &sigstoreTrust{
+		rekorKeys: map[string]crypto.PublicKey{},
+		identity:  identity,
+		issuer:    issuer,
+	}
+
+	for _, filename := range fulcioRoots {
+		blocks, err := readPEM(filename, "CERTIFICATE")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			cert, err := x509.ParseCertificate(block)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+
+			// self-signed certificates are roots, everything else is an
+			// intermediate
+			if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+				trust.roots = append(trust.roots, cert)
+			} else {
+				trust.intermediates = append(trust.intermediates, cert)
+			}
+		}
+	}
+
+	for _, filename := range rekorKeys {
+		blocks, err := readPEM(filename, "PUBLIC KEY")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			key, err := x509.ParsePKIXPublicKey(block)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+
+			id := sha256.Sum256(block)
+			trust.rekorKeys[string(id[:])] = key
+		}
+	}
+
+	if len(trust.roots) == 0 {
+		return nil, errors.New("No Fulcio root certificates configured")
+	}
+	if len(trust.rekorKeys) == 0 {
+		return nil, errors.New("No Rekor public keys configured")
+	}
+
+	return trust, nil
+}
+
+// readPEM reads all the PEM blocks of type kind from filename.
+func readPEM(filename string, kind string) ([][]byte, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := [][]byte{}
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			break
+		}
+		if block.Type == kind {
+			blocks = append(blocks, block.Bytes)
+		}
+	}
+
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s: no %s found", filename, kind)
+	}
+
+	return blocks, nil
+}
+
+// parseSigstoreBundle decodes a Sigstore bundle. Only message signature
+// bundles are supported, not DSSE attestations.
+func parseSigstoreBundle(contents []byte) (*sigstoreBundle, error) {
+	bundle := &sigstoreBundle{}
+	if err := json.Unmarshal(contents, bundle); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(bundle.MediaType, "application/vnd.dev.sigstore.bundle") {
+		return nil, errors.New("Not a Sigstore bundle")
+	}
+	if bundle.MessageSignature == nil {
+		return nil, errors.New("Only Sigstore bundles with a message signature are supported")
+	}
+
+	return bundle, nil
+}
+
+// certificates returns the signing certificate, followed by any intermediates
+// bundled with it.
+func (b sigstoreBundle) certificates() ([]*x509.Certificate, error) {
+	raw := [][]byte{}
+
+	switch {
+	case b.VerificationMaterial.Certificate != nil:
+		raw = append(raw, b.VerificationMaterial.Certificate.RawBytes)
+	case b.VerificationMaterial.X509CertificateChain != nil:
+		for _, cert := range b.VerificationMaterial.X509CertificateChain.Certificates {
+			raw = append(raw, cert.RawBytes)
+		}
+	}
+
+	if len(raw) == 0 {
+		return nil, errors.New("The Sigstore bundle doesn't have a signing certificate")
+	}
+
+	certs := []*x509.Certificate{}
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// verify checks the bundle against artifact, and returns the identity of the
+// signing certificate. Everything is checked offline: the certificate chains
+// up to a trusted Fulcio root, the signature matches the artifact, and the
+// Rekor entry for the signature is included in a log checkpoint signed by a
+// trusted Rekor key.
+func (b sigstoreBundle) verify(artifact io.Reader, trust *sigstoreTrust) (string, error) {
+	if trust.identity == "" || trust.issuer == "" {
+		return "", errors.New("The expected Sigstore identity and issuer are missing; set them in the policy")
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, artifact); err != nil {
+		return "", err
+	}
+	digest := h.Sum(nil)
+
+	certs, err := b.certificates()
+	if err != nil {
+		return "", err
+	}
+	leaf := certs[0]
+
+	if len(b.VerificationMaterial.TlogEntries) == 0 {
+		return "", errors.New("The Sigstore bundle doesn't have a transparency log entry")
+	}
+	entry := b.VerificationMaterial.TlogEntries[0]
+
+	signature := b.MessageSignature.Signature
+	if len(b.MessageSignature.MessageDigest.Digest) > 0 && !bytes.Equal(b.MessageSignature.MessageDigest.Digest, digest) {
+		return "", errors.New("The Sigstore bundle is for a different file")
+	}
+	if err := verifyDigestSignature(leaf.PublicKey, digest, signature); err != nil {
+		return "", err
+	}
+
+	if err := entry.verify(leaf, digest, signature, trust); err != nil {
+		return "", err
+	}
+
+	// the certificate only lives for a few minutes, so it has to have been
+	// valid when the signature was logged
+	signed, err := entry.signedTime(trust)
+	if err != nil {
+		return "", err
+	}
+
+	roots := x509.NewCertPool()
+	for _, cert := range trust.roots {
+		roots.AddCert(cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range trust.intermediates {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signed,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return "", errors.New("The Sigstore certificate isn't trusted: " + err.Error())
+	}
+
+	identity, err := checkIdentity(leaf, trust.identity, trust.issuer)
+	if err != nil {
+		return "", err
+	}
+
+	return identity, nil
+}
+
+// verifyDigestSignature checks a signature made over a SHA-256 digest with an
+// ECDSA or RSA key. Ed25519 can't sign a prehashed digest, so it isn't
+// supported.
+func verifyDigestSignature(key crypto.PublicKey, digest []byte, signature []byte) error {
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(pub, digest, signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature) == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		return errors.New("Ed25519 Sigstore signatures aren't supported")
+	default:
+		return errors.New("Unsupported Sigstore key type")
+	}
+
+	return errors.New("Failed to verify Sigstore signature")
+}
+
+// signedTime is when the log took the entry in, once verify has checked the
+// entry's inclusion proof. If the entry has an inclusion promise (a signed
+// entry timestamp), it has to be signed by a trusted Rekor key.
+func (e sigstoreTlogEntry) signedTime(trust *sigstoreTrust) (time.Time, error) {
+	if e.InclusionPromise == nil {
+		return time.Unix(e.IntegratedTime, 0), nil
+	}
+
+	key, ok := trust.rekorKeys[string(e.LogID.KeyID)]
+	if !ok {
+		return time.Time{}, errors.New("The Rekor entry is from an untrusted log")
+	}
+	if !verifyMessageSignature(key, e.promised(), e.InclusionPromise.SignedEntryTimestamp) {
+		return time.Time{}, errors.New("The Rekor entry's timestamp isn't signed by a trusted key")
+	}
+
+	return time.Unix(e.IntegratedTime, 0), nil
+}
+
+// promised is the canonical JSON a signed entry timestamp is made over.
+func (e sigstoreTlogEntry) promised() []byte {
+	return []byte(fmt.Sprintf(`{"body":"%s","integratedTime":%d,"logID":"%s","logIndex":%d}`,
+		base64.StdEncoding.EncodeToString(e.CanonicalizedBody), e.IntegratedTime, hex.EncodeToString(e.LogID.KeyID), e.LogIndex))
+}
+
+// verify checks that the log entry records this signature, and that the entry
+// is in a log checkpoint signed by a trusted Rekor key.
+func (e sigstoreTlogEntry) verify(leaf *x509.Certificate, digest []byte, signature []byte, trust *sigstoreTrust) error {
+	if e.KindVersion.Kind != "hashedrekord" {
+		return errors.New("Unsupported Rekor entry kind " + e.KindVersion.Kind)
+	}
+
+	body := hashedRekord{}
+	if err := json.Unmarshal(e.CanonicalizedBody, &body); err != nil {
+		return err
+	}
+
+	cert, _ := pem.Decode(body.Spec.Signature.PublicKey.Content)
+	switch {
+	case body.Spec.Data.Hash.Algorithm != "sha256" || body.Spec.Data.Hash.Value != hex.EncodeToString(digest):
+		return errors.New("The Rekor entry is for a different file")
+	case !bytes.Equal(body.Spec.Signature.Content, signature):
+		return errors.New("The Rekor entry is for a different signature")
+	case cert == nil || !bytes.Equal(cert.Bytes, leaf.Raw):
+		return errors.New("The Rekor entry is for a different certificate")
+	}
+
+	key, ok := trust.rekorKeys[string(e.LogID.KeyID)]
+	if !ok {
+		return errors.New("The Rekor entry is from an untrusted log")
+	}
+
+	proof := e.InclusionProof
+	if proof == nil {
+		return errors.New("The Sigstore bundle doesn't have a Rekor inclusion proof")
+	}
+
+	leafHash := sha256.Sum256(append([]byte{0}, e.CanonicalizedBody...))
+	if err := verifyInclusion(proof.LogIndex, proof.TreeSize, leafHash[:], proof.Hashes, proof.RootHash); err != nil {
+		return err
+	}
+
+	size, root, err := verifyCheckpoint(proof.Checkpoint.Envelope, key)
+	if err != nil {
+		return err
+	}
+	if size != proof.TreeSize || !bytes.Equal(root, proof.RootHash) {
+		return errors.New("The Rekor checkpoint doesn't match the inclusion proof")
+	}
+
+	return nil
+}
+
+// verifyInclusion checks a Merkle tree inclusion proof, as described in RFC
+// 9162 section 2.1.3.2.
+func verifyInclusion(index int64, size int64, leafHash []byte, proof [][]byte, root []byte) error {
+	if index < 0 || index >= size {
+		return errors.New("The Rekor inclusion proof index is out of range")
+	}
+
+	node := func(left, right []byte) []byte {
+		h := sha256.New()
+		h.Write([]byte{1})
+		h.Write(left)
+		h.Write(right)
+		return h.Sum(nil)
+	}
+
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return errors.New("The Rekor inclusion proof is too long")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = node(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = node(r, p)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || !bytes.Equal(r, root) {
+		return errors.New("The Rekor inclusion proof doesn't match the log root")
+	}
+
+	return nil
+}
+
+// verifyCheckpoint checks a Rekor checkpoint (a signed note) with key, and
+// returns the tree size and root hash it vouches for.
+func verifyCheckpoint(envelope string, key crypto.PublicKey) (int64, []byte, error) {
+	split := strings.Index(envelope, "\n\n")
+	if split < 0 {
+		return 0, nil, errors.New("Invalid Rekor checkpoint")
+	}
+	text := envelope[:split+1]
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	id := sha256.Sum256(der)
+
+	verified := false
+	for _, line := range strings.Split(envelope[split+2:], "\n") {
+		if !strings.HasPrefix(line, "— ") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		sig, err := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+		if err != nil || len(sig) < 5 || !bytes.Equal(sig[:4], id[:4]) {
+			continue
+		}
+
+		if verifyMessageSignature(key, []byte(text), sig[4:]) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return 0, nil, errors.New("The Rekor checkpoint isn't signed by a trusted key")
+	}
+
+	// origin, tree size, root hash, then optional extensions
+	lines := strings.Split(text, "\n")
+	if len(lines) < 3 {
+		return 0, nil, errors.New("Invalid Rekor checkpoint")
+	}
+
+	size, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil {
+		return 0, nil, errors.New("Invalid Rekor checkpoint tree size")
+	}
+
+	root, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil {
+		return 0, nil, errors.New("Invalid Rekor checkpoint root hash")
+	}
+
+	return size, root, nil
+}
+
+// verifyMessageSignature checks a signature over message made by key.
+func verifyMessageSignature(key crypto.PublicKey, message []byte, signature []byte) bool {
+	digest := sha256.Sum256(message)
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, message, signature)
+	}
+
+	return false
+}
+
+// checkIdentity makes sure the certificate was issued to identity (an email
+// address or URI) by the OIDC issuer.
+func checkIdentity(cert *x509.Certificate, identity string, issuer string) (string, error) {
+	actualIssuer := ""
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidFulcioIssuerV2):
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &actualIssuer, "utf8"); err != nil {
+				return "", err
+			}
+		case ext.Id.Equal(oidFulcioIssuer) && actualIssuer == "":
+			actualIssuer = string(ext.Value)
+		}
+	}
+
+	if actualIssuer != issuer {
+		return "", fmt.Errorf("The Sigstore certificate was issued by %q, not %q", actualIssuer, issuer)
+	}
+
+	identities := append([]string{}, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	for _, actual := range identities {
+		if actual == identity {
+			return actual, nil
+		}
+	}
+
+	return "", fmt.Errorf("The Sigstore certificate belongs to %s, not %s", strings.Join(identities, ", "), identity)
+}
+
+// sigstoreVerifier checks Sigstore bundles, and returns the identity of the
+// certificate that signed them.
+type sigstoreVerifier struct{}
+
+func (sigstoreVerifier) Verify(artifact io.Reader, signature []byte, trust Trust) (Signer, error) {
+	if trust.Sigstore == nil {
+		return Signer{}, errors.New("No Sigstore trust roots configured")
+	}
+
+	bundle, err := parseSigstoreBundle(signature)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	identity, err := bundle.verify(artifact, trust.Sigstore)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	return Signer{Key: identity}, nil
+}
@@ -0,0 +1,429 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SigstoreTest struct {
+	suite.Suite
+	dir      string
+	artifact []byte
+	caKey    *ecdsa.PrivateKey
+	ca       *x509.Certificate
+	rekorKey *ecdsa.PrivateKey
+	trust    *sigstoreTrust
+}
+
+// SetupSuite plays Fulcio and Rekor: a CA that issues signing certificates,
+// and a log key that signs checkpoints. Their public halves are written to
+// files, the way pipethis would load the real ones.
+func (s *SigstoreTest) SetupSuite() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "pipethis-test-")
+	s.Require().NoError(err)
+
+	s.artifact = []byte("#!/bin/sh\necho hello\n")
+
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sigstore"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	s.Require().NoError(err)
+	s.ca, err = x509.ParseCertificate(der)
+	s.Require().NoError(err)
+	s.writePEM("fulcio.pem", "CERTIFICATE", der)
+
+	s.rekorKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	der, err = x509.MarshalPKIXPublicKey(&s.rekorKey.PublicKey)
+	s.Require().NoError(err)
+	s.writePEM("rekor.pub", "PUBLIC KEY", der)
+
+	s.trust, err = newSigstoreTrust(
+		[]string{filepath.Join(s.dir, "fulcio.pem")},
+		[]string{filepath.Join(s.dir, "rekor.pub")},
+		"gemma@example.com",
+		"https://accounts.example.com",
+	)
+	s.Require().NoError(err)
+}
+
+func (s *SigstoreTest) TearDownSuite() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *SigstoreTest) writePEM(name string, kind string, der []byte) {
+	contents := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(s.dir, name), contents, 0644))
+}
+
+// leaf issues a short-lived signing certificate for email from issuer.
+func (s *SigstoreTest) leaf(email string, issuer string, signed time.Time) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+
+	issuerValue, err := asn1.MarshalWithParams(issuer, "utf8")
+	s.Require().NoError(err)
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       signed.Add(-time.Minute),
+		NotAfter:        signed.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{email},
+		ExtraExtensions: []pkix.Extension{{Id: oidFulcioIssuerV2, Value: issuerValue}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, &key.PublicKey, s.caKey)
+	s.Require().NoError(err)
+
+	return key, der
+}
+
+// bundle signs artifact with a fresh certificate, logs it at index 3 of a
+// five-entry Rekor log, and returns the bundle.
+func (s *SigstoreTest) bundle(artifact []byte, email string, issuer string) *sigstoreBundle {
+	signed := time.Now().Add(-time.Hour)
+	key, cert := s.leaf(email, issuer, signed)
+
+	digest := sha256.Sum256(artifact)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	s.Require().NoError(err)
+
+	body := hashedRekord{Kind: "hashedrekord"}
+	body.Spec.Data.Hash.Algorithm = "sha256"
+	body.Spec.Data.Hash.Value = hex.EncodeToString(digest[:])
+	body.Spec.Signature.Content = signature
+	body.Spec.Signature.PublicKey.Content = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	canonical, err := json.Marshal(body)
+	s.Require().NoError(err)
+
+	leaves := [][]byte{}
+	for i := 0; i < 5; i++ {
+		entry := []byte(fmt.Sprintf("entry %d", i))
+		if i == 3 {
+			entry = canonical
+		}
+		hash := sha256.Sum256(append([]byte{0}, entry...))
+		leaves = append(leaves, hash[:])
+	}
+	root := merkleRoot(leaves)
+
+	der, err := x509.MarshalPKIXPublicKey(&s.rekorKey.PublicKey)
+	s.Require().NoError(err)
+	logID := sha256.Sum256(der)
+
+	b := &sigstoreBundle{MediaType: "application/vnd.dev.sigstore.bundle.v0.3+json"}
+	b.VerificationMaterial.Certificate = &struct {
+		RawBytes []byte `json:"rawBytes"`
+	}{cert}
+
+	entry := sigstoreTlogEntry{
+		LogIndex:          3,
+		IntegratedTime:    signed.Unix(),
+		CanonicalizedBody: canonical,
+	}
+	entry.LogID.KeyID = logID[:]
+	entry.KindVersion.Kind = "hashedrekord"
+	entry.KindVersion.Version = "0.0.1"
+	entry.InclusionProof = &struct {
+		LogIndex   int64    `json:"logIndex,string"`
+		RootHash   []byte   `json:"rootHash"`
+		TreeSize   int64    `json:"treeSize,string"`
+		Hashes     [][]byte `json:"hashes"`
+		Checkpoint struct {
+			Envelope string `json:"envelope"`
+		} `json:"checkpoint"`
+	}{LogIndex: 3, RootHash: root, TreeSize: 5, Hashes: merklePath(3, leaves)}
+	entry.InclusionProof.Checkpoint.Envelope = s.checkpoint(s.rekorKey, 5, root)
+	s.promise(&entry, s.rekorKey)
+	b.VerificationMaterial.TlogEntries = []sigstoreTlogEntry{entry}
+
+	b.MessageSignature = &struct {
+		MessageDigest struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	}{Signature: signature}
+	b.MessageSignature.MessageDigest.Algorithm = "SHA2_256"
+	b.MessageSignature.MessageDigest.Digest = digest[:]
+
+	return b
+}
+
+// promise signs the entry's timestamp with key, the way Rekor does.
+func (s *SigstoreTest) promise(entry *sigstoreTlogEntry, key *ecdsa.PrivateKey) {
+	digest := sha256.Sum256(entry.promised())
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	s.Require().NoError(err)
+
+	entry.InclusionPromise = &struct {
+		SignedEntryTimestamp []byte `json:"signedEntryTimestamp"`
+	}{signature}
+}
+
+// checkpoint makes a signed note for a tree of size with root, signed by key.
+func (s *SigstoreTest) checkpoint(key *ecdsa.PrivateKey, size int64, root []byte) string {
+	text := fmt.Sprintf("rekor.example.com - 1\n%d\n%s\n", size, base64.StdEncoding.EncodeToString(root))
+
+	digest := sha256.Sum256([]byte(text))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	s.Require().NoError(err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	s.Require().NoError(err)
+	id := sha256.Sum256(der)
+
+	return text + "\n— rekor.example.com " + base64.StdEncoding.EncodeToString(append(id[:4], signature...)) + "\n"
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit is the largest power of two smaller than n.
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot and merklePath build RFC 6962 tree heads and inclusion proofs.
+func merkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+
+	k := merkleSplit(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+func merklePath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) == 1 {
+		return [][]byte{}
+	}
+
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merklePath(index, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(index-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+func (s *SigstoreTest) TestVerifyAcceptsValidBundle() {
+	b := s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+
+	identity, err := b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.NoError(err)
+	s.Equal("gemma@example.com", identity)
+}
+
+func (s *SigstoreTest) TestVerifyRejectsChangedArtifact() {
+	b := s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+
+	_, err := b.verify(strings.NewReader("echo pwned"), s.trust)
+	s.EqualError(err, "The Sigstore bundle is for a different file")
+
+	b.MessageSignature.MessageDigest.Digest = nil
+	_, err = b.verify(strings.NewReader("echo pwned"), s.trust)
+	s.EqualError(err, "Failed to verify Sigstore signature")
+}
+
+func (s *SigstoreTest) TestVerifyEnforcesIdentityAndIssuer() {
+	b := s.bundle(s.artifact, "mallory@example.com", "https://accounts.example.com")
+	_, err := b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Sigstore certificate belongs to mallory@example.com, not gemma@example.com")
+
+	b = s.bundle(s.artifact, "gemma@example.com", "https://evil.example.com")
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, `The Sigstore certificate was issued by "https://evil.example.com", not "https://accounts.example.com"`)
+
+	trust := *s.trust
+	trust.identity = ""
+	_, err = b.verify(strings.NewReader(string(s.artifact)), &trust)
+	s.Error(err)
+}
+
+func (s *SigstoreTest) TestVerifyRejectsUntrustedCertificate() {
+	b := s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+
+	trust := *s.trust
+	trust.roots = nil
+	_, err := b.verify(strings.NewReader(string(s.artifact)), &trust)
+	s.Error(err)
+	s.Contains(err.Error(), "The Sigstore certificate isn't trusted")
+
+	// the certificate has to have been valid when the entry was logged
+	entry := &b.VerificationMaterial.TlogEntries[0]
+	entry.IntegratedTime = time.Now().Unix()
+	s.promise(entry, s.rekorKey)
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.Error(err)
+	s.Contains(err.Error(), "The Sigstore certificate isn't trusted")
+}
+
+func (s *SigstoreTest) TestVerifyOnlyTrustsSignedTimestamps() {
+	// the hour-old certificate expired long ago, so the bundle can't claim
+	// it was logged at some other time
+	b := s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+	b.VerificationMaterial.TlogEntries[0].IntegratedTime = time.Now().Add(-time.Hour).Add(time.Second).Unix()
+	_, err := b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Rekor entry's timestamp isn't signed by a trusted key")
+
+	forger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	s.promise(&b.VerificationMaterial.TlogEntries[0], forger)
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Rekor entry's timestamp isn't signed by a trusted key")
+
+	// without a promise, the inclusion proof is enough to use the
+	// entry's time
+	b.VerificationMaterial.TlogEntries[0].InclusionPromise = nil
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.NoError(err)
+
+	b.VerificationMaterial.TlogEntries[0].IntegratedTime = time.Now().Unix()
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.Error(err)
+	s.Contains(err.Error(), "The Sigstore certificate isn't trusted")
+}
+
+func (s *SigstoreTest) TestVerifyRejectsBadLogEntries() {
+	b := s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+	b.VerificationMaterial.TlogEntries = nil
+	_, err := b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Sigstore bundle doesn't have a transparency log entry")
+
+	b = s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+	b.VerificationMaterial.TlogEntries[0].LogID.KeyID = []byte("somebody else")
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Rekor entry is from an untrusted log")
+
+	b = s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+	b.VerificationMaterial.TlogEntries[0].InclusionProof.Hashes[0] = make([]byte, 32)
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Rekor inclusion proof doesn't match the log root")
+
+	// an entry for some other signature doesn't count
+	other := s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+	b = s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+	b.VerificationMaterial.TlogEntries = other.VerificationMaterial.TlogEntries
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Rekor entry is for a different signature")
+}
+
+func (s *SigstoreTest) TestVerifyRejectsUntrustedCheckpoint() {
+	b := s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com")
+	proof := b.VerificationMaterial.TlogEntries[0].InclusionProof
+
+	forger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	s.Require().NoError(err)
+	proof.Checkpoint.Envelope = s.checkpoint(forger, proof.TreeSize, proof.RootHash)
+
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Rekor checkpoint isn't signed by a trusted key")
+
+	proof.Checkpoint.Envelope = s.checkpoint(s.rekorKey, proof.TreeSize+1, proof.RootHash)
+	_, err = b.verify(strings.NewReader(string(s.artifact)), s.trust)
+	s.EqualError(err, "The Rekor checkpoint doesn't match the inclusion proof")
+}
+
+func (s *SigstoreTest) TestVerifyInclusionForEveryLeaf() {
+	for size := 1; size <= 9; size++ {
+		leaves := [][]byte{}
+		for i := 0; i < size; i++ {
+			hash := sha256.Sum256([]byte{0, byte(i)})
+			leaves = append(leaves, hash[:])
+		}
+		root := merkleRoot(leaves)
+
+		for index := 0; index < size; index++ {
+			err := verifyInclusion(int64(index), int64(size), leaves[index], merklePath(index, leaves), root)
+			s.NoError(err, "leaf %d of %d", index, size)
+		}
+
+		s.Error(verifyInclusion(int64(size), int64(size), leaves[0], merklePath(0, leaves), root))
+	}
+}
+
+func (s *SigstoreTest) TestParseRejectsOtherFormats() {
+	_, err := parseSigstoreBundle([]byte(`{"mediaType": "application/json"}`))
+	s.EqualError(err, "Not a Sigstore bundle")
+
+	_, err = parseSigstoreBundle([]byte(`{"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json", "dsseEnvelope": {}}`))
+	s.Error(err)
+}
+
+func (s *SigstoreTest) TestSignatureVerifiesSigstoreFormat() {
+	script := filepath.Join(s.dir, "install.sh")
+	s.Require().NoError(ioutil.WriteFile(script, s.artifact, 0644))
+
+	contents, err := json.Marshal(s.bundle(s.artifact, "gemma@example.com", "https://accounts.example.com"))
+	s.Require().NoError(err)
+	s.Require().NoError(ioutil.WriteFile(script+".sigstore.json", contents, 0644))
+
+	sig := Signature{
+		script:   &Script{filename: script, source: script},
+		filename: filepath.Join(s.dir, "downloaded.sig"),
+	}
+	defer os.Remove(sig.Name())
+
+	format, err := sig.Format()
+	s.NoError(err)
+	s.Equal(formatSigstore, format)
+	s.Equal(script+".sigstore.json", sig.Source())
+
+	s.EqualError(sig.Verify(), "No Sigstore trust roots configured")
+
+	sig.UseSigstore(s.trust)
+	s.NoError(sig.Verify())
+}
+
+func TestSigstoreTest(t *testing.T) {
+	suite.Run(t, new(SigstoreTest))
+}
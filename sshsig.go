@@ -0,0 +1,351 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshsigMagic starts every `ssh-keygen -Y sign` signature, and the blob it
+// signs. See PROTOCOL.sshsig in the OpenSSH source.
+const sshsigMagic = "SSHSIG"
+
+// sshSignature is a parsed SSH signature.
+type sshSignature struct {
+	key           ssh.PublicKey
+	namespace     string
+	hashAlgorithm string
+	signature     *ssh.Signature
+}
+
+// sshSigner is one entry from an allowed_signers file: a key, the identities
+// it's allowed to sign for, and the namespaces it's allowed to sign in.
+type sshSigner struct {
+	principals  []string
+	key         ssh.PublicKey
+	namespaces  []string
+	validAfter  time.Time
+	validBefore time.Time
+}
+
+// parseSSHSignature decodes an armored SSH signature.
+func parseSSHSignature(armored []byte) (*sshSignature, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, errors.New("Not an SSH signature")
+	}
+
+	if !bytes.HasPrefix(block.Bytes, []byte(sshsigMagic)) {
+		return nil, errors.New("Invalid SSH signature preamble")
+	}
+
+	var wire struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[len(sshsigMagic):], &wire); err != nil {
+		return nil, err
+	}
+	if wire.Version != 1 {
+		return nil, fmt.Errorf("Unsupported SSH signature version %d", wire.Version)
+	}
+
+	key, err := ssh.ParsePublicKey(wire.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(wire.Signature, signature); err != nil {
+		return nil, err
+	}
+
+	return &sshSignature{
+		key:           key,
+		namespace:     wire.Namespace,
+		hashAlgorithm: wire.HashAlgorithm,
+		signature:     signature,
+	}, nil
+}
+
+// signedData builds the blob that was actually signed for message.
+func (s sshSignature) signedData(message io.Reader) ([]byte, error) {
+	var hash crypto.Hash
+	switch s.hashAlgorithm {
+	case "sha256":
+		hash = crypto.SHA256
+	case "sha512":
+		hash = crypto.SHA512
+	default:
+		return nil, errors.New("Unsupported SSH signature hash " + s.hashAlgorithm)
+	}
+
+	h := hash.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+
+	return append([]byte(sshsigMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{s.namespace, "", s.hashAlgorithm, h.Sum(nil)})...), nil
+}
+
+// verify checks the signature over message. The signature has to be made in
+// namespace, by a key one of the signers allows for identity.
+func (s sshSignature) verify(message io.Reader, namespace string, identity string, signers []sshSigner) (ssh.PublicKey, error) {
+	if s.namespace != namespace {
+		return nil, fmt.Errorf("The SSH signature is for namespace %q, not %q", s.namespace, namespace)
+	}
+
+	allowed := false
+	for _, signer := range signers {
+		if signer.allows(s.key, namespace, identity, time.Now()) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("No allowed signer for %s has the key %s", identity, ssh.FingerprintSHA256(s.key))
+	}
+
+	// like ssh-keygen, RSA signatures have to use SHA-2
+	if s.key.Type() == ssh.KeyAlgoRSA && s.signature.Format != ssh.KeyAlgoRSASHA256 && s.signature.Format != ssh.KeyAlgoRSASHA512 {
+		return nil, fmt.Errorf("SSH signatures in the %s format aren't accepted; sign with rsa-sha2-512 instead", s.signature.Format)
+	}
+
+	data, err := s.signedData(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.key.Verify(data, s.signature); err != nil {
+		return nil, errors.New("Failed to verify SSH signature")
+	}
+
+	return s.key, nil
+}
+
+// allows is true if the signer has key and is allowed to sign for identity
+// in namespace at time now.
+func (s sshSigner) allows(key ssh.PublicKey, namespace string, identity string, now time.Time) bool {
+	if !bytes.Equal(s.key.Marshal(), key.Marshal()) {
+		return false
+	}
+
+	if !s.validAfter.IsZero() && now.Before(s.validAfter) {
+		return false
+	}
+	if !s.validBefore.IsZero() && now.After(s.validBefore) {
+		return false
+	}
+
+	if len(s.namespaces) > 0 && !matchesAny(s.namespaces, namespace) {
+		return false
+	}
+
+	return len(s.principals) == 0 || matchesAny(s.principals, identity)
+}
+
+// matchesAny is true if value matches any of the wildcard patterns. A pattern
+// starting with ! rules the value out entirely.
+func matchesAny(patterns []string, value string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if matchPattern(strings.TrimPrefix(pattern, "!"), value) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// matchPattern matches value against an OpenSSH wildcard pattern, where *
+// is any run of characters (including none) and ? is any one character.
+// Nothing else is special.
+func matchPattern(pattern, value string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(value); i++ {
+				if matchPattern(pattern, value[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if value == "" {
+				return false
+			}
+		default:
+			if value == "" || value[0] != pattern[0] {
+				return false
+			}
+		}
+
+		pattern, value = pattern[1:], value[1:]
+	}
+
+	return value == ""
+}
+
+// readAllowedSigners loads an allowed_signers file, in the format
+// `ssh-keygen -Y verify` uses:
+//
+//	principals [options] keytype base64-key [comment]
+//
+// cert-authority entries aren't supported, and are skipped.
+func readAllowedSigners(filename string) ([]sshSigner, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	signers := []sshSigner{}
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		principals, rest := splitPrincipals(line)
+		if principals == "" || rest == "" {
+			return nil, fmt.Errorf("%s:%d: missing public key", filename, n)
+		}
+
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+		}
+
+		signer := sshSigner{key: key, principals: strings.Split(principals, ",")}
+		skip := false
+
+		for _, option := range options {
+			name, value := option, ""
+			if idx := strings.Index(option, "="); idx >= 0 {
+				name, value = option[:idx], strings.Trim(option[idx+1:], `"`)
+			}
+
+			switch strings.ToLower(name) {
+			case "cert-authority":
+				skip = true
+			case "namespaces":
+				signer.namespaces = strings.Split(value, ",")
+			case "valid-after":
+				signer.validAfter, err = parseSSHTime(value)
+			case "valid-before":
+				signer.validBefore, err = parseSSHTime(value)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+			}
+		}
+
+		if !skip {
+			signers = append(signers, signer)
+		}
+	}
+
+	return signers, scanner.Err()
+}
+
+// splitPrincipals splits the principals off the front of an allowed_signers
+// line. They end at the first space or tab, unless they're quoted.
+func splitPrincipals(line string) (string, string) {
+	if strings.HasPrefix(line, `"`) {
+		end := strings.Index(line[1:], `"`)
+		if end < 0 {
+			return "", ""
+		}
+		return line[1 : end+1], strings.TrimSpace(line[end+2:])
+	}
+
+	fields := strings.Fields(line)
+	return fields[0], strings.TrimSpace(line[len(fields[0]):])
+}
+
+// parseSSHTime reads the YYYYMMDD[HHMM[SS]][Z] timestamps from allowed_signers
+// options. They're in local time unless they end in Z.
+func parseSSHTime(value string) (time.Time, error) {
+	location := time.Local
+	if strings.HasSuffix(value, "Z") {
+		location = time.UTC
+		value = strings.TrimSuffix(value, "Z")
+	}
+
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(layout) != len(value) {
+			continue
+		}
+
+		return time.ParseInLocation(layout, value, location)
+	}
+
+	return time.Time{}, errors.New("Invalid time " + value)
+}
+
+// sshSignersForKeys allows each of keys to sign anything, for anybody. It's
+// for keys that were already looked up for the author.
+func sshSignersForKeys(keys []ssh.PublicKey) []sshSigner {
+	signers := []sshSigner{}
+	for _, key := range keys {
+		signers = append(signers, sshSigner{key: key})
+	}
+
+	return signers
+}
+
+// sshVerifier checks `ssh-keygen -Y sign` signatures. The author has to be
+// one of the principals the signing key is allowed for.
+type sshVerifier struct{}
+
+func (sshVerifier) Verify(artifact io.Reader, signature []byte, trust Trust) (Signer, error) {
+	parsed, err := parseSSHSignature(signature)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	key, err := parsed.verify(artifact, trust.SSHNamespace, trust.Author, trust.SSHSigners)
+	if err != nil {
+		return Signer{}, err
+	}
+
+	return Signer{Name: trust.Author, Key: ssh.FingerprintSHA256(key)}, nil
+}
@@ -0,0 +1,252 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+)
+
+type SSHSigTest struct {
+	suite.Suite
+	signature *sshSignature
+	signers   []sshSigner
+}
+
+// fixtures/signed.ssh.sig was made with
+// `ssh-keygen -Y sign -f key -n file fixtures/signed.ssh`.
+func (s *SSHSigTest) SetupTest() {
+	contents, err := ioutil.ReadFile("fixtures/signed.ssh.sig")
+	s.Require().NoError(err)
+
+	s.signature, err = parseSSHSignature(contents)
+	s.Require().NoError(err)
+
+	s.signers, err = readAllowedSigners("fixtures/allowed_signers")
+	s.Require().NoError(err)
+}
+
+func (s *SSHSigTest) script() *os.File {
+	f, err := os.Open("fixtures/signed.ssh")
+	s.Require().NoError(err)
+	return f
+}
+
+func (s *SSHSigTest) TestParseReadsFields() {
+	s.Equal("file", s.signature.namespace)
+	s.Equal("sha512", s.signature.hashAlgorithm)
+	s.Equal("ssh-ed25519", s.signature.key.Type())
+}
+
+func (s *SSHSigTest) TestParseRejectsOtherFormats() {
+	_, err := parseSSHSignature([]byte("-----BEGIN PGP SIGNATURE-----\n\nfoo\n-----END PGP SIGNATURE-----\n"))
+	s.Error(err)
+
+	_, err = parseSSHSignature([]byte("-----BEGIN SSH SIGNATURE-----\nZm9vYmFy\n-----END SSH SIGNATURE-----\n"))
+	s.Error(err)
+}
+
+func (s *SSHSigTest) TestVerifyAcceptsAllowedSigner() {
+	script := s.script()
+	defer script.Close()
+
+	key, err := s.signature.verify(script, "file", "gemma", s.signers)
+	s.NoError(err)
+	s.Equal(s.signature.key, key)
+}
+
+func (s *SSHSigTest) TestVerifyEnforcesNamespace() {
+	script := s.script()
+	defer script.Close()
+
+	_, err := s.signature.verify(script, "git", "gemma", s.signers)
+	s.EqualError(err, `The SSH signature is for namespace "file", not "git"`)
+}
+
+func (s *SSHSigTest) TestVerifyEnforcesPrincipal() {
+	script := s.script()
+	defer script.Close()
+
+	_, err := s.signature.verify(script, "file", "somebody", s.signers)
+	s.Error(err)
+	s.Contains(err.Error(), "No allowed signer for somebody")
+}
+
+func (s *SSHSigTest) TestVerifyRejectsChangedScript() {
+	_, err := s.signature.verify(strings.NewReader("echo pwned"), "file", "gemma", s.signers)
+	s.EqualError(err, "Failed to verify SSH signature")
+}
+
+func (s *SSHSigTest) TestVerifyAcceptsLookedUpKeys() {
+	script := s.script()
+	defer script.Close()
+
+	_, err := s.signature.verify(script, "file", "anybody", sshSignersForKeys([]ssh.PublicKey{s.signers[0].key}))
+	s.NoError(err)
+}
+
+func (s *SSHSigTest) TestSignerAllowsChecksOptions() {
+	key := s.signers[0].key
+	now := time.Now()
+
+	s.True(sshSigner{key: key}.allows(key, "file", "gemma", now))
+	s.True(sshSigner{key: key, principals: []string{"*@example.com"}}.allows(key, "file", "gemma@example.com", now))
+	s.False(sshSigner{key: key, principals: []string{"*@example.com", "!gemma@example.com"}}.allows(key, "file", "gemma@example.com", now))
+	s.False(sshSigner{key: key, namespaces: []string{"git"}}.allows(key, "file", "gemma", now))
+	s.False(sshSigner{key: key, validBefore: now.Add(-time.Hour)}.allows(key, "file", "gemma", now))
+	s.False(sshSigner{key: key, validAfter: now.Add(time.Hour)}.allows(key, "file", "gemma", now))
+}
+
+func (s *SSHSigTest) TestMatchPatternFollowsOpenSSH() {
+	for _, match := range [][2]string{
+		{"*", "gemma"},
+		{"*@example.com", "gemma/ops@example.com"},
+		{"gem?a", "gemma"},
+		{"[gemma]", "[gemma]"},
+		{"a*b*c", "abbbc"},
+	} {
+		s.True(matchPattern(match[0], match[1]), match[0])
+	}
+
+	for _, match := range [][2]string{
+		{"[g]emma", "gemma"},
+		{"gem?a", "gema"},
+		{"*@example.com", "gemma@example.org"},
+		{"a*b*c", "abbbcd"},
+	} {
+		s.False(matchPattern(match[0], match[1]), match[0])
+	}
+}
+
+func (s *SSHSigTest) TestVerifyRejectsSHA1RSASignatures() {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	s.Require().NoError(err)
+	signer, err := ssh.NewSignerFromKey(private)
+	s.Require().NoError(err)
+
+	signature := &sshSignature{key: signer.PublicKey(), namespace: "file", hashAlgorithm: "sha512"}
+	data, err := signature.signedData(strings.NewReader("echo hi\n"))
+	s.Require().NoError(err)
+	signers := sshSignersForKeys([]ssh.PublicKey{signer.PublicKey()})
+
+	for _, algorithm := range []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512} {
+		signature.signature, err = signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, algorithm)
+		s.Require().NoError(err)
+		_, err = signature.verify(strings.NewReader("echo hi\n"), "file", "gemma", signers)
+		s.NoError(err, algorithm)
+	}
+
+	signature.signature, err = signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSA)
+	s.Require().NoError(err)
+	_, err = signature.verify(strings.NewReader("echo hi\n"), "file", "gemma", signers)
+	s.Error(err)
+}
+
+func (s *SSHSigTest) TestReadAllowedSignersHandlesOptions() {
+	f, err := ioutil.TempFile("", "pipethis-test-")
+	s.Require().NoError(err)
+	defer os.Remove(f.Name())
+
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINwQo4L8IwVH+a+f8EUjv0VuvJ4SsH38FuzQ8YaPLBvm"
+	f.WriteString("# a comment\n\n")
+	f.WriteString("gemma,*@example.com " + key + " a comment\n")
+	f.WriteString(`gemma namespaces="file,git",valid-before="20200101Z" ` + key + "\n")
+	f.WriteString("*@example.com cert-authority " + key + "\n")
+	f.Close()
+
+	signers, err := readAllowedSigners(f.Name())
+	s.NoError(err)
+	s.Len(signers, 2)
+
+	s.Equal([]string{"gemma", "*@example.com"}, signers[0].principals)
+	s.Empty(signers[0].namespaces)
+
+	s.Equal([]string{"file", "git"}, signers[1].namespaces)
+	s.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), signers[1].validBefore)
+}
+
+func (s *SSHSigTest) TestReadAllowedSignersHandlesTabs() {
+	signers, err := readAllowedSigners("fixtures/allowed_signers.tabs")
+	s.Require().NoError(err)
+	s.Require().Len(signers, 2)
+
+	s.Equal([]string{"gemma"}, signers[0].principals)
+	s.Equal([]string{"file", "git"}, signers[0].namespaces)
+	s.Equal(s.signers[0].key.Marshal(), signers[0].key.Marshal())
+
+	s.Equal([]string{"gemma@example.com", "*@ops.example.com"}, signers[1].principals)
+	s.Empty(signers[1].namespaces)
+}
+
+func (s *SSHSigTest) TestReadAllowedSignersRejectsBadLines() {
+	for _, line := range []string{"gemma\n", "\"gemma ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINwQo4L8IwVH+a+f8EUjv0VuvJ4SsH38FuzQ8YaPLBvm\n"} {
+		f, err := ioutil.TempFile("", "pipethis-test-")
+		s.Require().NoError(err)
+		defer os.Remove(f.Name())
+
+		f.WriteString(line)
+		f.Close()
+
+		_, err = readAllowedSigners(f.Name())
+		s.Error(err, line)
+	}
+}
+
+func (s *SSHSigTest) TestParseSSHTime() {
+	t, err := parseSSHTime("20200102")
+	s.NoError(err)
+	s.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local), t)
+
+	t, err = parseSSHTime("202001020304Z")
+	s.NoError(err)
+	s.Equal(time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC), t)
+
+	t, err = parseSSHTime("20200102030405Z")
+	s.NoError(err)
+	s.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), t)
+
+	_, err = parseSSHTime("2020")
+	s.Error(err)
+}
+
+func (s *SSHSigTest) TestSignatureVerifiesSSHFormat() {
+	sig := Signature{
+		script:   &Script{filename: "fixtures/signed.ssh"},
+		filename: "fixtures/signed.ssh.sig",
+	}
+	sig.UseSSHSigners(s.signers, "file")
+
+	format, err := sig.Format()
+	s.NoError(err)
+	s.Equal(formatSSH, format)
+	s.NoError(sig.Verify())
+}
+
+func (s *SSHSigTest) TestSignatureFailsSSHFormatWithoutSigners() {
+	sig := Signature{
+		script:   &Script{filename: "fixtures/signed.ssh"},
+		filename: "fixtures/signed.ssh.sig",
+	}
+	sig.UseSSHSigners(nil, "file")
+
+	s.Error(sig.Verify())
+}
+
+func TestSSHSigTest(t *testing.T) {
+	suite.Run(t, new(SSHSigTest))
+}
@@ -0,0 +1,116 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Verifier checks one kind of detached signature over an artifact, and
+// returns who made it.
+type Verifier interface {
+	Verify(artifact io.Reader, signature []byte, trust Trust) (Signer, error)
+}
+
+// Signer is who made a verified signature. Key identifies the key (or for
+// Sigstore, the certificate identity) the signature was made with: a PGP
+// fingerprint, an SSH SHA256 fingerprint, or a minisign key ID.
+type Signer struct {
+	Name string
+	Key  string
+}
+
+func (s Signer) String() string {
+	if s.Name == "" {
+		return s.Key
+	}
+
+	return s.Name + " (" + s.Key + ")"
+}
+
+// Trust is the trust material a Verifier checks a signature against. Each
+// Verifier only looks at the parts it needs.
+type Trust struct {
+	// Author is who the signature has to be from, for the formats that check
+	// the script author.
+	Author string
+
+	PGPKeys      openpgp.KeyRing
+	SSHSigners   []sshSigner
+	SSHNamespace string
+	Sigstore     *sigstoreTrust
+	MinisignKeys []*minisignKey
+}
+
+// verifiers has a Verifier for every signature format pipethis knows.
+var verifiers = map[string]Verifier{
+	formatPGP:      pgpVerifier{},
+	formatSSH:      sshVerifier{},
+	formatSigstore: sigstoreVerifier{},
+	formatMinisign: minisignVerifier{},
+	formatSignify:  minisignVerifier{},
+}
+
+// VerifierFor returns the Verifier for a signature format.
+func VerifierFor(format string) (Verifier, error) {
+	verifier, ok := verifiers[format]
+	if !ok {
+		return nil, errors.New("Unsupported signature format " + format)
+	}
+
+	return verifier, nil
+}
+
+// pgpVerifier checks armored or binary detached PGP signatures.
+type pgpVerifier struct{}
+
+func (pgpVerifier) Verify(artifact io.Reader, signature []byte, trust Trust) (Signer, error) {
+	if trust.PGPKeys == nil {
+		return Signer{}, errors.New("No PGP key to verify the signature with")
+	}
+
+	var signer *openpgp.Entity
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		signer, err = openpgp.CheckArmoredDetachedSignature(trust.PGPKeys, artifact, bytes.NewReader(signature), nil)
+	} else {
+		signer, err = openpgp.CheckDetachedSignature(trust.PGPKeys, artifact, bytes.NewReader(signature), nil)
+	}
+	if err != nil {
+		return Signer{}, errors.New("Failed to verify signature")
+	}
+
+	return Signer{Name: primaryIdentity(signer), Key: fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)}, nil
+}
+
+// primaryIdentity is the name of the entity's primary user ID, or the first
+// one alphabetically if none is marked primary.
+func primaryIdentity(entity *openpgp.Entity) string {
+	names := []string{}
+	for name, identity := range entity.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+	return names[0]
+}
@@ -0,0 +1,116 @@
+/*
+pipethis: Stop piping the internet into your shell
+Copyright 2016 Ellotheth
+
+Use of this source code is governed by the GNU Public License version 2
+(GPLv2). You should have received a copy of the GPLv2 along with your copy of
+the source. If not, see http://www.gnu.org/licenses/gpl-2.0.html.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/suite"
+)
+
+type VerifierTest struct {
+	suite.Suite
+	entity *openpgp.Entity
+}
+
+func (s *VerifierTest) SetupSuite() {
+	var err error
+	s.entity, err = openpgp.NewEntity("Gemma", "", "gemma@example.com", nil)
+	s.Require().NoError(err)
+}
+
+func (s *VerifierTest) TestVerifierForKnownFormats() {
+	for _, format := range []string{formatPGP, formatSSH, formatSigstore, formatMinisign, formatSignify} {
+		verifier, err := VerifierFor(format)
+		s.NoError(err, format)
+		s.NotNil(verifier, format)
+	}
+
+	_, err := VerifierFor("x509")
+	s.EqualError(err, "Unsupported signature format x509")
+}
+
+func (s *VerifierTest) TestPGPVerifierAcceptsArmoredAndBinary() {
+	message := "#!/bin/sh\necho hello\n"
+	expected := Signer{Name: "Gemma <gemma@example.com>", Key: fmt.Sprintf("%X", s.entity.PrimaryKey.Fingerprint)}
+
+	armored := &bytes.Buffer{}
+	s.Require().NoError(openpgp.ArmoredDetachSign(armored, s.entity, strings.NewReader(message), nil))
+	binary := &bytes.Buffer{}
+	s.Require().NoError(openpgp.DetachSign(binary, s.entity, strings.NewReader(message), nil))
+
+	for _, signature := range [][]byte{armored.Bytes(), binary.Bytes()} {
+		signer, err := pgpVerifier{}.Verify(strings.NewReader(message), signature, Trust{PGPKeys: openpgp.EntityList{s.entity}})
+		s.NoError(err)
+		s.Equal(expected, signer)
+
+		_, err = pgpVerifier{}.Verify(strings.NewReader("echo pwned"), signature, Trust{PGPKeys: openpgp.EntityList{s.entity}})
+		s.EqualError(err, "Failed to verify signature")
+	}
+}
+
+func (s *VerifierTest) TestPGPVerifierNeedsKeys() {
+	_, err := pgpVerifier{}.Verify(strings.NewReader("foo"), []byte("bar"), Trust{})
+	s.Error(err)
+}
+
+// The fixtures were made with GnuPG 2.2:
+//
+//	gpg --quick-gen-key "Gemma Ed <gemma-ed25519@example.com>" ed25519 sign never
+//	gpg --detach-sign -a -o fixtures/signed.ed25519.sig fixtures/signed.ed25519
+//	gpg --clearsign -o fixtures/signed.ed25519.attached unsigned.sh
+//	gpg --quick-gen-key "Gemma RSA <gemma-rsa4096@example.com>" rsa4096 sign never
+//	gpg --detach-sign -o fixtures/signed.rsa4096.sig fixtures/signed.rsa4096
+func (s *VerifierTest) TestModernKeysVerify() {
+	for _, name := range []string{"ed25519", "rsa4096"} {
+		ring, err := readKeyFile("fixtures/" + name + ".asc")
+		s.Require().NoError(err, name)
+
+		sig := Signature{
+			script:   &Script{filename: "fixtures/signed." + name},
+			filename: "fixtures/signed." + name + ".sig",
+		}
+		sig.UseKey(ring)
+
+		signer, err := sig.VerifyWith(pgpVerifier{})
+		s.NoError(err, name)
+		s.Contains(signer.Name, "gemma-"+name+"@example.com", name)
+	}
+}
+
+func (s *VerifierTest) TestClearsignedModernKeyVerifies() {
+	ring, err := readKeyFile("fixtures/ed25519.asc")
+	s.Require().NoError(err)
+
+	script, err := NewScript("fixtures/signed.ed25519.attached")
+	s.Require().NoError(err)
+	defer os.Remove(script.Name())
+	s.True(script.IsClearsigned())
+
+	sig := NewSignature(ring, script, "")
+	defer os.Remove(sig.Name())
+
+	signer, err := sig.VerifyWith(pgpVerifier{})
+	s.NoError(err)
+	s.Equal("Gemma Ed <gemma-ed25519@example.com> (22B5F4DF9CBF8FF3659A6E49C5DF7ACA675E5260)", signer.String())
+
+	author, err := script.Author()
+	s.NoError(err)
+	s.Equal("gemma-ed25519@example.com", author)
+}
+
+func TestVerifierTest(t *testing.T) {
+	suite.Run(t, new(VerifierTest))
+}